@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	ps "github.com/jetrmm/go-sysinfo"
-	"github.com/jetrmm/rmm-agent/shared"
 	jrmm "github.com/jetrmm/rmm-shared"
 	"github.com/kardianos/service"
 	"github.com/nats-io/nats.go"
@@ -35,15 +34,6 @@ type InfoCollector interface {
 	GetCPULoadAvg() int
 }
 
-type TaskChecker interface {
-	ScriptCheck(data shared.Check, r *resty.Client)
-	DiskCheck(data shared.Check, r *resty.Client)
-	CPULoadCheck(data shared.Check, r *resty.Client)
-	MemCheck(data shared.Check, r *resty.Client)
-	PingCheck(data shared.Check, r *resty.Client)
-	// CheckService(data shared.X, r *resty.Client)
-}
-
 type TaskScheduler interface {
 	RunTask(int) // currently in baseAgent
 	CreateTask(task any) (bool, error)
@@ -138,8 +128,13 @@ type IAgent interface {
 type Agent struct {
 	IAgent
 	*AgentConfig
-	Logger  *logrus.Logger
-	RClient *resty.Client
+	Logger    *logrus.Logger
+	RClient   *resty.Client
+	Checks    *CheckEngine
+	Scheduler *CheckScheduler
+	Sampler   *Sampler
+	Outbox    *Outbox
+	Jobs      *JobManager
 }
 
 func (a *Agent) Start(s service.Service) error {
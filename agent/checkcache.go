@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const CHECK_CACHE_FILE = "checks.cache"
+
+var errCheckCacheTampered = errors.New("check cache failed its integrity check")
+
+// checkCache is the on-disk form of the cached check definitions
+type checkCache struct {
+	MAC  []byte          `json:"mac"`
+	Data json.RawMessage `json:"data"`
+}
+
+// checkCachePath returns where the check cache is kept, in the agent's
+// state dir so it can't be deleted or planted by other users
+func (a *Agent) checkCachePath() (string, error) {
+	dir, err := a.stateDir("")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, CHECK_CACHE_FILE), nil
+}
+
+// checkCacheMAC signs the cached definitions with a key only this agent
+// knows, so a local user can't plant checks (and their scripts) in the cache
+func (a *Agent) checkCacheMAC(data []byte) []byte {
+	key := sha256.Sum256([]byte("rmm-check-cache:" + a.AgentID + ":" + a.Token))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// SaveCheckCache stores the check definitions for use while offline
+func (a *Agent) SaveCheckCache(data shared.AllChecks) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(checkCache{MAC: a.checkCacheMAC(raw), Data: raw})
+	if err != nil {
+		return err
+	}
+
+	path, err := a.checkCachePath()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadCheckCache returns the cached check definitions, if they are intact
+func (a *Agent) LoadCheckCache() (shared.AllChecks, error) {
+	data := shared.AllChecks{}
+	path, err := a.checkCachePath()
+	if err != nil {
+		return data, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return data, err
+	}
+
+	var cache checkCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return data, err
+	}
+	if !hmac.Equal(cache.MAC, a.checkCacheMAC(cache.Data)) {
+		return data, errCheckCacheTampered
+	}
+	if err := json.Unmarshal(cache.Data, &data); err != nil {
+		return data, err
+	}
+	return data, nil
+}
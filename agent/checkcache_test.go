@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestCheckCacheInStateDir(t *testing.T) {
+	root := t.TempDir()
+	a := &Agent{AgentConfig: &AgentConfig{AgentID: "agent", Token: "token", StateDir: root}, Logger: testLogger()}
+	checks := shared.AllChecks{Checks: []shared.Check{{CheckPK: 1}, {CheckPK: 2}}}
+	if err := a.SaveCheckCache(checks); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, CHECK_CACHE_FILE)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.LoadCheckCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Checks) != 2 || got.Checks[1].CheckPK != 2 {
+		t.Errorf("LoadCheckCache() = %+v, want %+v", got, checks)
+	}
+
+	other := &Agent{AgentConfig: &AgentConfig{AgentID: "agent", Token: "other", StateDir: root}, Logger: testLogger()}
+	if _, err := other.LoadCheckCache(); err != errCheckCacheTampered {
+		t.Errorf("LoadCheckCache() with another key = %v, want errCheckCacheTampered", err)
+	}
+}
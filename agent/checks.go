@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CHECK_WORKERS         = 4
+	CHECK_DEFAULT_TIMEOUT = 60 // seconds
+	// grace on top of the check's own timeout, so script checks can report
+	// their own timeout (exit code 98) before the engine gives up on them
+	CHECK_TIMEOUT_GRACE = 5 * time.Second
+	CHECK_JITTER_MIN_MS = 300
+	CHECK_JITTER_MAX_MS = 950
+)
+
+// CheckResult is the outcome of one check run. Status and Severity are
+// optional, checks that leave grading to the server only set Fields.
+type CheckResult struct {
+	Status   string
+	Severity string
+	Fields   map[string]interface{}
+	// Delivered is called once the server has accepted the result
+	Delivered func()
+}
+
+// CheckFunc runs a single check. It should honour ctx, but the engine
+// reports a timeout even if it does not.
+type CheckFunc func(ctx context.Context, data shared.Check) CheckResult
+
+// CheckEngine runs check definitions through the check types registered
+// by the platform agent and plugins, and delivers the results
+type CheckEngine struct {
+	logger  *logrus.Logger
+	outbox  *Outbox
+	runTask func(int) error
+	lock    func(string) (*Lock, error)
+	workers int
+	tracker *severityTracker
+
+	mu     sync.RWMutex
+	checks map[string]CheckFunc
+
+	// assigned tasks in flight
+	tasksMu sync.Mutex
+	tasks   map[int]bool
+}
+
+type checkOutcome struct {
+	check  shared.Check
+	result CheckResult
+}
+
+// NewCheckEngine returns an engine that delivers results through outbox,
+// runs the assigned tasks of failing checks with runTask and takes each
+// check's lock with lock
+func NewCheckEngine(logger *logrus.Logger, outbox *Outbox, runTask func(int) error, lock func(string) (*Lock, error)) *CheckEngine {
+	return &CheckEngine{
+		logger:  logger,
+		outbox:  outbox,
+		runTask: runTask,
+		lock:    lock,
+		workers: CHECK_WORKERS,
+		tracker: newSeverityTracker(),
+		checks:  make(map[string]CheckFunc),
+		tasks:   make(map[int]bool),
+	}
+}
+
+// Register adds a check type, registering the same type twice panics
+func (e *CheckEngine) Register(checkType string, fn CheckFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.checks[checkType]; ok {
+		panic(fmt.Sprintf("check type already registered: %s", checkType))
+	}
+	e.checks[checkType] = fn
+}
+
+// Types returns the registered check types
+func (e *CheckEngine) Types() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	ret := make([]string, 0, len(e.checks))
+	for t := range e.checks {
+		ret = append(ret, t)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (e *CheckEngine) lookup(checkType string) (CheckFunc, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	fn, ok := e.checks[checkType]
+	return fn, ok
+}
+
+// Run runs the checks on a bounded worker pool and blocks until every
+// result has been delivered. finished, if not nil, is called for each check
+// as soon as it is delivered or skipped.
+func (e *CheckEngine) Run(ctx context.Context, checks []shared.Check, finished func(shared.Check)) {
+	if finished == nil {
+		finished = func(shared.Check) {}
+	}
+
+	jobs := make(chan shared.Check)
+	results := make(chan checkOutcome)
+
+	var workers sync.WaitGroup
+	for i := 0; i < e.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for check := range jobs {
+				// another agent process may be running the same check
+				lock, err := e.lock(CheckLockName(check.CheckPK))
+				if err != nil {
+					e.logger.Debugln("Skipping check", check.CheckPK, err)
+					finished(check)
+					continue
+				}
+				res := e.tracker.Evaluate(check, e.runOne(ctx, check))
+				lock.Release()
+				results <- checkOutcome{check, res}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for res := range results {
+			e.deliver(res.check, res.result)
+			finished(res.check)
+		}
+	}()
+
+	for _, check := range checks {
+		if _, ok := e.lookup(check.CheckType); !ok {
+			e.logger.Debugln("Unsupported check type:", check.CheckType)
+			finished(check)
+			continue
+		}
+		jobs <- check
+	}
+	close(jobs)
+	workers.Wait()
+	close(results)
+	<-done
+}
+
+// runOne runs a check after a random delay, so checks hitting the same
+// resources don't all start at once, and enforces the check's timeout
+func (e *CheckEngine) runOne(ctx context.Context, check shared.Check) CheckResult {
+	fn, _ := e.lookup(check.CheckType)
+
+	jitter := time.Duration(CHECK_JITTER_MIN_MS+rand.Intn(CHECK_JITTER_MAX_MS-CHECK_JITTER_MIN_MS)) * time.Millisecond
+	select {
+	case <-time.After(jitter):
+	case <-ctx.Done():
+		return checkError(ctx.Err())
+	}
+
+	timeout := CheckTimeout(check) + CHECK_TIMEOUT_GRACE
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	ch := make(chan CheckResult, 1)
+	go func() {
+		ch <- fn(ctx, check)
+	}()
+
+	var res CheckResult
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		e.logger.Debugln("Check", check.CheckPK, check.CheckType, "timed out")
+		res = checkError(fmt.Errorf("check timed out after %s", timeout))
+	}
+
+	if res.Fields == nil {
+		res.Fields = make(map[string]interface{})
+	}
+	runtime := time.Since(start)
+	Stats.ObserveCheck(check.CheckType, runtime)
+	res.Fields["check_runtime"] = runtime.Seconds()
+	return res
+}
+
+// Forget drops the run history of checks that are no longer assigned
+func (e *CheckEngine) Forget(keep []shared.Check) {
+	e.tracker.Forget(keep)
+}
+
+// deliver sends a result to the server through the outbox, then runs the
+// check's assigned tasks if the server says it is failing. When the result
+// is queued instead, the locally evaluated status decides.
+func (e *CheckEngine) deliver(check shared.Check, res CheckResult) {
+	payload := make(map[string]interface{}, len(res.Fields)+3)
+	for k, v := range res.Fields {
+		payload[k] = v
+	}
+	payload["id"] = check.CheckPK
+	if res.Status != "" {
+		payload["status"] = res.Status
+	}
+	if res.Severity != "" {
+		payload["severity"] = res.Severity
+	}
+
+	resp, err := e.outbox.HTTP(fmt.Sprintf("check-%d", check.CheckPK), resty.MethodPatch, API_URL_CHECKRUNNER, payload, func([]byte) {
+		if res.Delivered != nil {
+			res.Delivered()
+		}
+	})
+	if err == ErrQueued {
+		if res.Status == CHECK_STATUS_FAILING {
+			e.runAssignedTasks(check)
+		}
+		return
+	}
+	if err != nil {
+		e.logger.Debugln("CheckRunner:", err)
+		return
+	}
+
+	if string(resp) == CHECK_STATUS_FAILING {
+		e.runAssignedTasks(check)
+	}
+}
+
+// runAssignedTasks starts the enabled tasks assigned to a failing check
+// without waiting for them, so a long task doesn't hold up the delivery of
+// other results. A task still running from an earlier failure is skipped.
+func (e *CheckEngine) runAssignedTasks(check shared.Check) {
+	if e.runTask == nil {
+		return
+	}
+	for _, t := range check.AssignedTasks {
+		if !t.Enabled {
+			continue
+		}
+		e.tasksMu.Lock()
+		if e.tasks[t.TaskPK] {
+			e.tasksMu.Unlock()
+			e.logger.Debugln("Assigned task", t.TaskPK, "is still running")
+			continue
+		}
+		e.tasks[t.TaskPK] = true
+		e.tasksMu.Unlock()
+
+		go func(pk int) {
+			defer func() {
+				e.tasksMu.Lock()
+				delete(e.tasks, pk)
+				e.tasksMu.Unlock()
+			}()
+			if err := e.runTask(pk); err != nil {
+				e.logger.Debugln("Assigned task", pk, err)
+			}
+		}(t.TaskPK)
+	}
+}
+
+// CheckTimeout returns the check's timeout, or the default when unset
+func CheckTimeout(data shared.Check) time.Duration {
+	if data.Timeout <= 0 {
+		return CHECK_DEFAULT_TIMEOUT * time.Second
+	}
+	return time.Duration(data.Timeout) * time.Second
+}
+
+// GetChecks retrieves the agent's check definitions. force returns every
+// check and refreshes the offline cache, otherwise only the checks due to
+// run are returned.
+func (a *Agent) GetChecks(force bool) (shared.AllChecks, error) {
+	data := shared.AllChecks{}
+	var url string
+	if force {
+		url = fmt.Sprintf("/api/v3/%s/runchecks/", a.AgentID)
+	} else {
+		url = fmt.Sprintf("/api/v3/%s/checkrunner/", a.AgentID)
+	}
+
+	r, err := a.RClient.R().Get(url)
+	if err != nil {
+		return data, err
+	}
+	if r.IsError() {
+		return data, fmt.Errorf("checkrunner response code: %v", r.StatusCode())
+	}
+	if err := json.Unmarshal(r.Body(), &data); err != nil {
+		return data, err
+	}
+	if force {
+		if err := a.SaveCheckCache(data); err != nil {
+			a.Logger.Debugln("Check cache:", err)
+		}
+	}
+	return data, nil
+}
+
+// RunChecks retrieves the check definitions and runs them
+func (a *Agent) RunChecks(force bool) error {
+	data, err := a.GetChecks(force)
+	if err != nil {
+		a.Logger.Debugln(err)
+		return err
+	}
+	a.Checks.Run(context.Background(), data.Checks, nil)
+	return nil
+}
+
+// CheckResultFor builds a graded result, failing unless severity is ok.
+// An empty severity leaves the result for the server to grade.
+func CheckResultFor(severity string, fields map[string]interface{}) CheckResult {
+	return CheckResult{
+		Status:   severityStatus(severity),
+		Severity: severity,
+		Fields:   fields,
+	}
+}
+
+// checkError builds a failing result for a check that could not run
+func checkError(err error) CheckResult {
+	return CheckResultFor(CHECK_SEVERITY_ERROR, map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+// thresholdSeverity grades value against the warning and error thresholds,
+// a threshold of 0 is disabled. When lowerIsWorse is set, values at or
+// below a threshold trip it (e.g. days until a certificate expires). With
+// neither set the value isn't graded and "" is returned, the server keeps
+// grading it then.
+func thresholdSeverity(value, warn, err float64, lowerIsWorse bool) string {
+	if warn == 0 && err == 0 {
+		return ""
+	}
+	tripped := func(t float64) bool {
+		if t == 0 {
+			return false
+		}
+		if lowerIsWorse {
+			return value <= t
+		}
+		return value >= t
+	}
+
+	switch {
+	case tripped(err):
+		return CHECK_SEVERITY_ERROR
+	case tripped(warn):
+		return CHECK_SEVERITY_WARNING
+	default:
+		return CHECK_SEVERITY_OK
+	}
+}
+
+// worstSeverity returns the most severe of the given severities, ungraded
+// ones are skipped and "" is returned if none were graded
+func worstSeverity(severities ...string) string {
+	ret := ""
+	for _, s := range severities {
+		switch s {
+		case CHECK_SEVERITY_ERROR:
+			return CHECK_SEVERITY_ERROR
+		case CHECK_SEVERITY_WARNING:
+			ret = CHECK_SEVERITY_WARNING
+		case CHECK_SEVERITY_OK:
+			if ret == "" {
+				ret = CHECK_SEVERITY_OK
+			}
+		}
+	}
+	return ret
+}
+
+// severityStatus maps a severity onto the check status the server expects,
+// an ungraded result has none
+func severityStatus(severity string) string {
+	if severity == "" {
+		return ""
+	}
+	if severity == CHECK_SEVERITY_OK {
+		return CHECK_STATUS_PASSING
+	}
+	return CHECK_STATUS_FAILING
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// testLocks returns a lock function keeping its locks in a test state dir
+func testLocks(t *testing.T) func(string) (*Lock, error) {
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger()}
+	return a.AcquireLock
+}
+
+func TestThresholdSeverity(t *testing.T) {
+	for _, tt := range []struct {
+		value, warn, err float64
+		lowerIsWorse     bool
+		want             string
+	}{
+		{99, 0, 0, false, ""},
+		{50, 80, 90, false, CHECK_SEVERITY_OK},
+		{85, 80, 90, false, CHECK_SEVERITY_WARNING},
+		{95, 80, 90, false, CHECK_SEVERITY_ERROR},
+		{95, 0, 90, false, CHECK_SEVERITY_ERROR},
+		{5, 30, 7, true, CHECK_SEVERITY_ERROR},
+		{20, 30, 7, true, CHECK_SEVERITY_WARNING},
+	} {
+		if got := thresholdSeverity(tt.value, tt.warn, tt.err, tt.lowerIsWorse); got != tt.want {
+			t.Errorf("thresholdSeverity(%v, %v, %v, %v) = %q, want %q", tt.value, tt.warn, tt.err, tt.lowerIsWorse, got, tt.want)
+		}
+	}
+}
+
+func TestWorstSeverity(t *testing.T) {
+	for _, tt := range []struct {
+		in   []string
+		want string
+	}{
+		{[]string{"", ""}, ""},
+		{[]string{"", CHECK_SEVERITY_OK}, CHECK_SEVERITY_OK},
+		{[]string{CHECK_SEVERITY_OK, "", CHECK_SEVERITY_WARNING}, CHECK_SEVERITY_WARNING},
+		{[]string{CHECK_SEVERITY_WARNING, CHECK_SEVERITY_ERROR, ""}, CHECK_SEVERITY_ERROR},
+	} {
+		if got := worstSeverity(tt.in...); got != tt.want {
+			t.Errorf("worstSeverity(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDiskCheckWithoutThresholdsIsUngraded(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{}, Logger: testLogger()}
+	dir := os.TempDir()
+
+	res := a.DiskCheck(context.Background(), shared.Check{Storage: dir})
+	if res.Status != "" || res.Severity != "" {
+		t.Errorf("DiskCheck() without thresholds = %q/%q, want it left to the server", res.Status, res.Severity)
+	}
+
+	// any disk in use is over this
+	res = a.DiskCheck(context.Background(), shared.Check{Storage: dir, ErrorThreshold: 0.0001})
+	if res.Status != CHECK_STATUS_FAILING {
+		t.Errorf("DiskCheck() over its threshold = %q, want %q", res.Status, CHECK_STATUS_FAILING)
+	}
+}
+
+func TestAssignedTasksDontBlockDelivery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte(CHECK_STATUS_FAILING))
+	}))
+	defer srv.Close()
+	ob, err := NewOutbox("", testLogger(), resty.New().SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	defer close(block)
+	var started atomic.Int32
+	engine := NewCheckEngine(testLogger(), ob, func(int) error {
+		started.Add(1)
+		<-block
+		return nil
+	}, testLocks(t))
+	engine.Register("failing", func(context.Context, shared.Check) CheckResult {
+		return CheckResult{}
+	})
+	checks := []shared.Check{{
+		CheckPK:       990101,
+		CheckType:     "failing",
+		AssignedTasks: []shared.AssignedTask{{TaskPK: 1, Enabled: true}, {TaskPK: 2}},
+	}}
+
+	done := make(chan struct{})
+	go func() {
+		engine.Run(context.Background(), checks, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run waited for the assigned task")
+	}
+	waitFor(t, func() bool { return started.Load() == 1 })
+
+	// the task from the first failure is still running
+	engine.Run(context.Background(), checks, nil)
+	time.Sleep(50 * time.Millisecond)
+	if n := started.Load(); n != 1 {
+		t.Errorf("task started %d times, want 1", n)
+	}
+}
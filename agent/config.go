@@ -16,4 +16,18 @@ type AgentConfig struct {
 	Debug   bool
 	Version string
 	Headers map[string]string
+
+	StateDir string // where the outbox, caches and secrets are kept, empty uses the platform default
+
+	ScriptPublisherKeys []string // base64 ed25519 keys scripts must be signed with, empty allows unsigned scripts
+
+	MetricsResolution     int    // seconds between recorded metric points, 0 uses the default
+	MetricsUploadInterval int    // seconds between metric uploads, 0 uses the default
+	PrometheusListen      string // address of the Prometheus endpoint, empty disables it
+	OTLPEndpoint          string // OTLP/HTTP base URL, empty disables the export
+	OTLPHeaders           map[string]string
+	JobRetention          int // seconds finished jobs are kept, 0 uses the default
+	ScriptCacheMB         int // size of the local script cache, 0 uses the default
+	ClientName            string
+	SiteName              string
 }
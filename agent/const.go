@@ -8,17 +8,42 @@ const (
 	// NATS_RMM_IDENTIFIER = "ACMERMM"
 
 	TASK_PREFIX = "RMM_"
+
+	API_URL_CHECKRUNNER = "/api/v3/checkrunner/"
+)
+
+const (
+	CHECK_TYPE_DISKSPACE = "diskspace"
+	CHECK_TYPE_CPULOAD   = "cpuload"
+	CHECK_TYPE_MEMORY    = "memory"
+	CHECK_TYPE_PING      = "ping"
+	CHECK_TYPE_SCRIPT    = "script"
+	CHECK_TYPE_TCP       = "tcp"
+	CHECK_TYPE_HTTP      = "http"
+	CHECK_TYPE_DNS       = "dns"
+	CHECK_TYPE_TLSCERT   = "tlscert"
+
+	CHECK_STATUS_PASSING = "passing"
+	CHECK_STATUS_FAILING = "failing"
+
+	CHECK_SEVERITY_OK      = "ok"
+	CHECK_SEVERITY_WARNING = "warning"
+	CHECK_SEVERITY_ERROR   = "error"
 )
 
 const (
 	NATS_CMD_AGENT_UNINSTALL    = "uninstall"
 	NATS_CMD_AGENT_UPDATE       = "agentupdate"
 	NATS_CMD_CHOCO_INSTALL      = "installwithchoco"
+	NATS_CMD_CHECKS_UPDATE      = "checksupdate"
 	NATS_CMD_CPULOADAVG         = "cpuloadavg"
 	NATS_CMD_EVENTLOG           = "eventlog"
 	NATS_CMD_GETWINUPDATES      = "getwinupdates"
 	NATS_CMD_INSTALL_CHOCO      = "installchoco"
 	NATS_CMD_INSTALL_WINUPDATES = "installwinupdates"
+	NATS_CMD_JOB_CANCEL         = "canceljob"
+	NATS_CMD_JOB_STATUS         = "jobstatus"
+	NATS_CMD_JOBS_LIST          = "listjobs"
 	NATS_CMD_PING               = "ping"
 	NATS_CMD_PROCS_KILL         = "killproc"
 	NATS_CMD_PROCS_LIST         = "procs"
@@ -30,6 +55,9 @@ const (
 	NATS_CMD_RUNCHECKS          = "runchecks"
 	NATS_CMD_SCRIPT_RUN         = "runscript"
 	NATS_CMD_SCRIPT_RUN_FULL    = "runscriptfull"
+	NATS_CMD_SCRIPT_RUN_STREAM  = "runscriptstream"
+	NATS_CMD_SECRET_DEL         = "delsecret"
+	NATS_CMD_SECRET_SET         = "setsecret"
 	NATS_CMD_SOFTWARE_LIST      = "softwarelist"
 	NATS_CMD_SYNC               = "sync"
 	NATS_CMD_SYSINFO            = "sysinfo"
@@ -65,11 +65,6 @@ func (a *freebsdAgent) RunChecks(force bool) error {
 	panic("implement me")
 }
 
-func (a *freebsdAgent) RunScript(code string, shell string, args []string, timeout int) (stdout, stderr string, exitcode int, e error) {
-	// TODO implement me
-	panic("implement me")
-}
-
 func (a *freebsdAgent) CheckIn(nc *nats.Conn, mode string) {
 	// TODO implement me
 	panic("implement me")
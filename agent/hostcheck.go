@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	ps "github.com/jetrmm/go-sysinfo"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+const CPULOAD_DEFAULT_MINUTES = 5
+
+// ScriptRunner is implemented by platform agents that can run scripts
+type ScriptRunner interface {
+	RunScriptOpts(code string, interpreter string, args []string, timeout int, opts ScriptOptions) (stdout, stderr string, exitcode int, e error)
+}
+
+// CPULoader is implemented by platform agents that can report CPU load
+type CPULoader interface {
+	GetCPULoadAvg() int
+}
+
+// RegisterDefaultChecks registers the platform neutral check types on the
+// agent's check engine. The cpuload check needs the agent's sampler or a
+// platform CPULoader, and the script check needs a platform ScriptRunner.
+func (a *Agent) RegisterDefaultChecks(host any) {
+	a.Checks.Register(CHECK_TYPE_DISKSPACE, a.DiskCheck)
+	a.Checks.Register(CHECK_TYPE_MEMORY, a.MemCheck)
+	a.Checks.Register(CHECK_TYPE_PING, a.PingCheck)
+	a.Checks.Register(CHECK_TYPE_TCP, a.TCPCheck)
+	a.Checks.Register(CHECK_TYPE_HTTP, a.HTTPCheck)
+	a.Checks.Register(CHECK_TYPE_DNS, a.DNSCheck)
+	a.Checks.Register(CHECK_TYPE_TLSCERT, a.TLSCheck)
+
+	cpu, _ := host.(CPULoader)
+	if a.Sampler != nil || cpu != nil {
+		a.Checks.Register(CHECK_TYPE_CPULOAD, func(ctx context.Context, data shared.Check) CheckResult {
+			return CPULoadCheck(a.Sampler, cpu, data)
+		})
+	}
+	if runner, ok := host.(ScriptRunner); ok {
+		a.Checks.Register(CHECK_TYPE_SCRIPT, func(ctx context.Context, data shared.Check) CheckResult {
+			return ScriptCheck(runner, data)
+		})
+	}
+}
+
+// DiskCheck checks disk usage
+func (a *Agent) DiskCheck(ctx context.Context, data shared.Check) CheckResult {
+	usage, err := disk.UsageWithContext(ctx, data.Storage)
+	if err != nil {
+		a.Logger.Debugln("StorageDrive", data.Storage, err)
+		return CheckResultFor(CHECK_SEVERITY_ERROR, map[string]interface{}{
+			"exists": false,
+		})
+	}
+
+	return CheckResultFor(thresholdSeverity(usage.UsedPercent, data.WarnThreshold, data.ErrorThreshold, false), map[string]interface{}{
+		"exists":       true,
+		"percent_used": usage.UsedPercent,
+		"total":        usage.Total,
+		"free":         usage.Free,
+	})
+}
+
+// MemCheck Checks memory usage percentage
+func (a *Agent) MemCheck(ctx context.Context, data shared.Check) CheckResult {
+	host, err := ps.Host()
+	if err != nil {
+		return checkError(err)
+	}
+	mem, err := host.Memory()
+	if err != nil {
+		return checkError(err)
+	}
+	percent := int(math.Round((float64(mem.Used) / float64(mem.Total)) * 100))
+
+	return CheckResultFor(thresholdSeverity(float64(percent), data.WarnThreshold, data.ErrorThreshold, false), map[string]interface{}{
+		"percent": percent,
+	})
+}
+
+// CPULoadCheck Checks the average processor load over the check's window
+// of samples, falling back to host's reading until the sampler has any
+func CPULoadCheck(sampler *Sampler, host CPULoader, data shared.Check) CheckResult {
+	minutes := data.AvgMinutes
+	if minutes <= 0 {
+		minutes = CPULOAD_DEFAULT_MINUTES
+	}
+
+	var st SampleStats
+	ok := false
+	if sampler != nil {
+		st, ok = sampler.Stats(SAMPLE_METRIC_CPU, time.Duration(minutes)*time.Minute)
+	}
+	if !ok {
+		if host == nil {
+			return checkError(fmt.Errorf("no CPU samples yet"))
+		}
+		percent := host.GetCPULoadAvg()
+		return CheckResultFor(thresholdSeverity(float64(percent), data.WarnThreshold, data.ErrorThreshold, false), map[string]interface{}{
+			"percent": percent,
+		})
+	}
+
+	value := st.Avg
+	if data.Percentile > 0 {
+		value, _ = sampler.Percentile(SAMPLE_METRIC_CPU, time.Duration(minutes)*time.Minute, data.Percentile)
+	}
+
+	fields := map[string]interface{}{
+		"percent": int(math.Round(value)),
+		"window":  minutes,
+		"samples": st.Count,
+		"p95":     math.Round(st.P95),
+		"max":     math.Round(st.Max),
+	}
+	for _, m := range []int{1, 5, 15} {
+		if avg, ok := sampler.CPULoadAvg(m); ok {
+			fields[fmt.Sprintf("avg_%dm", m)] = math.Round(avg)
+		}
+	}
+	return CheckResultFor(thresholdSeverity(value, data.WarnThreshold, data.ErrorThreshold, false), fields)
+}
+
+// ScriptCheck runs the check's script and sends back its output and
+// return code for the server to grade
+func ScriptCheck(runner ScriptRunner, data shared.Check) CheckResult {
+	start := time.Now()
+	stdout, stderr, retcode, err := runner.RunScriptOpts(data.Script.Code, data.Script.Interpreter, data.ScriptArgs, data.Timeout, ScriptOptionsFor(data.Script))
+	if err != nil && stderr == "" {
+		stderr = fmt.Sprint(err)
+	}
+
+	fields := map[string]interface{}{
+		"stdout":  stdout,
+		"stderr":  stderr,
+		"retcode": retcode,
+		"runtime": time.Since(start).Seconds(),
+	}
+	var scriptErr *ScriptError
+	if errors.As(err, &scriptErr) {
+		fields["error"] = scriptErr
+	}
+	return CheckResult{Fields: fields}
+}
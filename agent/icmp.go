@@ -0,0 +1,257 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	PING_DEFAULT_COUNT    = 5
+	PING_MAX_COUNT        = 100
+	PING_PROBE_INTERVAL   = 1 * time.Second
+	PING_PROBE_TIMEOUT    = 2 * time.Second
+	PING_PROTOCOL_ICMP    = 1
+	PING_PROTOCOL_ICMPV6  = 58
+	PING_PAYLOAD_TOKENLEN = 16
+)
+
+// PingStats summarizes a run of ICMP echo probes, times are in ms
+type PingStats struct {
+	Addr     string  `json:"addr"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"` // percent
+	MinRTT   float64 `json:"min_ms"`
+	AvgRTT   float64 `json:"avg_ms"`
+	MaxRTT   float64 `json:"max_ms"`
+	Jitter   float64 `json:"jitter_ms"` // mean difference between consecutive RTTs
+}
+
+// String formats the stats like the summary of the ping utility
+func (s PingStats) String() string {
+	return fmt.Sprintf("%d packets transmitted, %d received, %.1f%% packet loss\nrtt min/avg/max/jitter = %.3f/%.3f/%.3f/%.3f ms",
+		s.Sent, s.Received, s.Loss, s.MinRTT, s.AvgRTT, s.MaxRTT, s.Jitter)
+}
+
+// listenICMP opens an unprivileged datagram ICMP socket where the OS allows
+// it (Linux ping_group_range, macOS), falling back to a raw socket
+func listenICMP(v4 bool) (conn *icmp.PacketConn, raw bool, err error) {
+	udp, ip, addr := "udp6", "ip6:ipv6-icmp", "::"
+	if v4 {
+		udp, ip, addr = "udp4", "ip4:icmp", "0.0.0.0"
+	}
+
+	conn, err = icmp.ListenPacket(udp, addr)
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, rerr := icmp.ListenPacket(ip, addr)
+	if rerr != nil {
+		return nil, false, errors.Join(err, rerr)
+	}
+	return conn, true, nil
+}
+
+// Ping sends count ICMP echo requests to host, one per interval, waiting
+// up to timeout for each reply but not past ctx's deadline. Cancelling ctx
+// stops sending further probes.
+func Ping(ctx context.Context, host string, count int, interval, timeout time.Duration) (PingStats, error) {
+	stats := PingStats{}
+
+	dst, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return stats, err
+	}
+	stats.Addr = dst.String()
+	v4 := dst.IP.To4() != nil
+
+	conn, raw, err := listenICMP(v4)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+
+	var (
+		echoType icmp.Type = ipv6.ICMPTypeEchoRequest
+		proto              = PING_PROTOCOL_ICMPV6
+		addr     net.Addr  = &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+	)
+	if v4 {
+		echoType, proto = ipv4.ICMPTypeEcho, PING_PROTOCOL_ICMP
+	}
+	if raw {
+		addr = dst
+	}
+
+	// datagram sockets get their ID rewritten by the kernel, so replies are
+	// matched on a random payload token instead
+	token := make([]byte, PING_PAYLOAD_TOKENLEN)
+	if _, err := rand.Read(token); err != nil {
+		return stats, err
+	}
+	id := int(token[0])<<8 | int(token[1])
+
+	rtts := make([]float64, 0, count)
+	buf := make([]byte, 1500)
+Probes:
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				break Probes
+			}
+		}
+
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: token},
+		}
+		wb, err := msg.Marshal(nil)
+		if err != nil {
+			return stats, err
+		}
+
+		sent := time.Now()
+		if _, err := conn.WriteTo(wb, addr); err != nil {
+			return stats, err
+		}
+		stats.Sent++
+
+		if rtt, ok := waitEchoReply(conn, buf, proto, seq, token, sent, probeDeadline(ctx, sent, timeout)); ok {
+			rtts = append(rtts, rtt)
+		}
+	}
+
+	summarizePing(&stats, rtts)
+	return stats, nil
+}
+
+// probeDeadline returns when to stop waiting for the reply to a probe sent
+// at sent: after timeout, or at ctx's deadline if that comes first
+func probeDeadline(ctx context.Context, sent time.Time, timeout time.Duration) time.Time {
+	deadline := sent.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// waitEchoReply reads until the reply to seq arrives or the deadline passes,
+// the RTT is measured from sent
+func waitEchoReply(conn *icmp.PacketConn, buf []byte, proto, seq int, token []byte, sent, deadline time.Time) (float64, bool) {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return 0, false
+	}
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, false
+		}
+		rtt := float64(time.Since(sent).Microseconds()) / 1000
+
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		if reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || !bytes.Equal(echo.Data, token) {
+			continue
+		}
+		return rtt, true
+	}
+}
+
+func summarizePing(stats *PingStats, rtts []float64) {
+	stats.Received = len(rtts)
+	if stats.Sent > 0 {
+		stats.Loss = roundMs(float64(stats.Sent-stats.Received) / float64(stats.Sent) * 100)
+	}
+	if len(rtts) == 0 {
+		return
+	}
+
+	minRTT, maxRTT, sum, diffs := rtts[0], rtts[0], 0.0, 0.0
+	for i, rtt := range rtts {
+		minRTT = math.Min(minRTT, rtt)
+		maxRTT = math.Max(maxRTT, rtt)
+		sum += rtt
+		if i > 0 {
+			diffs += math.Abs(rtt - rtts[i-1])
+		}
+	}
+
+	stats.MinRTT = roundMs(minRTT)
+	stats.MaxRTT = roundMs(maxRTT)
+	stats.AvgRTT = roundMs(sum / float64(len(rtts)))
+	if len(rtts) > 1 {
+		stats.Jitter = roundMs(diffs / float64(len(rtts)-1))
+	}
+}
+
+func roundMs(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// pingCount returns how many probes the check sends, no more than fit in
+// its timeout
+func pingCount(data shared.Check) int {
+	count := data.PingCount
+	if count <= 0 {
+		count = PING_DEFAULT_COUNT
+	}
+	fit := int((CheckTimeout(data)-PING_PROBE_TIMEOUT)/PING_PROBE_INTERVAL) + 1
+	return max(min(count, fit, PING_MAX_COUNT), 1)
+}
+
+// PingCheck pings the check's IP natively and grades packet loss, average
+// RTT and jitter against their thresholds, the worst one wins. With no
+// thresholds set the server grades it, from has_stdout and has_stderr as
+// it did the output of the ping executable.
+func (a *Agent) PingCheck(ctx context.Context, data shared.Check) CheckResult {
+	payload := map[string]interface{}{
+		"has_stdout": false,
+		"has_stderr": true,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout(data))
+	defer cancel()
+
+	stats, err := Ping(ctx, data.IP, pingCount(data), PING_PROBE_INTERVAL, PING_PROBE_TIMEOUT)
+	if err != nil {
+		a.Logger.Debugln("PingCheck", data.IP, err)
+		payload["output"] = fmt.Sprintf("Ping %s failed: %s", data.IP, err)
+		return CheckResultFor(CHECK_SEVERITY_ERROR, payload)
+	}
+
+	severity := CHECK_SEVERITY_ERROR
+	if stats.Received > 0 {
+		severity = worstSeverity(
+			thresholdSeverity(stats.Loss, data.LossWarn, data.LossError, false),
+			thresholdSeverity(stats.AvgRTT, data.WarnThreshold, data.ErrorThreshold, false),
+			thresholdSeverity(stats.Jitter, data.JitterWarn, data.JitterError, false),
+		)
+	}
+
+	// as ping exits with success when any reply came back
+	payload["has_stdout"] = stats.Received > 0
+	payload["has_stderr"] = stats.Received == 0
+	payload["stats"] = stats
+	payload["output"] = stats.String()
+	return CheckResultFor(severity, payload)
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestPingCountFitsTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		count, timeout int
+		want           int
+	}{
+		{0, 0, PING_DEFAULT_COUNT},
+		{100, 0, int((CHECK_DEFAULT_TIMEOUT*time.Second-PING_PROBE_TIMEOUT)/PING_PROBE_INTERVAL) + 1},
+		{100, 10, 9},
+		{5, 1, 1},
+		{1000, 3600, PING_MAX_COUNT},
+	} {
+		if got := pingCount(shared.Check{PingCount: tt.count, Timeout: tt.timeout}); got != tt.want {
+			t.Errorf("pingCount(%d, %ds) = %d, want %d", tt.count, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestPingCheckKeepsLegacyFields(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{}, Logger: testLogger()}
+	res := a.PingCheck(t.Context(), shared.Check{IP: "127.0.0.1", PingCount: 1})
+	if _, ok := res.Fields["has_stdout"]; !ok {
+		t.Errorf("PingCheck() fields = %v, want has_stdout", res.Fields)
+	}
+	if _, ok := res.Fields["has_stderr"]; !ok {
+		t.Errorf("PingCheck() fields = %v, want has_stderr", res.Fields)
+	}
+	if stats, ok := res.Fields["stats"].(PingStats); ok && stats.Received > 0 {
+		if res.Fields["has_stdout"] != true || res.Severity != "" {
+			t.Errorf("PingCheck() of localhost = %v/%q, want has_stdout and left to the server", res.Fields["has_stdout"], res.Severity)
+		}
+	}
+}
+
+func TestProbeDeadline(t *testing.T) {
+	sent := time.Now()
+	if got := probeDeadline(t.Context(), sent, PING_PROBE_TIMEOUT); !got.Equal(sent.Add(PING_PROBE_TIMEOUT)) {
+		t.Errorf("probeDeadline() without a ctx deadline = %v, want the probe timeout", got.Sub(sent))
+	}
+
+	ctx, cancel := context.WithDeadline(t.Context(), sent.Add(500*time.Millisecond))
+	defer cancel()
+	if got := probeDeadline(ctx, sent, PING_PROBE_TIMEOUT); !got.Equal(sent.Add(500 * time.Millisecond)) {
+		t.Errorf("probeDeadline() = %v, want capped at the ctx deadline", got.Sub(sent))
+	}
+	if got := probeDeadline(ctx, sent, 100*time.Millisecond); !got.Equal(sent.Add(100 * time.Millisecond)) {
+		t.Errorf("probeDeadline() = %v, want the shorter probe timeout", got.Sub(sent))
+	}
+}
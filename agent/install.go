@@ -11,6 +11,8 @@ type InstallInfo struct {
 	Description string        // Defaults to hostname
 	Token       string        // Authorization token (password)
 	RootCert    string        // Trusted Root Certificate
+	ScriptKeys  []string      // Trusted script publisher keys, base64 ed25519
+	Settings    AgentSettings // Optional settings
 	Timeout     time.Duration // Installation timeout
 	Silent      bool          // Silent installation
 	// AgentType   string // Workstation, Server
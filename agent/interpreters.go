@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	INTERPRETER_DISCOVERY_INTERVAL = 6 * time.Hour
+	INTERPRETER_VERSION_TIMEOUT    = 10 * time.Second
+)
+
+var (
+	interpreterVersionRe = regexp.MustCompile(`\d+(\.\d+)+`)
+
+	discoveredMu sync.RWMutex
+	discovered   []shared.InterpreterInfo
+	discoveredAt time.Time
+)
+
+// registeredInterpreters returns each registered interpreter once, aliases
+// left out
+func registeredInterpreters() []*Interpreter {
+	interpretersMu.RLock()
+	defer interpretersMu.RUnlock()
+	ret := make([]*Interpreter, 0, len(interpreters))
+	for name, i := range interpreters {
+		if name == i.Name {
+			ret = append(ret, i)
+		}
+	}
+	sort.Slice(ret, func(x, y int) bool { return ret[x].Name < ret[y].Name })
+	return ret
+}
+
+// DiscoverInterpreters looks for the registered interpreters and their
+// versions, and remembers the ones found for InterpreterInventory
+func (a *Agent) DiscoverInterpreters() []shared.InterpreterInfo {
+	found := make([]shared.InterpreterInfo, 0)
+	for _, i := range registeredInterpreters() {
+		info, ok := i.discover()
+		if !ok {
+			continue
+		}
+		if info.Version == "" {
+			a.Logger.Debugln("Interpreter", i.Name, "found without a version")
+		}
+		found = append(found, info)
+	}
+
+	discoveredMu.Lock()
+	discovered = found
+	discoveredAt = time.Now()
+	discoveredMu.Unlock()
+	return found
+}
+
+// discover finds the interpreter's executable and asks it for its version.
+// Interpreters that run the script itself, and have no way to tell their
+// version, aren't reported.
+func (i *Interpreter) discover() (shared.InterpreterInfo, bool) {
+	info := shared.InterpreterInfo{Name: i.Name}
+	for _, exe := range i.Exes {
+		if p, err := exec.LookPath(exe); err == nil {
+			info.Path = p
+			break
+		}
+	}
+	if len(i.Exes) > 0 && info.Path == "" {
+		return info, false
+	}
+
+	versionCmd := i.VersionCmd
+	if len(versionCmd) == 0 {
+		if info.Path == "" {
+			return info, false
+		}
+		versionCmd = []string{info.Path, "--version"}
+	}
+	exe, err := exec.LookPath(versionCmd[0])
+	if err != nil {
+		return info, false
+	}
+	if info.Path == "" {
+		info.Path = exe
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), INTERPRETER_VERSION_TIMEOUT)
+	defer cancel()
+	// some print their version to stderr, and some exit non-zero for it
+	out, _ := exec.CommandContext(ctx, exe, versionCmd[1:]...).CombinedOutput()
+	info.Version = parseInterpreterVersion(string(out))
+	return info, true
+}
+
+// parseInterpreterVersion picks the version number out of the output of
+// e.g. "bash --version" or "cmd /c ver"
+func parseInterpreterVersion(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if v := interpreterVersionRe.FindString(line); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func discoveredInterpreters() []shared.InterpreterInfo {
+	discoveredMu.RLock()
+	defer discoveredMu.RUnlock()
+	return discovered
+}
+
+// InterpreterInventory returns the interpreters found by the last
+// discovery, running one if there hasn't been any yet
+func (a *Agent) InterpreterInventory() []shared.InterpreterInfo {
+	discoveredMu.RLock()
+	done := !discoveredAt.IsZero()
+	discoveredMu.RUnlock()
+	if !done {
+		return a.DiscoverInterpreters()
+	}
+	return discoveredInterpreters()
+}
+
+// RunInterpreterDiscovery discovers the interpreters at startup and again
+// every INTERPRETER_DISCOVERY_INTERVAL, to pick up installs and upgrades
+func (a *Agent) RunInterpreterDiscovery(ctx context.Context) {
+	ticker := time.NewTicker(INTERPRETER_DISCOVERY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		found := a.DiscoverInterpreters()
+		a.Logger.Debugln("Interpreters found:", found)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
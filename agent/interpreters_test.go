@@ -0,0 +1,24 @@
+package agent
+
+import "testing"
+
+func TestParseInterpreterVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name, out, want string
+	}{
+		{"bash", "GNU bash, version 5.2.15(1)-release (x86_64-pc-linux-gnu)\nCopyright (C) 2022 Free Software Foundation, Inc.\n", "5.2.15"},
+		{"zsh", "zsh 5.9 (x86_64-debian-linux-gnu)\n", "5.9"},
+		{"python", "Python 3.11.2\n", "3.11.2"},
+		{"perl", "\nThis is perl 5, version 36, subversion 0 (v5.36.0) built for x86_64-linux-gnu-thread-multi\n", "5.36.0"},
+		{"node", "v20.11.0\n", "20.11.0"},
+		{"cmd /c ver", "\r\nMicrosoft Windows [Version 10.0.19045.3570]\r\n", "10.0.19045.3570"},
+		{"pwsh", "PowerShell 7.4.1\n", "7.4.1"},
+		{"windows powershell", "5.1.19041.3570\r\n", "5.1.19041.3570"},
+		{"no version", "sh: 0: Illegal option --\n", ""},
+		{"empty", "", ""},
+	} {
+		if got := parseInterpreterVersion(tt.out); got != tt.want {
+			t.Errorf("parseInterpreterVersion(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
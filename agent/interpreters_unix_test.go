@@ -0,0 +1,84 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeInterpreters puts shell scripts printing out under each name in a
+// directory that becomes the whole PATH. They exit non-zero, as some
+// interpreters do for their version.
+func fakeInterpreters(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, out := range scripts {
+		code := "#!/bin/sh\nprintf '" + out + "'\nexit 1\n"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(code), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	return dir
+}
+
+func TestInterpreterDiscover(t *testing.T) {
+	dir := fakeInterpreters(t, map[string]string{
+		"fakesh":    "fakesh 1.2.3\\n",
+		"fakever":   "Fake [Version 4.5.6]\\n",
+		"noversion": "usage: noversion file\\n",
+	})
+
+	for _, tt := range []struct {
+		name      string
+		i         Interpreter
+		found     bool
+		path, ver string
+	}{
+		{"not installed", Interpreter{Exes: []string{"missing"}}, false, "", ""},
+		{"second candidate", Interpreter{Exes: []string{"missing", "fakesh"}}, true, "fakesh", "1.2.3"},
+		{"version command", Interpreter{Exes: []string{"fakesh"}, VersionCmd: []string{"fakever"}}, true, "fakesh", "4.5.6"},
+		{"runs the script itself", Interpreter{VersionCmd: []string{"fakever", "/c", "ver"}}, true, "fakever", "4.5.6"},
+		{"version command not installed", Interpreter{Exes: []string{"fakesh"}, VersionCmd: []string{"missing"}}, false, "", ""},
+		{"runs the script itself without a version command", Interpreter{}, false, "", ""},
+		{"without a version", Interpreter{Exes: []string{"noversion"}}, true, "noversion", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.i.Name = "fake"
+			info, ok := tt.i.discover()
+			if ok != tt.found {
+				t.Fatalf("discover() found = %v, want %v", ok, tt.found)
+			}
+			if !ok {
+				return
+			}
+			if want := filepath.Join(dir, tt.path); info.Path != want {
+				t.Errorf("Path = %q, want %q", info.Path, want)
+			}
+			if info.Version != tt.ver {
+				t.Errorf("Version = %q, want %q", info.Version, tt.ver)
+			}
+		})
+	}
+}
+
+func TestDiscoverInterpretersSkipsMissing(t *testing.T) {
+	fakeInterpreters(t, map[string]string{
+		"bash":   "GNU bash, version 5.2.15(1)-release\\n",
+		"nodejs": "v18.19.0\\n",
+	})
+
+	a := &Agent{Logger: testLogger()}
+	found := a.DiscoverInterpreters()
+	if len(found) != 2 || found[0].Name != "bash" || found[1].Name != "node" {
+		t.Fatalf("DiscoverInterpreters() = %+v, want bash and node", found)
+	}
+	if found[0].Version != "5.2.15" || found[1].Version != "18.19.0" {
+		t.Errorf("versions = %q, %q", found[0].Version, found[1].Version)
+	}
+	if got := a.InterpreterInventory(); len(got) != 2 {
+		t.Errorf("InterpreterInventory() = %+v, want the discovered interpreters", got)
+	}
+}
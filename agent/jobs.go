@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	JOB_DEFAULT_RETENTION = time.Hour
+	JOB_OUTPUT_TAIL       = 64 << 10 // of each stream, kept as the output so far
+
+	// Job kinds
+	JOB_KIND_SCRIPT = "script"
+	JOB_KIND_TASK   = "task"
+
+	// Job states
+	JOB_STATE_RUNNING   = "running"
+	JOB_STATE_FINISHED  = "finished"
+	JOB_STATE_FAILED    = "failed" // couldn't be run at all
+	JOB_STATE_CANCELLED = "cancelled"
+)
+
+var (
+	ErrJobNotFound   = errors.New("job not found")
+	ErrJobNotRunning = errors.New("job is not running")
+	ErrJobExists     = errors.New("job already exists")
+)
+
+// Job is the state of a script or task run, as reported to the server
+type Job struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"` // script, task
+	Name     string    `json:"name"` // the interpreter, or the task's ID
+	State    string    `json:"state"`
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"` // zero while running
+	Retcode  int       `json:"retcode"`
+	Stdout   string    `json:"stdout"` // the tail while running
+	Stderr   string    `json:"stderr"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// runningJob tracks one run for the JobManager
+type runningJob struct {
+	mu        sync.Mutex
+	job       Job
+	stdout    jobTail
+	stderr    jobTail
+	redact    *strings.Replacer
+	longest   int // of the secrets redacted
+	cancel    func()
+	cancelled bool
+}
+
+// jobTail keeps the last JOB_OUTPUT_TAIL bytes written to it
+type jobTail struct {
+	buf     []byte
+	trimmed bool
+}
+
+func (t *jobTail) write(p []byte) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - JOB_OUTPUT_TAIL; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+		t.trimmed = true
+	}
+}
+
+// string returns the tail with secrets redacted. A trimmed tail may start
+// in the middle of a secret, so as much as the longest secret is dropped
+// from its front.
+func (t *jobTail) string(redact *strings.Replacer, longest int) string {
+	s := string(t.buf)
+	if t.trimmed {
+		s = s[min(longest, len(s)):]
+	}
+	return redact.Replace(s)
+}
+
+type jobOutput struct {
+	j      *runningJob
+	stream string
+}
+
+func (w *jobOutput) Write(p []byte) (int, error) {
+	w.j.mu.Lock()
+	defer w.j.mu.Unlock()
+	if w.stream == SCRIPT_STREAM_STDERR {
+		w.j.stderr.write(p)
+	} else {
+		w.j.stdout.write(p)
+	}
+	return len(p), nil
+}
+
+// output returns a writer keeping the tail of stream as the output so far
+func (j *runningJob) output(stream string) *jobOutput {
+	return &jobOutput{j: j, stream: stream}
+}
+
+// started records the script's pid and how to cancel it. A cancel that
+// came in before the script was started is carried out now.
+func (j *runningJob) started(pid int, secrets map[string]string, cancel func()) {
+	j.mu.Lock()
+	j.job.PID = pid
+	j.redact = secretRedactor(secrets)
+	for _, v := range secrets {
+		j.longest = max(j.longest, len(v))
+	}
+	j.cancel = cancel
+	cancelled := j.cancelled
+	j.mu.Unlock()
+	if cancelled {
+		cancel()
+	}
+}
+
+func (j *runningJob) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ret := j.job
+	if ret.State == JOB_STATE_RUNNING && j.redact != nil {
+		ret.Stdout = j.stdout.string(j.redact, j.longest)
+		ret.Stderr = j.stderr.string(j.redact, j.longest)
+	}
+	return ret
+}
+
+// JobManager tracks the scripts and tasks the agent runs, so they can be
+// listed and cancelled, and keeps finished ones for a while
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*runningJob
+	retention time.Duration
+}
+
+// NewJobManager returns a job manager keeping finished jobs for retention,
+// zero uses JOB_DEFAULT_RETENTION
+func NewJobManager(retention time.Duration) *JobManager {
+	if retention <= 0 {
+		retention = JOB_DEFAULT_RETENTION
+	}
+	return &JobManager{jobs: make(map[string]*runningJob), retention: retention}
+}
+
+// NewJobID returns a new, unique job ID
+func NewJobID() string {
+	return ulid.Make().String()
+}
+
+// add starts tracking a new running job, with id or a generated one
+func (m *JobManager) add(id, kind, name string) (*runningJob, error) {
+	if id == "" {
+		id = NewJobID()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	if _, ok := m.jobs[id]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrJobExists, id)
+	}
+	j := &runningJob{job: Job{ID: id, Kind: kind, Name: name, State: JOB_STATE_RUNNING, Started: time.Now()}}
+	m.jobs[id] = j
+	return j, nil
+}
+
+// finish records the result of j
+func (m *JobManager) finish(j *runningJob, stdout, stderr string, retcode int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Finished = time.Now()
+	j.job.Retcode = retcode
+	j.job.Stdout = stdout
+	j.job.Stderr = stderr
+	switch {
+	case j.cancelled:
+		j.job.State = JOB_STATE_CANCELLED
+	case err != nil:
+		j.job.State = JOB_STATE_FAILED
+		j.job.Error = err.Error()
+	default:
+		j.job.State = JOB_STATE_FINISHED
+	}
+	j.cancel = nil
+	j.stdout, j.stderr = jobTail{}, jobTail{}
+}
+
+// prune drops the finished jobs past their retention. Called with m.mu held.
+func (m *JobManager) prune() {
+	cutoff := time.Now().Add(-m.retention)
+	for id, j := range m.jobs {
+		j.mu.Lock()
+		expired := j.job.State != JOB_STATE_RUNNING && j.job.Finished.Before(cutoff)
+		j.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// List returns the running and retained jobs, oldest first
+func (m *JobManager) List() []Job {
+	m.mu.Lock()
+	m.prune()
+	jobs := make([]*runningJob, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j)
+	}
+	m.mu.Unlock()
+
+	ret := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		ret = append(ret, j.snapshot())
+	}
+	sort.Slice(ret, func(i, k int) bool { return ret[i].Started.Before(ret[k].Started) })
+	return ret
+}
+
+// Get returns the job with id
+func (m *JobManager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	m.prune()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return j.snapshot(), nil
+}
+
+// Cancel kills the running job with id and everything it started
+func (m *JobManager) Cancel(id string) error {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+
+	j.mu.Lock()
+	if j.job.State != JOB_STATE_RUNNING {
+		j.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrJobNotRunning, id)
+	}
+	j.cancelled = true
+	cancel := j.cancel
+	j.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+// RunScriptJob is RunScriptOpts tracked as a job of kind, with id or a
+// generated one when id is empty
+func (a *Agent) RunScriptJob(id, kind, name string, code string, interpreter string, args []string, timeout int, opts ScriptOptions) (stdout, stderr string, exitcode int, e error) {
+	if a.Jobs == nil {
+		return a.RunScriptOpts(code, interpreter, args, timeout, opts)
+	}
+	j, err := a.Jobs.add(id, kind, name)
+	if err != nil {
+		return "", err.Error(), SCRIPT_EXIT_CONFIG, err
+	}
+	opts.job = j
+	stdout, stderr, exitcode, e = a.RunScriptOpts(code, interpreter, args, timeout, opts)
+	a.Jobs.finish(j, stdout, stderr, exitcode, e)
+	return stdout, stderr, exitcode, e
+}
@@ -0,0 +1,96 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobsListAndGet(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger(), Jobs: NewJobManager(0)}
+
+	out, _, _, err := a.RunScriptJob("job-1", JOB_KIND_SCRIPT, "sh", "echo one", "sh", nil, 10, ScriptOptions{})
+	if err != nil || out != "one\n" {
+		t.Fatalf("RunScriptJob() = %q, %v", out, err)
+	}
+	a.RunScriptJob("job-2", JOB_KIND_TASK, "7", "exit 3", "sh", nil, 10, ScriptOptions{})
+
+	jobs := a.Jobs.List()
+	if len(jobs) != 2 || jobs[0].ID != "job-1" || jobs[1].ID != "job-2" {
+		t.Fatalf("List() = %+v, want both jobs oldest first", jobs)
+	}
+
+	job, err := a.Jobs.Get("job-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JOB_STATE_FINISHED || job.Retcode != 3 || job.Kind != JOB_KIND_TASK || job.Finished.IsZero() {
+		t.Errorf("Get() = %+v", job)
+	}
+	if _, err := a.Jobs.Get("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Get() = %v, want ErrJobNotFound", err)
+	}
+	if _, _, _, err := a.RunScriptJob("job-1", JOB_KIND_SCRIPT, "sh", "true", "sh", nil, 10, ScriptOptions{}); !errors.Is(err, ErrJobExists) {
+		t.Errorf("RunScriptJob() with a used id = %v, want ErrJobExists", err)
+	}
+}
+
+func TestJobsCancelRunning(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger(), Jobs: NewJobManager(0)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.RunScriptJob("job-1", JOB_KIND_SCRIPT, "sh", "echo started; sleep 30", "sh", nil, 60, ScriptOptions{})
+	}()
+	waitFor(t, func() bool {
+		job, err := a.Jobs.Get("job-1")
+		return err == nil && job.PID != 0 && job.Stdout == "started\n"
+	})
+	if job, _ := a.Jobs.Get("job-1"); job.State != JOB_STATE_RUNNING {
+		t.Fatalf("state %q, want running", job.State)
+	}
+
+	if err := a.Jobs.Cancel("job-1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("cancelled job still running")
+	}
+	if job, _ := a.Jobs.Get("job-1"); job.State != JOB_STATE_CANCELLED {
+		t.Errorf("state %q, want cancelled", job.State)
+	}
+	if err := a.Jobs.Cancel("job-1"); !errors.Is(err, ErrJobNotRunning) {
+		t.Errorf("Cancel() of a finished job = %v, want ErrJobNotRunning", err)
+	}
+	if err := a.Jobs.Cancel("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Cancel() = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestJobsPrunedAfterRetention(t *testing.T) {
+	m := NewJobManager(50 * time.Millisecond)
+	running, _ := m.add("running", JOB_KIND_SCRIPT, "sh")
+	finished, _ := m.add("finished", JOB_KIND_SCRIPT, "sh")
+	m.finish(finished, "", "", 0, nil)
+
+	if n := len(m.List()); n != 2 {
+		t.Fatalf("%d jobs within the retention, want 2", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	jobs := m.List()
+	if len(jobs) != 1 || jobs[0].ID != "running" {
+		t.Errorf("List() = %+v, want only the running job", jobs)
+	}
+	m.finish(running, "", "", 0, nil)
+
+	var c AgentConfig
+	AgentSettings{JobRetention: 600}.Apply(&c)
+	if c.JobRetention != 600 {
+		t.Errorf("JobRetention = %d, want 600", c.JobRetention)
+	}
+}
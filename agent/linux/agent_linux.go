@@ -1 +1,93 @@
 package linux
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/sirupsen/logrus"
+)
+
+// AGENT_SETTINGS_FILE holds the optional agent settings
+const AGENT_SETTINGS_FILE = "/etc/rmm-agent/settings.json"
+
+var settingsFile = AGENT_SETTINGS_FILE
+
+type linuxAgent struct {
+	agent.Agent
+}
+
+// NewAgent Initializes a new linuxAgent from an agent configuration
+func NewAgent(logger *logrus.Logger, version string, config *agent.AgentConfig) *linuxAgent {
+	headers := make(map[string]string)
+	restyC := resty.New()
+
+	if len(config.Token) > 0 {
+		headers["Content-Type"] = "application/json"
+		headers["Authorization"] = fmt.Sprintf("Token %s", config.Token)
+	}
+	restyC.SetBaseURL(config.BaseURL)
+	restyC.SetCloseConnection(true)
+	restyC.SetHeaders(headers)
+	restyC.SetTimeout(15 * time.Second)
+	restyC.SetDebug(logger.IsLevelEnabled(logrus.DebugLevel))
+	if len(config.Cert) > 0 {
+		restyC.SetRootCertificate(config.Cert)
+	}
+
+	config.Version = version
+	config.Debug = logger.IsLevelEnabled(logrus.DebugLevel)
+	config.Headers = headers
+	if config.ApiPort == 0 {
+		config.ApiPort = agent.NATS_DEFAULT_PORT
+	}
+	settings, err := agent.LoadSettings(settingsFile)
+	if err != nil {
+		logger.Errorln("Unable to load settings:", err)
+	}
+	settings.Apply(config)
+
+	a := &linuxAgent{
+		Agent: agent.Agent{
+			AgentConfig: config,
+			Logger:      logger,
+			RClient:     restyC,
+		},
+	}
+	a.registerChecks()
+	return a
+}
+
+// GetCPULoadAvg Retrieve CPU load average
+func (a *linuxAgent) GetCPULoadAvg() int {
+	if load, ok := a.SampledCPULoad(1, 0); ok {
+		return load
+	}
+
+	percent, err := cpu.Percent(10*time.Second, false)
+	if err != nil {
+		a.Logger.Debugln("Go CPU Check:", err)
+		return 0
+	}
+	return int(math.Round(percent[0]))
+}
+
+// Install writes the install-time settings, including the script publisher
+// keys, to the settings file. Registering with the server is not done on
+// Linux yet.
+func (a *linuxAgent) Install(i *agent.InstallInfo, agentID string) {
+	if _, err := agent.ParsePublisherKeys(i.ScriptKeys); err != nil {
+		a.Logger.Fatalln(err)
+	}
+	settings := i.Settings
+	if len(i.ScriptKeys) > 0 {
+		settings.ScriptPublisherKeys = i.ScriptKeys
+	}
+	if err := agent.SaveSettings(settingsFile, settings); err != nil {
+		a.Logger.Fatalln("Unable to save settings:", err)
+	}
+	settings.Apply(a.AgentConfig)
+}
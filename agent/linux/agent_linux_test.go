@@ -0,0 +1,48 @@
+package linux
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/sirupsen/logrus"
+)
+
+func TestInstalledScriptKeysRejectUnsignedScripts(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := settingsFile
+	settingsFile = filepath.Join(t.TempDir(), "settings.json")
+	t.Cleanup(func() { settingsFile = saved })
+
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	installer := &linuxAgent{Agent: agent.Agent{AgentConfig: &agent.AgentConfig{}, Logger: l}}
+	installer.Install(&agent.InstallInfo{ScriptKeys: []string{base64.StdEncoding.EncodeToString(pub)}}, "agent-1")
+
+	a := NewAgent(l, "test", &agent.AgentConfig{StateDir: t.TempDir()})
+	if len(a.ScriptPublisherKeys) != 1 {
+		t.Fatalf("ScriptPublisherKeys = %v, want the installed key", a.ScriptPublisherKeys)
+	}
+	_, _, code, err := a.RunScriptOpts("echo hello", "sh", nil, 10, agent.ScriptOptions{})
+	var scriptErr *agent.ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.Code != agent.SCRIPT_ERR_UNSIGNED {
+		t.Errorf("RunScriptOpts() = %v, want an unsigned script error", err)
+	}
+	if code != agent.SCRIPT_EXIT_SIGNATURE {
+		t.Errorf("exit code = %d, want %d", code, agent.SCRIPT_EXIT_SIGNATURE)
+	}
+
+	// without keys the same script runs
+	settingsFile = filepath.Join(t.TempDir(), "missing.json")
+	open := NewAgent(l, "test", &agent.AgentConfig{StateDir: t.TempDir()})
+	if out, _, _, err := open.RunScriptOpts("echo hello", "sh", nil, 10, agent.ScriptOptions{}); err != nil || out != "hello\n" {
+		t.Errorf("RunScriptOpts() = %q, %v without keys", out, err)
+	}
+}
@@ -0,0 +1,180 @@
+package linux
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	// Check Types
+	CHECK_TYPE_KERNELLOG = "kernellog"
+	CHECK_TYPE_MDRAID    = "mdraid"
+	CHECK_TYPE_MOUNTS    = "mounts"
+)
+
+// registerChecks sets up the check engine and scheduler with the platform neutral and
+// the Linux-only check types
+func (a *linuxAgent) registerChecks() {
+	a.OpenOutbox()
+	a.Checks = agent.NewCheckEngine(a.Logger, a.Outbox, a.RunTask, a.AcquireLock)
+	a.Sampler = agent.NewSampler(a.Logger)
+	a.Jobs = agent.NewJobManager(time.Duration(a.JobRetention) * time.Second)
+	a.RegisterDefaultChecks(a)
+	a.Checks.Register(CHECK_TYPE_KERNELLOG, a.KernelLogCheck)
+	a.Checks.Register(CHECK_TYPE_MDRAID, a.MdRaidCheck)
+	a.Checks.Register(CHECK_TYPE_MOUNTS, a.MountsCheck)
+	a.Scheduler = agent.NewCheckScheduler(&a.Agent)
+}
+
+// KernelLogCheck fails when the kernel logged events in the check's
+// categories since the previous run, or when the kernel log can't be read.
+// The first run only sets its starting point.
+func (a *linuxAgent) KernelLogCheck(ctx context.Context, data rmm.Check) agent.CheckResult {
+	cursor := kmsgCursorName(strconv.Itoa(data.CheckPK))
+
+	var k *KmsgReader
+	var evts []rmm.KernelEvent
+	dir, err := a.kmsgCursorDir()
+	if err == nil {
+		k, err = openKmsgCursor(dir, cursor)
+	}
+	if err == nil {
+		evts, err = k.ReadEvents()
+	}
+	if err != nil {
+		a.Logger.Debugln("KernelLogCheck", err)
+		return agent.CheckResult{
+			Status: agent.CHECK_STATUS_FAILING,
+			Fields: map[string]interface{}{
+				"events": []rmm.KernelEvent{},
+				"error":  err.Error(),
+			},
+		}
+	}
+
+	matches := make([]rmm.KernelEvent, 0)
+	for _, evt := range evts {
+		if len(data.KernelLogCats) == 0 || slices.Contains(data.KernelLogCats, evt.Category) {
+			matches = append(matches, evt)
+		}
+	}
+
+	status := agent.CHECK_STATUS_PASSING
+	if len(matches) > 0 {
+		status = agent.CHECK_STATUS_FAILING
+	}
+
+	return agent.CheckResult{
+		Status: status,
+		Fields: map[string]interface{}{
+			"events": matches,
+		},
+		// only advance once the server has the events
+		Delivered: func() {
+			if err := saveKmsgCursor(dir, cursor, k); err != nil {
+				a.Logger.Debugln("KernelLogCheck", err)
+			}
+		},
+	}
+}
+
+// MdRaidCheck checks the health of the md software RAID arrays
+func (a *linuxAgent) MdRaidCheck(ctx context.Context, data rmm.Check) agent.CheckResult {
+	arrays, err := GetMdArrays()
+	if err != nil {
+		a.Logger.Debugln("MdRaidCheck", err)
+		return agent.CheckResult{
+			Status: agent.CHECK_STATUS_FAILING,
+			Fields: map[string]interface{}{
+				"exists": false,
+				"error":  err.Error(),
+			},
+		}
+	}
+
+	status := agent.CHECK_STATUS_PASSING
+	for _, md := range arrays {
+		// a scheduled "check" scrub is routine, anything else needs attention
+		if md.Health != MD_HEALTH_CLEAN && md.Health != MD_HEALTH_CHECK {
+			status = agent.CHECK_STATUS_FAILING
+		}
+	}
+
+	return agent.CheckResult{
+		Status: status,
+		Fields: map[string]interface{}{
+			"exists": true,
+			"arrays": arrays,
+		},
+	}
+}
+
+// MountsCheck verifies the expected mount points and looks for filesystems
+// that went read-only or network mounts that went stale, expected or not
+func (a *linuxAgent) MountsCheck(ctx context.Context, data rmm.Check) agent.CheckResult {
+	mounts, err := getMounts()
+	if err != nil {
+		a.Logger.Debugln("MountsCheck", err)
+		return agent.CheckResult{
+			Status: agent.CHECK_STATUS_FAILING,
+			Fields: map[string]interface{}{
+				"error": err.Error(),
+			},
+		}
+	}
+
+	status := agent.CHECK_STATUS_PASSING
+	results := make([]rmm.MountStatus, 0)
+	for _, want := range data.Mounts {
+		res := checkMount(want, mounts)
+		if len(res.Errors) > 0 {
+			status = agent.CHECK_STATUS_FAILING
+		}
+		results = append(results, res)
+	}
+
+	for _, m := range readOnlyMounts(mounts) {
+		if slices.ContainsFunc(results, func(res rmm.MountStatus) bool { return res.Path == m.Path }) {
+			continue
+		}
+		status = agent.CHECK_STATUS_FAILING
+		results = append(results, rmm.MountStatus{
+			Path:     m.Path,
+			Mounted:  true,
+			Device:   m.Device,
+			Fstype:   m.Fstype,
+			Options:  m.Options,
+			ReadOnly: true,
+			Errors:   []string{"mounted read-only"},
+		})
+	}
+
+	for _, m := range staleMounts(mounts, STALE_MOUNT_TIMEOUT) {
+		if slices.ContainsFunc(results, func(res rmm.MountStatus) bool { return res.Path == m.Path }) {
+			continue
+		}
+		status = agent.CHECK_STATUS_FAILING
+		results = append(results, rmm.MountStatus{
+			Path:     m.Path,
+			Mounted:  true,
+			Device:   m.Device,
+			Fstype:   m.Fstype,
+			Options:  m.Options,
+			ReadOnly: slices.Contains(m.Options, "ro"),
+			Stale:    true,
+			Errors:   []string{"stale mount, stat timed out"},
+		})
+	}
+
+	return agent.CheckResult{
+		Status: status,
+		Fields: map[string]interface{}{
+			"mounts": results,
+		},
+	}
+}
@@ -0,0 +1,72 @@
+package linux
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+	"github.com/sirupsen/logrus"
+)
+
+func testAgent(t *testing.T) *linuxAgent {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return &linuxAgent{Agent: agent.Agent{AgentConfig: &agent.AgentConfig{StateDir: t.TempDir()}, Logger: l}}
+}
+
+func withKmsgDevice(t *testing.T, path string) {
+	saved := kmsgDevice
+	kmsgDevice = path
+	t.Cleanup(func() { kmsgDevice = saved })
+}
+
+func TestKernelLogCheckFailsWhenUnreadable(t *testing.T) {
+	withKmsgDevice(t, filepath.Join(t.TempDir(), "kmsg"))
+
+	res := testAgent(t).KernelLogCheck(context.Background(), rmm.Check{CheckPK: 990101})
+	if res.Status != agent.CHECK_STATUS_FAILING || res.Fields["error"] == nil {
+		t.Errorf("KernelLogCheck() = %q %v, want failing with the error", res.Status, res.Fields)
+	}
+	if res.Delivered != nil {
+		t.Error("KernelLogCheck() would advance its cursor without reading")
+	}
+}
+
+func TestKernelLogCheckStartsAtTheEnd(t *testing.T) {
+	dev := filepath.Join(t.TempDir(), "kmsg")
+	if err := os.WriteFile(dev, []byte("3,41,1000,-;Out of memory: Killed process 1234 (java)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withKmsgDevice(t, dev)
+
+	const pk = 990102
+	cursor := kmsgCursorName(strconv.Itoa(pk))
+
+	a := testAgent(t)
+	dir, err := a.kmsgCursorDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := a.KernelLogCheck(context.Background(), rmm.Check{CheckPK: pk})
+	if res.Status != agent.CHECK_STATUS_PASSING || len(res.Fields["events"].([]rmm.KernelEvent)) != 0 {
+		t.Errorf("first KernelLogCheck() = %q %v, want passing without the old events", res.Status, res.Fields)
+	}
+	res.Delivered()
+	if _, seq := loadKmsgCursor(dir, cursor); seq != 41 {
+		t.Errorf("cursor at %d, want 41", seq)
+	}
+
+	// a new record after the cursor is reported
+	if err := os.WriteFile(dev, []byte("3,42,2000,-;Out of memory: Killed process 99 (php)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	res = a.KernelLogCheck(context.Background(), rmm.Check{CheckPK: pk})
+	if res.Status != agent.CHECK_STATUS_FAILING || len(res.Fields["events"].([]rmm.KernelEvent)) != 1 {
+		t.Errorf("KernelLogCheck() = %q %v, want failing with the new event", res.Status, res.Fields)
+	}
+}
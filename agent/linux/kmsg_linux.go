@@ -0,0 +1,245 @@
+package linux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	rmm "github.com/jetrmm/rmm-agent/shared"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	KMSG_DEVICE      = "/dev/kmsg"
+	KMSG_BOOT_ID     = "/proc/sys/kernel/random/boot_id"
+	KMSG_CURSOR_DIR  = "kmsg"
+	KMSG_CURSOR_FILE = "kmsg-%s.cursor"
+
+	// Kernel event categories
+	KMSG_CAT_OOM         = "oom"
+	KMSG_CAT_FS_ERROR    = "fs_error"
+	KMSG_CAT_FS_READONLY = "fs_readonly"
+	KMSG_CAT_HARDWARE    = "hardware"
+	KMSG_CAT_HUNG_TASK   = "hung_task"
+)
+
+// kmsgDevice is the ring buffer read, tests point it elsewhere
+var kmsgDevice = KMSG_DEVICE
+
+// kmsgRules are evaluated in order, the first match wins
+var kmsgRules = []struct {
+	category string
+	re       *regexp.Regexp
+}{
+	{KMSG_CAT_OOM, regexp.MustCompile(`(?i)out of memory|oom-kill|oom_reaper|killed process \d+`)},
+	{KMSG_CAT_FS_READONLY, regexp.MustCompile(`(?i)remounting filesystem read-only|remount.*read-only|forced? .*read-only`)},
+	{KMSG_CAT_FS_ERROR, regexp.MustCompile(`(?i)(ext[234]-fs|xfs|btrfs|f2fs).*(error|corrupt|shutdown)|i/o error.*(dev|sector)|buffer i/o error`)},
+	{KMSG_CAT_HARDWARE, regexp.MustCompile(`(?i)\bmce\b|machine check|hardware error|\bedac\b|pcie bus error|\bahci\b.*error`)},
+	{KMSG_CAT_HUNG_TASK, regexp.MustCompile(`(?i)blocked for more than \d+ seconds|hung_task|soft lockup|rcu_sched self-detected stall`)},
+}
+
+// KmsgReader incrementally reads the kernel ring buffer, only returning
+// records newer than the last one seen
+type KmsgReader struct {
+	bootID  string
+	lastSeq uint64
+	hasSeq  bool
+}
+
+// NewKmsgReader returns a reader that starts after lastSeq when the
+// system has not rebooted since bootID was recorded
+func NewKmsgReader(bootID string, lastSeq uint64) *KmsgReader {
+	k := &KmsgReader{bootID: currentBootID()}
+	if bootID != "" && bootID == k.bootID {
+		k.lastSeq = lastSeq
+		k.hasSeq = true
+	}
+	return k
+}
+
+// Cursor returns the boot ID and sequence number of the last record read
+func (k *KmsgReader) Cursor() (string, uint64) {
+	return k.bootID, k.lastSeq
+}
+
+// ReadEvents returns the new kernel records that match a known category
+func (k *KmsgReader) ReadEvents() ([]rmm.KernelEvent, error) {
+	ret := make([]rmm.KernelEvent, 0)
+
+	// raw syscalls, an os.File would park on the runtime poller instead
+	// of returning EAGAIN at the end of the buffer
+	fd, err := unix.Open(kmsgDevice, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return ret, err
+	}
+	defer unix.Close(fd)
+
+	bootTime := bootTime()
+	// each read returns exactly one record, which the kernel caps below 8K
+	buf := make([]byte, 8192)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				break
+			}
+			// older records were overwritten while reading, keep going
+			if errors.Is(err, unix.EPIPE) {
+				continue
+			}
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return ret, err
+		}
+		if n == 0 {
+			break
+		}
+
+		seq, prio, usec, msg, ok := parseKmsgRecord(buf[:n])
+		if !ok {
+			continue
+		}
+		if k.hasSeq && seq <= k.lastSeq {
+			continue
+		}
+		k.lastSeq = seq
+		k.hasSeq = true
+
+		category := classifyKmsg(msg)
+		if category == "" {
+			continue
+		}
+
+		ret = append(ret, rmm.KernelEvent{
+			Seq:      seq,
+			Priority: prio,
+			Category: category,
+			Message:  msg,
+			Time:     bootTime.Add(time.Duration(usec) * time.Microsecond).String(),
+		})
+	}
+	return ret, nil
+}
+
+// openKmsgCursor returns a reader positioned at the cursor saved under
+// name in dir. Without one it starts at the current end of the buffer, so a
+// new consumer doesn't report everything logged since boot. After a reboot
+// it reads the new boot's buffer from the start.
+func openKmsgCursor(dir, name string) (*KmsgReader, error) {
+	bootID, seq := loadKmsgCursor(dir, name)
+	k := NewKmsgReader(bootID, seq)
+	if bootID == "" {
+		if _, err := k.ReadEvents(); err != nil {
+			return k, err
+		}
+	}
+	return k, nil
+}
+
+// parseKmsgRecord parses a "prio,seq,usec,flags;message" record
+// Source: https://www.kernel.org/doc/Documentation/ABI/testing/dev-kmsg
+func parseKmsgRecord(rec []byte) (seq uint64, prio int, usec uint64, msg string, ok bool) {
+	semi := bytes.IndexByte(rec, ';')
+	if semi < 0 {
+		return
+	}
+
+	fields := strings.Split(string(rec[:semi]), ",")
+	if len(fields) < 3 {
+		return
+	}
+
+	p, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	seq, err = strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	usec, err = strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return
+	}
+
+	// continuation lines (" KEY=value") follow the first newline
+	body := rec[semi+1:]
+	if nl := bytes.IndexByte(body, '\n'); nl >= 0 {
+		body = body[:nl]
+	}
+
+	return seq, p & 7, usec, string(body), true
+}
+
+// classifyKmsg returns the event category of a kernel message, or "" when
+// the message is not one we monitor
+func classifyKmsg(msg string) string {
+	for _, rule := range kmsgRules {
+		if rule.re.MatchString(msg) {
+			return rule.category
+		}
+	}
+	return ""
+}
+
+func currentBootID() string {
+	b, err := os.ReadFile(KMSG_BOOT_ID)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// bootTime approximates the wall clock time of boot from CLOCK_MONOTONIC,
+// which is the clock /dev/kmsg timestamps use
+func bootTime() time.Time {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return time.Now()
+	}
+	return time.Now().Add(-time.Duration(ts.Nano()))
+}
+
+// kmsgCursorName returns the cursor file name for a kmsg consumer
+func kmsgCursorName(id string) string {
+	return fmt.Sprintf(KMSG_CURSOR_FILE, id)
+}
+
+// loadKmsgCursor reads the last boot ID and sequence number saved under
+// name in dir
+func loadKmsgCursor(dir, name string) (string, uint64) {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", 0
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return "", 0
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return fields[0], seq
+}
+
+// saveKmsgCursor persists the reader position so the next run only
+// sees new records
+func saveKmsgCursor(dir, name string, k *KmsgReader) error {
+	bootID, seq := k.Cursor()
+	content := fmt.Sprintf("%s %d\n", bootID, seq)
+	return os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+}
+
+// kmsgCursorDir returns the dir the kmsg cursors are kept in, which is in
+// the state dir so they survive a reboot and nobody else can move them
+func (a *linuxAgent) kmsgCursorDir() (string, error) {
+	return a.StateSubdir(KMSG_CURSOR_DIR)
+}
@@ -0,0 +1,270 @@
+package linux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/nats-io/nats.go"
+	"github.com/ugorji/go/codec"
+)
+
+type NatsMsg struct {
+	shared.RpcPayload
+	ScriptArgs  []string            `json:"script_args"`
+	TaskId      int                 `json:"task_id"`
+	CheckUpdate shared.CheckUpdate  `json:"check_update"`
+	RunAsUser   bool                `json:"run_as_user"`
+	RunAs       string              `json:"run_as_username"`
+	Env         map[string]string   `json:"env_vars"`
+	Secrets     []shared.SecretRef  `json:"secrets"`
+	Limits      shared.ScriptLimits `json:"limits"`
+	Signature   string              `json:"signature"`
+	ScriptHash  string              `json:"script_hash"`
+}
+
+func (p *NatsMsg) scriptOptions() agent.ScriptOptions {
+	return agent.ScriptOptions{RunAsUser: p.RunAsUser, User: p.RunAs, Env: p.Env, Secrets: p.Secrets, Limits: p.Limits, Signature: p.Signature, Hash: p.ScriptHash}
+}
+
+// RunService handles incoming RPC (NATS) payloads from server and dispatches tasks
+func (a *linuxAgent) RunService() {
+	a.Logger.Infoln("Agent service started")
+	opts := a.SetupNatsOptions()
+	server := fmt.Sprintf("tls://%s:%d", a.ApiURL, a.ApiPort)
+	nc, err := nats.Connect(server, opts...)
+	if err != nil {
+		a.Logger.Fatalln(err)
+	}
+
+	go a.RunAgentService(nc)
+
+	nc.Subscribe(a.AgentID, func(msg *nats.Msg) {
+		a.ProcessRpcMsg(nc, msg)
+	})
+
+	nc.Flush()
+
+	if err := nc.LastError(); err != nil {
+		a.Logger.Errorln(err)
+		os.Exit(1)
+	}
+
+	runtime.Goexit()
+}
+
+func (a *linuxAgent) RunAgentService(nc *nats.Conn) {
+	a.CreateAgentTempDir()
+	go a.CheckRunner()
+	go a.RunMetrics(context.Background())
+	go a.ServePrometheus(context.Background())
+	go a.RunOTLP(context.Background())
+	go a.RunInterpreterDiscovery(context.Background())
+	go a.RunCheckIns(context.Background())
+	go a.KernelLogMonitor(context.Background())
+	a.Outbox.SetConn(nc)
+	a.Outbox.Start(context.Background())
+}
+
+func (a *linuxAgent) ProcessRpcMsg(nc *nats.Conn, m *nats.Msg) {
+	var payload *NatsMsg
+	var mh codec.MsgpackHandle
+	mh.RawToString = true
+
+	dec := codec.NewDecoderBytes(m.Data, &mh)
+	if err := dec.Decode(&payload); err != nil {
+		a.Logger.Errorln(err)
+		return
+	}
+	msg := agent.NewRpcReply(m, payload.Func)
+
+	switch payload.Func {
+	case agent.NATS_CMD_PING:
+		go func() {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			a.Logger.Debugln("pong")
+			ret.Encode("pong")
+			msg.Respond(resp)
+		}()
+
+	case agent.NATS_CMD_SCRIPT_RUN:
+		go func(p *NatsMsg) {
+			var resp []byte
+			var retData string
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			stdout, stderr, _, err := a.RunScriptJob(p.Data["job_id"], agent.JOB_KIND_SCRIPT, p.Data["shell"], p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.scriptOptions())
+			if err != nil {
+				a.Logger.Debugln(err)
+				retData = err.Error()
+			} else {
+				retData = stdout + stderr
+			}
+			a.Logger.Debugln(retData)
+			ret.Encode(retData)
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_SCRIPT_RUN_FULL:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			jobID := p.Data["job_id"]
+			if jobID == "" {
+				jobID = agent.NewJobID()
+			}
+			start := time.Now()
+			out, err, retcode, runErr := a.RunScriptJob(jobID, agent.JOB_KIND_SCRIPT, p.Data["shell"], p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.scriptOptions())
+			var scriptErr *agent.ScriptError
+			errors.As(runErr, &scriptErr)
+			retData := struct {
+				JobID    string             `json:"job_id"`
+				Stdout   string             `json:"stdout"`
+				Stderr   string             `json:"stderr"`
+				Retcode  int                `json:"retcode"`
+				ExecTime float64            `json:"execution_time"`
+				Error    *agent.ScriptError `json:"error,omitempty"`
+			}{jobID, out, err, retcode, time.Since(start).Seconds(), scriptErr}
+			a.Logger.Debugln(retData)
+			ret.Encode(retData)
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_CPULOADAVG:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			// optional window (1, 5 or 15 minutes) and percentile of the samples
+			minutes, _ := strconv.Atoi(p.Data["minutes"])
+			pct, _ := strconv.ParseFloat(p.Data["percentile"], 64)
+			loadAvg, ok := a.SampledCPULoad(minutes, pct)
+			if minutes <= 0 || !ok {
+				loadAvg = a.GetCPULoadAvg()
+			}
+			a.Logger.Debugln("CPU Load Average:", loadAvg)
+			ret.Encode(loadAvg)
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_SYSINFO:
+		go func() {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			a.Logger.Debugln("Sending agent info")
+			a.CheckIn(nc, CHECKIN_MODE_OSINFO)
+			ret.Encode("ok")
+			msg.Respond(resp)
+		}()
+
+	case agent.NATS_CMD_TASK_RUN:
+		go func(p *NatsMsg) {
+			a.Logger.Debugln("Running task")
+			a.RunTask(p.TaskId)
+		}(payload)
+
+	case agent.NATS_CMD_SCRIPT_RUN_STREAM:
+		// output goes to stream_subject, or the reply subject, as it comes.
+		// A separate stream_subject gets the request acked with the job id.
+		go func(p *NatsMsg) {
+			subject := p.Data["stream_subject"]
+			if subject == "" {
+				subject = m.Reply
+			}
+			if subject == "" {
+				a.Logger.Debugln("Script stream: no subject to stream to")
+				return
+			}
+			a.StreamScript(nc, msg, subject, p.Data["job_id"], p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.scriptOptions())
+		}(payload)
+
+	case agent.NATS_CMD_SECRET_SET:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if err := a.SetSecret(p.Data["key"], p.Data["value"]); err != nil {
+				a.Logger.Debugln("Set secret:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode("ok")
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_SECRET_DEL:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if err := a.DeleteSecret(p.Data["key"]); err != nil {
+				a.Logger.Debugln("Delete secret:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode("ok")
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_JOBS_LIST:
+		go func() {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			ret.Encode(a.Jobs.List())
+			msg.Respond(resp)
+		}()
+
+	case agent.NATS_CMD_JOB_STATUS:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if job, err := a.Jobs.Get(p.Data["job_id"]); err != nil {
+				a.Logger.Debugln("Job status:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode(job)
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_JOB_CANCEL:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if err := a.Jobs.Cancel(p.Data["job_id"]); err != nil {
+				a.Logger.Debugln("Cancel job:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode("ok")
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case agent.NATS_CMD_CHECKS_UPDATE:
+		// applied in order, so an update is never overtaken by an older one
+		var resp []byte
+		ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+		version := a.Scheduler.ApplyUpdate(payload.CheckUpdate)
+		a.Logger.Debugln("Check definitions at version", version)
+		ret.Encode(version)
+		msg.Respond(resp)
+
+	case agent.NATS_CMD_RUNCHECKS:
+		go func() {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if !a.Scheduler.RunNow() {
+				ret.Encode("busy")
+				msg.Respond(resp)
+				a.Logger.Debugln("A check run is already pending, please wait")
+			} else {
+				ret.Encode("ok")
+				msg.Respond(resp)
+				a.Logger.Debugln("Running checks")
+			}
+		}()
+	}
+}
@@ -0,0 +1,382 @@
+package linux
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rmm "github.com/jetrmm/rmm-agent/shared"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	PROC_MDSTAT    = "/proc/mdstat"
+	PROC_MOUNTINFO = "/proc/self/mountinfo"
+	ETC_FSTAB      = "/etc/fstab"
+
+	// RAID array health
+	MD_HEALTH_CLEAN    = "clean"
+	MD_HEALTH_DEGRADED = "degraded"
+	MD_HEALTH_INACTIVE = "inactive"
+	MD_HEALTH_CHECK    = "check"
+
+	STALE_MOUNT_TIMEOUT = 5 * time.Second
+)
+
+var (
+	// e.g. "1046528 blocks super 1.2 [2/1] [U_]"
+	mdStatusRe = regexp.MustCompile(`\[(\d+)/(\d+)\]\s+\[([U_]+)\]`)
+	// e.g. "[==>......]  resync = 12.6% (132096/1046528) finish=0.1min"
+	mdSyncRe = regexp.MustCompile(`\b(resync|recovery|reshape|check)\s*=\s*([\d.]+)%`)
+
+	networkFstypes = []string{"nfs", "nfs4", "cifs", "smb3", "smbfs", "9p", "fuse.sshfs", "glusterfs", "fuse.glusterfs", "ceph", "fuse.ceph"}
+
+	// the stats in flight by path, a stat blocked on a hung mount is waited
+	// on again instead of leaking another goroutine every run
+	staleStats = struct {
+		sync.Mutex
+		calls map[string]*statCall
+	}{calls: make(map[string]*statCall)}
+
+	statPath = func(path string) error {
+		var st unix.Stat_t
+		return unix.Stat(path, &st)
+	}
+)
+
+// statCall is a stat of a possibly hung mount
+type statCall struct {
+	start time.Time
+	done  chan struct{}
+	err   error
+}
+
+// mountInfo is one line of /proc/self/mountinfo
+type mountInfo struct {
+	Device  string
+	Path    string
+	Fstype  string
+	Options []string
+}
+
+// GetMdArrays returns the md arrays listed in /proc/mdstat
+func GetMdArrays() ([]rmm.MdArray, error) {
+	f, err := os.Open(PROC_MDSTAT)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMdstat(f), nil
+}
+
+// parseMdstat parses the /proc/mdstat format
+// Source: https://raid.wiki.kernel.org/index.php/Mdstat
+func parseMdstat(r io.Reader) []rmm.MdArray {
+	ret := make([]rmm.MdArray, 0)
+	var cur *rmm.MdArray
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// "md0 : active raid1 sdb1[1] sda1[0](F)"
+		if strings.HasPrefix(fields[0], "md") && len(fields) >= 3 && fields[1] == ":" {
+			ret = append(ret, rmm.MdArray{
+				Name:    fields[0],
+				State:   fields[2],
+				Devices: make([]string, 0),
+				Failed:  make([]string, 0),
+				Health:  MD_HEALTH_CLEAN,
+			})
+			cur = &ret[len(ret)-1]
+
+			devs := fields[3:]
+			// "active (auto-read-only) raid1 ..."
+			if len(devs) > 0 && strings.HasPrefix(devs[0], "(") {
+				devs = devs[1:]
+			}
+			if len(devs) > 0 && !strings.Contains(devs[0], "[") {
+				cur.Level = devs[0]
+				devs = devs[1:]
+			}
+			for _, d := range devs {
+				name := d
+				if i := strings.IndexByte(d, '['); i > 0 {
+					name = d[:i]
+				}
+				cur.Devices = append(cur.Devices, name)
+				if strings.HasSuffix(d, "(F)") {
+					cur.Failed = append(cur.Failed, name)
+				}
+			}
+			if cur.State == MD_HEALTH_INACTIVE {
+				cur.Health = MD_HEALTH_INACTIVE
+			}
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+
+		if m := mdStatusRe.FindStringSubmatch(line); m != nil {
+			cur.Expected, _ = strconv.Atoi(m[1])
+			cur.Active, _ = strconv.Atoi(m[2])
+			if cur.Active < cur.Expected || strings.Contains(m[3], "_") {
+				cur.Health = MD_HEALTH_DEGRADED
+			}
+			continue
+		}
+
+		if m := mdSyncRe.FindStringSubmatch(line); m != nil {
+			// a degraded array rebuilding is still degraded
+			if cur.Health != MD_HEALTH_DEGRADED {
+				cur.Health = m[1]
+			}
+			cur.Progress, _ = strconv.ParseFloat(m[2], 64)
+		}
+	}
+
+	for i := range ret {
+		if len(ret[i].Failed) > 0 && ret[i].Health == MD_HEALTH_CLEAN {
+			ret[i].Health = MD_HEALTH_DEGRADED
+		}
+	}
+	return ret
+}
+
+// getMounts returns the current mount table
+func getMounts() ([]mountInfo, error) {
+	f, err := os.Open(PROC_MOUNTINFO)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f), nil
+}
+
+// parseMountInfo parses the /proc/<pid>/mountinfo format
+// Source: https://www.kernel.org/doc/Documentation/filesystems/proc.txt
+func parseMountInfo(r io.Reader) []mountInfo {
+	ret := make([]mountInfo, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		left, right, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		lf := strings.Fields(left)
+		rf := strings.Fields(right)
+		if len(lf) < 6 || len(rf) < 2 {
+			continue
+		}
+
+		// the per-mount flags (ro, nosuid, ...) come first, then the superblock options
+		opts := strings.Split(lf[5], ",")
+		if len(rf) > 2 {
+			for _, o := range strings.Split(rf[2], ",") {
+				if !slices.Contains(opts, o) {
+					opts = append(opts, o)
+				}
+			}
+		}
+
+		ret = append(ret, mountInfo{
+			Device:  unescapeMountPath(rf[1]),
+			Path:    unescapeMountPath(lf[4]),
+			Fstype:  rf[0],
+			Options: opts,
+		})
+	}
+	return ret
+}
+
+// unescapeMountPath decodes the octal escapes (\040 etc) the kernel uses
+// for whitespace in mount paths
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// checkMount verifies an expected mount against the mount table
+func checkMount(want rmm.ExpectedMount, mounts []mountInfo) rmm.MountStatus {
+	status := rmm.MountStatus{
+		Path:   want.Path,
+		Errors: make([]string, 0),
+	}
+
+	// with stacked mounts the last entry is the visible one
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].Path == want.Path {
+			found = &mounts[i]
+		}
+	}
+	if found == nil {
+		status.Errors = append(status.Errors, "not mounted")
+		return status
+	}
+
+	status.Mounted = true
+	status.Device = found.Device
+	status.Fstype = found.Fstype
+	status.Options = found.Options
+	status.ReadOnly = slices.Contains(found.Options, "ro")
+
+	if want.Fstype != "" && want.Fstype != found.Fstype {
+		status.Errors = append(status.Errors, "fstype is "+found.Fstype+", expected "+want.Fstype)
+	}
+	for _, o := range want.Options {
+		if !slices.Contains(found.Options, o) {
+			status.Errors = append(status.Errors, "missing option "+o)
+		}
+	}
+	if status.ReadOnly && !slices.Contains(want.Options, "ro") {
+		status.Errors = append(status.Errors, "mounted read-only")
+	}
+
+	if isNetworkMount(*found) && isStaleMount(found.Path, STALE_MOUNT_TIMEOUT) {
+		status.Stale = true
+		status.Errors = append(status.Errors, "stale mount, stat timed out")
+	}
+	return status
+}
+
+// readOnlyMounts returns the filesystems that are mounted read-only even
+// though fstab asks for read-write, which usually means the kernel
+// remounted them after an error
+func readOnlyMounts(mounts []mountInfo) []mountInfo {
+	ret := make([]mountInfo, 0)
+
+	f, err := os.Open(ETC_FSTAB)
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	fstab := parseFstab(f)
+
+	for _, m := range mounts {
+		opts, ok := fstab[m.Path]
+		if !ok || slices.Contains(opts, "ro") {
+			continue
+		}
+		if slices.Contains(m.Options, "ro") {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// parseFstab returns the mount options of each fstab entry by mount point
+func parseFstab(r io.Reader) map[string][]string {
+	ret := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ret[unescapeMountPath(fields[1])] = strings.Split(fields[3], ",")
+	}
+	return ret
+}
+
+func isNetworkMount(m mountInfo) bool {
+	return slices.Contains(networkFstypes, m.Fstype)
+}
+
+// staleMounts returns the network mounts that are stale, stating them all
+// at once so hung mounts don't add up their timeouts
+func staleMounts(mounts []mountInfo, timeout time.Duration) []mountInfo {
+	// with stacked mounts the last entry is the visible one
+	visible := make(map[string]mountInfo)
+	for _, m := range mounts {
+		visible[m.Path] = m
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ret := make([]mountInfo, 0)
+	for _, m := range visible {
+		if !isNetworkMount(m) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if isStaleMount(m.Path, timeout) {
+				mu.Lock()
+				ret = append(ret, m)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(ret, func(a, b mountInfo) int { return strings.Compare(a.Path, b.Path) })
+	return ret
+}
+
+// isStaleMount reports whether a stat of path does not return within
+// timeout, which is how hung NFS/CIFS mounts present. The stat may stay
+// blocked in the kernel, so only one is ever in flight per path: while it
+// is, later calls wait on it, and report stale at once when it has been
+// blocked longer than timeout.
+func isStaleMount(path string, timeout time.Duration) bool {
+	staleStats.Lock()
+	c, ok := staleStats.calls[path]
+	if !ok {
+		c = &statCall{start: time.Now(), done: make(chan struct{})}
+		staleStats.calls[path] = c
+		go func() {
+			c.err = statPath(path)
+			staleStats.Lock()
+			delete(staleStats.calls, path)
+			staleStats.Unlock()
+			close(c.done)
+		}()
+	}
+	staleStats.Unlock()
+
+	// ESTALE is returned directly when the server lost the file handle
+	select {
+	case <-c.done:
+		return c.err == unix.ESTALE
+	default:
+	}
+	wait := timeout - time.Since(c.start)
+	if wait <= 0 {
+		return true
+	}
+
+	select {
+	case <-c.done:
+		return c.err == unix.ESTALE
+	case <-time.After(wait):
+		return true
+	}
+}
@@ -0,0 +1,206 @@
+package linux
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rmm "github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestStaleMountStatsOnlyOnce(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	saved := statPath
+	statPath = func(string) error {
+		calls.Add(1)
+		<-release
+		return nil
+	}
+	defer func() { statPath = saved }()
+
+	const timeout = 50 * time.Millisecond
+	if !isStaleMount("/mnt/hung", timeout) {
+		t.Fatal("isStaleMount() = false for a blocked stat")
+	}
+	start := time.Now()
+	if !isStaleMount("/mnt/hung", timeout) {
+		t.Error("isStaleMount() = false while the stat is still blocked")
+	}
+	if d := time.Since(start); d >= timeout {
+		t.Errorf("isStaleMount() waited %s on a stat already blocked past the timeout", d)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d stats started, want 1", n)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for isStaleMount("/mnt/hung", timeout) {
+		if time.Now().After(deadline) {
+			t.Fatal("isStaleMount() still stale after the stat returned")
+		}
+	}
+}
+
+func TestStaleMountsCoversUnexpectedNetworkMounts(t *testing.T) {
+	saved := statPath
+	statPath = func(path string) error {
+		if path == "/mnt/nfs-hung" {
+			select {}
+		}
+		return nil
+	}
+	defer func() { statPath = saved }()
+
+	mounts := []mountInfo{
+		{Path: "/", Fstype: "ext4"},
+		{Path: "/mnt/nfs-ok", Fstype: "nfs4"},
+		{Path: "/mnt/nfs-hung", Fstype: "nfs4"},
+		{Path: "/mnt/local-hung", Fstype: "xfs"},
+	}
+	got := staleMounts(mounts, 50*time.Millisecond)
+	if len(got) != 1 || got[0].Path != "/mnt/nfs-hung" {
+		t.Errorf("staleMounts() = %+v, want /mnt/nfs-hung", got)
+	}
+}
+
+func TestStaleMountFinishedStatIsNotStale(t *testing.T) {
+	// a stat that returned after the timeout, but before it was looked at
+	done := make(chan struct{})
+	close(done)
+	for i := 0; i < 100; i++ {
+		staleStats.Lock()
+		staleStats.calls["/mnt/slow"] = &statCall{start: time.Now().Add(-time.Hour), done: done}
+		staleStats.Unlock()
+		if isStaleMount("/mnt/slow", time.Second) {
+			t.Fatal("isStaleMount() = true for a stat that returned")
+		}
+	}
+	staleStats.Lock()
+	delete(staleStats.calls, "/mnt/slow")
+	staleStats.Unlock()
+}
+
+func TestParseMdstat(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mdstat string
+		want   []rmm.MdArray
+	}{
+		{
+			name: "clean",
+			mdstat: `Personalities : [raid1] [linear] [multipath] [raid0] [raid6] [raid5] [raid4] [raid10]
+md0 : active raid1 sdb1[1] sda1[0]
+      1046528 blocks super 1.2 [2/2] [UU]
+
+unused devices: <none>
+`,
+			want: []rmm.MdArray{{Name: "md0", State: "active", Level: "raid1", Devices: []string{"sdb1", "sda1"}, Failed: []string{}, Expected: 2, Active: 2, Health: MD_HEALTH_CLEAN}},
+		},
+		{
+			name: "degraded",
+			mdstat: `Personalities : [raid1]
+md1 : active raid1 sdc1[2](F) sdd1[0]
+      976630464 blocks super 1.2 [2/1] [U_]
+      bitmap: 3/8 pages [12KB], 65536KB chunk
+
+unused devices: <none>
+`,
+			want: []rmm.MdArray{{Name: "md1", State: "active", Level: "raid1", Devices: []string{"sdc1", "sdd1"}, Failed: []string{"sdc1"}, Expected: 2, Active: 1, Health: MD_HEALTH_DEGRADED}},
+		},
+		{
+			name: "resyncing",
+			mdstat: `Personalities : [raid6] [raid5] [raid4]
+md127 : active raid5 sde[3] sdd[2] sdc[1] sdb[0]
+      5860147200 blocks super 1.2 level 5, 512k chunk, algorithm 2 [4/4] [UUUU]
+      [===>.................]  resync = 17.3% (338358784/1953382400) finish=172.3min speed=156160K/sec
+      bitmap: 13/15 pages [52KB], 65536KB chunk
+
+unused devices: <none>
+`,
+			want: []rmm.MdArray{{Name: "md127", State: "active", Level: "raid5", Devices: []string{"sde", "sdd", "sdc", "sdb"}, Failed: []string{}, Expected: 4, Active: 4, Health: "resync", Progress: 17.3}},
+		},
+		{
+			name: "recovering a degraded array",
+			mdstat: `md2 : active raid1 sdb2[2] sda2[0]
+      488253440 blocks super 1.2 [2/1] [U_]
+      [>....................]  recovery =  2.1% (10419712/488253440) finish=46.0min speed=173119K/sec
+`,
+			want: []rmm.MdArray{{Name: "md2", State: "active", Level: "raid1", Devices: []string{"sdb2", "sda2"}, Failed: []string{}, Expected: 2, Active: 1, Health: MD_HEALTH_DEGRADED, Progress: 2.1}},
+		},
+		{
+			name: "inactive and auto-read-only",
+			mdstat: `md126 : inactive sdf[0](S)
+      976630488 blocks super 1.2
+
+md125 : active (auto-read-only) raid1 sdg1[1] sdh1[0]
+      1046528 blocks super 1.2 [2/2] [UU]
+`,
+			want: []rmm.MdArray{
+				{Name: "md126", State: "inactive", Devices: []string{"sdf"}, Failed: []string{}, Health: MD_HEALTH_INACTIVE},
+				{Name: "md125", State: "active", Level: "raid1", Devices: []string{"sdg1", "sdh1"}, Failed: []string{}, Expected: 2, Active: 2, Health: MD_HEALTH_CLEAN},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseMdstat(strings.NewReader(tt.mdstat))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMdstat() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountinfo := `22 1 8:2 / / rw,relatime shared:1 - ext4 /dev/sda2 rw,errors=remount-ro
+25 22 0:23 / /proc rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw
+40 22 8:3 / /mnt/backup\040disk ro,relatime shared:20 - xfs /dev/sdb1 rw,attr2,inode64
+41 22 0:45 / /mnt/nfs rw,relatime shared:21 - nfs4 server:/export\040share rw,vers=4.2,hard,proto=tcp
+bogus line without a separator
+`
+	want := []mountInfo{
+		{Device: "/dev/sda2", Path: "/", Fstype: "ext4", Options: []string{"rw", "relatime", "errors=remount-ro"}},
+		{Device: "proc", Path: "/proc", Fstype: "proc", Options: []string{"rw", "nosuid", "nodev", "noexec", "relatime"}},
+		{Device: "/dev/sdb1", Path: "/mnt/backup disk", Fstype: "xfs", Options: []string{"ro", "relatime", "rw", "attr2", "inode64"}},
+		{Device: "server:/export share", Path: "/mnt/nfs", Fstype: "nfs4", Options: []string{"rw", "relatime", "vers=4.2", "hard", "proto=tcp"}},
+	}
+	got := parseMountInfo(strings.NewReader(mountinfo))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountInfo() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseFstab(t *testing.T) {
+	fstab := `# /etc/fstab: static file system information.
+UUID=0a1b2c3d / ext4 errors=remount-ro 0 1
+/dev/sdb1 /mnt/backup\040disk xfs defaults,nofail 0 2
+server:/export /mnt/nfs nfs4 rw,hard,_netdev 0 0
+tmpfs /tmp tmpfs
+`
+	want := map[string][]string{
+		"/":                {"errors=remount-ro"},
+		"/mnt/backup disk": {"defaults", "nofail"},
+		"/mnt/nfs":         {"rw", "hard", "_netdev"},
+	}
+	if got := parseFstab(strings.NewReader(fstab)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFstab() = %v, want %v", got, want)
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"/mnt/plain":            "/mnt/plain",
+		`/mnt/with\040space`:    "/mnt/with space",
+		`/mnt/tab\011and\012nl`: "/mnt/tab\tand\nnl",
+		`/mnt/back\134slash`:    `/mnt/back\slash`,
+		`/mnt/short\04`:         `/mnt/short\04`,
+		`/mnt/not\999octal`:     `/mnt/not\999octal`,
+	} {
+		if got := unescapeMountPath(in); got != want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package linux
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+	jrmm "github.com/jetrmm/rmm-shared"
+	"github.com/nats-io/nats.go"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	CHECKIN_KEY_PREFIX  = "checkin-"
+	CHECKIN_MODE_OSINFO = "osinfo"
+
+	NATS_MODE_KERNELLOG = "agent-kernellog"
+	NATS_MODE_OSINFO    = "agent-agentinfo"
+
+	// present when an installed package asks for a reboot
+	REBOOT_REQUIRED_FILE = "/var/run/reboot-required"
+
+	KMSG_MONITOR_CURSOR   = "monitor"
+	KMSG_MONITOR_INTERVAL = 30 * time.Second
+	KMSG_OUTBOX_PREFIX    = "kernellog-"
+)
+
+// KernelLogMonitor pushes newly classified kernel events through the
+// outbox until ctx is done
+func (a *linuxAgent) KernelLogMonitor(ctx context.Context) {
+	cursor := kmsgCursorName(KMSG_MONITOR_CURSOR)
+
+	var k *KmsgReader
+	ticker := time.NewTicker(KMSG_MONITOR_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		dir, err := a.kmsgCursorDir()
+		if err != nil {
+			a.Logger.Debugln("KernelLogMonitor", err)
+			continue
+		}
+		// retried until the kernel log can be read, so a failed start
+		// doesn't later push everything since boot
+		if k == nil {
+			r, err := openKmsgCursor(dir, cursor)
+			if err != nil {
+				a.Logger.Debugln("KernelLogMonitor", err)
+				continue
+			}
+			k = r
+			if err := saveKmsgCursor(dir, cursor, k); err != nil {
+				a.Logger.Debugln("KernelLogMonitor", err)
+			}
+		}
+
+		if err := a.pushKernelEvents(dir, cursor, k); err != nil {
+			a.Logger.Debugln("KernelLogMonitor", err)
+			// the reader has moved past the events, go back to the saved
+			// cursor so they are read again
+			k = nil
+		}
+	}
+}
+
+// pushKernelEvents queues the new kernel events in the outbox and then
+// saves the cursor. The cursor is left alone if they couldn't be queued.
+func (a *linuxAgent) pushKernelEvents(dir, cursor string, k *KmsgReader) error {
+	evts, err := k.ReadEvents()
+	if err != nil {
+		return err
+	}
+	if len(evts) > 0 {
+		payload := rmm.KernelEventsNats{
+			AgentId: a.AgentID,
+			Events:  evts,
+		}
+
+		var msg []byte
+		if err := codec.NewEncoderBytes(&msg, new(codec.MsgpackHandle)).Encode(payload); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s%d", KMSG_OUTBOX_PREFIX, evts[len(evts)-1].Seq)
+		if err := a.Outbox.NATS(key, a.AgentID, NATS_MODE_KERNELLOG, msg); err != nil && err != agent.ErrQueued {
+			return err
+		}
+	}
+	return saveKmsgCursor(dir, cursor, k)
+}
+
+// RunCheckIns sends the agentinfo check-in shortly after startup and then
+// every few minutes, until ctx is done
+func (a *linuxAgent) RunCheckIns(ctx context.Context) {
+	delay := time.Duration(14+rand.Intn(8)) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		a.CheckIn(nil, CHECKIN_MODE_OSINFO)
+		delay = time.Duration(250+rand.Intn(200)) * time.Second
+	}
+}
+
+// CheckIn Check in with the server. Only the agentinfo mode is sent on
+// Linux, others are ignored.
+func (a *linuxAgent) CheckIn(_ *nats.Conn, mode string) {
+	var payload interface{}
+	var nMode string
+
+	switch mode {
+	case CHECKIN_MODE_OSINFO:
+		plat, osInfo := a.OSInfo()
+		_, err := os.Stat(REBOOT_REQUIRED_FILE)
+
+		nMode = NATS_MODE_OSINFO
+		payload = rmm.AgentInfo{
+			AgentInfoNats: jrmm.AgentInfoNats{
+				AgentId:      a.AgentID,
+				Username:     loggedOnUser(),
+				Hostname:     a.GetHostname(),
+				OS:           osInfo,
+				Platform:     plat,
+				TotalRAM:     a.TotalRAM(),
+				BootTime:     a.BootTime(),
+				RebootNeeded: err == nil,
+				GoArch:       runtime.GOARCH,
+			},
+			Interpreters: a.InterpreterInventory(),
+		}
+
+	default:
+		a.Logger.Debugln("Checkin mode not supported on Linux:", mode)
+		return
+	}
+
+	var msg []byte
+	if err := codec.NewEncoderBytes(&msg, new(codec.MsgpackHandle)).Encode(payload); err != nil {
+		a.Logger.Debugln("Checkin:", err)
+		return
+	}
+	// newer check-ins of the same mode replace undelivered ones
+	if err := a.Outbox.NATS(CHECKIN_KEY_PREFIX+mode, a.AgentID, nMode, msg); err == nil {
+		agent.Stats.CheckedIn()
+	} else if err == agent.ErrQueued {
+		a.Logger.Debugln("Checkin queued:", mode)
+	} else {
+		a.Logger.Debugln("Checkin:", err)
+	}
+}
+
+// loggedOnUser returns the first user with a login session, if any
+func loggedOnUser() string {
+	users, err := host.Users()
+	if err != nil || len(users) == 0 {
+		return ""
+	}
+	return users[0].User
+}
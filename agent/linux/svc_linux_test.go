@@ -0,0 +1,117 @@
+package linux
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+	"github.com/ugorji/go/codec"
+)
+
+func TestAgentInfoCheckInReportsInterpreters(t *testing.T) {
+	a := testAgent(t)
+	a.AgentID = "agent-1"
+	dir := t.TempDir()
+	ob, err := agent.NewOutbox(dir, a.Logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Outbox = ob
+
+	// no connection, the check-in is queued
+	a.CheckIn(nil, CHECKIN_MODE_OSINFO)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("outbox has %d items, want 1", len(files))
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item agent.OutboxItem
+	if err := json.Unmarshal(raw, &item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Reply != NATS_MODE_OSINFO {
+		t.Errorf("mode = %q, want %q", item.Reply, NATS_MODE_OSINFO)
+	}
+	var data []byte
+	if err := json.Unmarshal(item.Body, &data); err != nil {
+		t.Fatal(err)
+	}
+	var info rmm.AgentInfo
+	if err := codec.NewDecoderBytes(data, new(codec.MsgpackHandle)).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.AgentId != "agent-1" {
+		t.Errorf("agent id = %q", info.AgentId)
+	}
+	var sh bool
+	for _, i := range info.Interpreters {
+		sh = sh || i.Name == "sh"
+	}
+	if !sh {
+		t.Errorf("interpreters = %v, want sh among them", info.Interpreters)
+	}
+}
+
+func TestKernelEventsAreNotLostWhenQueueingFails(t *testing.T) {
+	dev := filepath.Join(t.TempDir(), "kmsg")
+	withKmsgDevice(t, dev)
+	a := testAgent(t)
+	obDir := t.TempDir()
+	ob, err := agent.NewOutbox(obDir, a.Logger, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Outbox = ob
+	dir, err := a.kmsgCursorDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cursor = "test"
+
+	if err := os.WriteFile(dev, []byte("3,1,1000,-;booted\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := openKmsgCursor(dir, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveKmsgCursor(dir, cursor, k); err != nil {
+		t.Fatal(err)
+	}
+
+	// the outbox can't write the event
+	if err := os.WriteFile(dev, []byte("3,2,2000,-;Out of memory: Killed process 1234 (java)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(obDir)
+	if err := a.pushKernelEvents(dir, cursor, k); err == nil {
+		t.Fatal("pushKernelEvents() = nil with the outbox unwritable")
+	}
+	if _, seq := loadKmsgCursor(dir, cursor); seq != 1 {
+		t.Errorf("cursor moved to %d past the unsent event", seq)
+	}
+
+	// reopened at the saved cursor the event is read and queued again
+	if err := os.Mkdir(obDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	k, err = openKmsgCursor(dir, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.pushKernelEvents(dir, cursor, k); err != nil {
+		t.Fatal(err)
+	}
+	if ob.Len() != 1 {
+		t.Errorf("outbox has %d items, want the event", ob.Len())
+	}
+	if _, seq := loadKmsgCursor(dir, cursor); seq != 2 {
+		t.Errorf("cursor at %d, want 2", seq)
+	}
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	LOCK_DIR       = "locks"
+	LOCK_PID_WIDTH = 10 // the owner PID is space padded to this width
+
+	// Lock names
+	LOCK_AGENT_UPDATE    = "agentupdate"
+	LOCK_PATCH_SCAN      = "patchscan"
+	LOCK_PATCH_INSTALL   = "patchinstall"
+	LOCK_CHECK_PREFIX    = "check-"
+	LOCK_TASK_PREFIX     = "task-"
+	LOCK_MUTEX_NAMESPACE = "RMMAgent-"
+)
+
+// LockedError is returned when a lock is held by another process or
+// another part of this process
+type LockedError struct {
+	Name string
+	PID  int // 0 if the owner could not be determined
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is locked", e.Name)
+	}
+	return fmt.Sprintf("%s is locked by pid %d", e.Name, e.PID)
+}
+
+// Lock is a named lock shared by every agent process on the host. It is
+// released automatically if the owning process dies.
+type Lock struct {
+	Name    string
+	release func() error
+}
+
+// AcquireLock takes the named lock without waiting, returning a
+// *LockedError if it is already held. Lock files are kept in the state dir,
+// where nobody else can plant or hold them.
+func (a *Agent) AcquireLock(name string) (*Lock, error) {
+	dir, err := a.stateDir(LOCK_DIR)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := acquireLock(name, filepath.Join(dir, name+".lock"))
+	if err != nil {
+		return nil, err
+	}
+	return &Lock{Name: name, release: release}, nil
+}
+
+// Release frees the lock, it is safe to call more than once
+func (l *Lock) Release() error {
+	if l == nil || l.release == nil {
+		return nil
+	}
+	release := l.release
+	l.release = nil
+	return release()
+}
+
+// CheckLockName returns the lock name guarding a single check
+func CheckLockName(checkPK int) string {
+	return LOCK_CHECK_PREFIX + strconv.Itoa(checkPK)
+}
+
+// TaskLockName returns the lock name guarding a single task
+func TaskLockName(taskPK int) string {
+	return LOCK_TASK_PREFIX + strconv.Itoa(taskPK)
+}
+
+// readLockPID returns the owner PID recorded in a lock file
+func readLockPID(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid
+}
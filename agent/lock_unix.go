@@ -0,0 +1,43 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// acquireLock takes an flock on path. The kernel drops the flock when the
+// owning process exits, so a lock file left behind by a crashed agent is
+// simply locked again; the PID written to it is only for reporting.
+func acquireLock(name, path string) (func() error, error) {
+	// os.OpenFile sets O_CLOEXEC, so scripts we spawn can't inherit the
+	// lock, and a lock file replaced by a symlink is refused
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, &LockedError{Name: name, PID: readLockPID(path)}
+		}
+		return nil, err
+	}
+
+	// fixed width, so a shorter PID overwrites all of a longer one
+	_, _ = f.WriteAt([]byte(fmt.Sprintf("%*d", LOCK_PID_WIDTH, os.Getpid())), 0)
+
+	return func() error {
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockContentionAndRelease(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger()}
+
+	lock, err := a.AcquireLock(CheckLockName(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.AcquireLock(CheckLockName(1))
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("second AcquireLock() = %v, want a LockedError", err)
+	}
+	if locked.PID != os.Getpid() {
+		t.Errorf("owner pid = %d, want %d", locked.PID, os.Getpid())
+	}
+
+	// other names are independent
+	other, err := a.AcquireLock(CheckLockName(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Release()
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("second Release() = %v", err)
+	}
+	again, err := a.AcquireLock(CheckLockName(1))
+	if err != nil {
+		t.Fatalf("AcquireLock() after release = %v", err)
+	}
+	again.Release()
+}
+
+func TestLockRefusesSymlinks(t *testing.T) {
+	root := t.TempDir()
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: root}, Logger: testLogger()}
+	dir, err := a.stateDir(LOCK_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(target, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, CheckLockName(1)+".lock")); err != nil {
+		t.Fatal(err)
+	}
+
+	if lock, err := a.AcquireLock(CheckLockName(1)); err == nil {
+		lock.Release()
+		t.Error("AcquireLock() followed a symlink")
+	}
+	if b, _ := os.ReadFile(target); string(b) != "keep me" {
+		t.Errorf("symlink target changed to %q", b)
+	}
+}
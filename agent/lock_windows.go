@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/windows"
+)
+
+// acquireLock takes a named mutex in the Global namespace so the rpc and
+// agentsvc processes (and other sessions) share it. A mutex whose owner
+// died is reported as abandoned and simply taken over.
+//
+// Mutexes are owned by an OS thread, so the mutex is held by a goroutine
+// pinned to its thread until the lock is released.
+func acquireLock(name, path string) (func() error, error) {
+	mutexName, err := windows.UTF16PtrFromString(`Global\` + LOCK_MUTEX_NAMESPACE + name)
+	if err != nil {
+		return nil, err
+	}
+
+	acquired := make(chan error)
+	release := make(chan struct{})
+	released := make(chan error)
+
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		// ERROR_ALREADY_EXISTS comes back with a valid handle to the existing mutex
+		h, err := windows.CreateMutex(nil, false, mutexName)
+		if h == 0 {
+			acquired <- err
+			return
+		}
+
+		event, err := windows.WaitForSingleObject(h, 0)
+		switch event {
+		case windows.WAIT_OBJECT_0, windows.WAIT_ABANDONED:
+		case uint32(windows.WAIT_TIMEOUT):
+			windows.CloseHandle(h)
+			acquired <- &LockedError{Name: name, PID: readLockPID(path)}
+			return
+		default:
+			windows.CloseHandle(h)
+			if err == nil {
+				err = fmt.Errorf("unexpected wait result %d for %s", event, name)
+			}
+			acquired <- err
+			return
+		}
+
+		_ = os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0600)
+		acquired <- nil
+
+		<-release
+		_ = os.WriteFile(path, nil, 0600)
+		err = windows.ReleaseMutex(h)
+		windows.CloseHandle(h)
+		released <- err
+	}()
+
+	if err := <-acquired; err != nil {
+		return nil, err
+	}
+	return func() error {
+		close(release)
+		return <-released
+	}, nil
+}
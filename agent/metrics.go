@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	API_URL_METRICS = "/api/v3/metrics/"
+
+	METRICS_DIR                    = "metrics"
+	METRICS_DEFAULT_RESOLUTION     = 60  // seconds
+	METRICS_DEFAULT_UPLOAD_SECONDS = 300 // seconds
+	METRICS_SEGMENT_POINTS         = 60
+	METRICS_MAX_SEGMENTS           = 288
+	METRICS_UPLOAD_SEGMENTS        = 10 // segments sent per request
+	METRICS_SEGMENT_PREFIX         = "metrics-"
+	METRICS_SEGMENT_EXT            = ".jsonl"
+)
+
+// MetricsBatch is the payload of a metrics upload
+type MetricsBatch struct {
+	AgentID    string   `json:"agent_id"`
+	Resolution int      `json:"resolution"`
+	Points     []Sample `json:"points"`
+}
+
+// MetricsStore is a bounded on-disk buffer of metric points. Points are
+// appended to segment files, the oldest segments are dropped once there
+// are more than maxSegments.
+type MetricsStore struct {
+	dir         string
+	maxSegments int
+
+	mu      sync.Mutex
+	current string
+	points  int
+}
+
+// NewMetricsStore opens the store in dir, creating it if needed
+func NewMetricsStore(dir string) (*MetricsStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &MetricsStore{dir: dir, maxSegments: METRICS_MAX_SEGMENTS}, nil
+}
+
+// Append writes a point to the current segment
+func (m *MetricsStore) Append(p Sample) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.current == "" || m.points >= METRICS_SEGMENT_POINTS {
+		m.roll()
+	}
+	f, err := os.OpenFile(m.current, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	m.points++
+	return nil
+}
+
+// roll starts a new segment and drops the oldest ones over the limit
+func (m *MetricsStore) roll() {
+	m.current = filepath.Join(m.dir, fmt.Sprintf("%s%d%s", METRICS_SEGMENT_PREFIX, time.Now().UnixNano(), METRICS_SEGMENT_EXT))
+	m.points = 0
+
+	segs, err := m.segments()
+	if err != nil {
+		return
+	}
+	// leave room for the new segment
+	for len(segs) >= m.maxSegments {
+		os.Remove(segs[0])
+		segs = segs[1:]
+	}
+}
+
+// segments returns the segment files, oldest first
+func (m *MetricsStore) segments() ([]string, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, METRICS_SEGMENT_PREFIX) || !strings.HasSuffix(name, METRICS_SEGMENT_EXT) {
+			continue
+		}
+		ret = append(ret, filepath.Join(m.dir, name))
+	}
+	// the names hold a fixed width timestamp, so they sort by age
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Flush sends the buffered points with upload, oldest first, a few
+// segments at a time. A segment is removed once upload accepts it, so
+// points recorded while offline are sent on the next successful flush.
+// A segment that can't be read is skipped, it is retried on the next flush
+// until it ages out.
+func (m *MetricsStore) Flush(upload func([]Sample) error) error {
+	m.mu.Lock()
+	// close the current segment so its points go out too
+	m.current = ""
+	segs, err := m.segments()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for len(segs) > 0 {
+		n := min(len(segs), METRICS_UPLOAD_SEGMENTS)
+		var points []Sample
+		var read []string
+		for _, seg := range segs[:n] {
+			p, err := readSegment(seg)
+			if err != nil {
+				continue
+			}
+			points = append(points, p...)
+			read = append(read, seg)
+		}
+		if len(points) > 0 {
+			if err := upload(points); err != nil {
+				return err
+			}
+		}
+		for _, seg := range read {
+			os.Remove(seg)
+		}
+		segs = segs[n:]
+	}
+	return nil
+}
+
+// readSegment reads the points of a segment, skipping a truncated last line
+func readSegment(path string) ([]Sample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []Sample
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var p Sample
+		if err := json.Unmarshal(sc.Bytes(), &p); err != nil {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret, sc.Err()
+}
+
+// Average returns the mean of the samples taken within window, stamped with
+// the time of the newest one
+func (s *Sampler) Average(window time.Duration) (Sample, bool) {
+	samples := s.Samples(window)
+	if len(samples) == 0 {
+		return Sample{}, false
+	}
+
+	var avg Sample
+	for _, smp := range samples {
+		avg.CPU += smp.CPU
+		avg.Mem += smp.Mem
+		avg.Swap += smp.Swap
+		avg.DiskRead += smp.DiskRead
+		avg.DiskWrite += smp.DiskWrite
+		avg.NetRecv += smp.NetRecv
+		avg.NetSent += smp.NetSent
+		avg.Load1 += smp.Load1
+		avg.Load5 += smp.Load5
+		avg.Load15 += smp.Load15
+	}
+	n := float64(len(samples))
+	avg.CPU /= n
+	avg.Mem /= n
+	avg.Swap /= n
+	avg.DiskRead /= n
+	avg.DiskWrite /= n
+	avg.NetRecv /= n
+	avg.NetSent /= n
+	avg.Load1 /= n
+	avg.Load5 /= n
+	avg.Load15 /= n
+	avg.Time = samples[len(samples)-1].Time
+	return avg, true
+}
+
+// RunMetrics records the sampled metrics at the configured resolution and
+// uploads them in batches until ctx is cancelled
+func (a *Agent) RunMetrics(ctx context.Context) {
+	if a.Sampler == nil {
+		return
+	}
+	a.Sampler.Start(ctx)
+
+	// kept in the state dir, so the points survive a reboot and only the
+	// agent can change them
+	dir, err := a.stateDir(METRICS_DIR)
+	if err != nil {
+		a.Logger.Debugln("Metrics:", err)
+		return
+	}
+	store, err := NewMetricsStore(dir)
+	if err != nil {
+		a.Logger.Debugln("Metrics:", err)
+		return
+	}
+
+	resolution := time.Duration(a.MetricsResolution) * time.Second
+	if resolution <= 0 {
+		resolution = METRICS_DEFAULT_RESOLUTION * time.Second
+	}
+	every := time.Duration(a.MetricsUploadInterval) * time.Second
+	if every <= 0 {
+		every = METRICS_DEFAULT_UPLOAD_SECONDS * time.Second
+	}
+
+	record := time.NewTicker(resolution)
+	defer record.Stop()
+	upload := time.NewTicker(every)
+	defer upload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-record.C:
+			// at resolutions finer than the sampler, repeat the latest sample
+			window := max(resolution, SAMPLE_INTERVAL)
+			p, ok := a.Sampler.Average(window)
+			if !ok {
+				continue
+			}
+			if err := store.Append(p); err != nil {
+				a.Logger.Debugln("Metrics:", err)
+			}
+		case <-upload.C:
+			if err := store.Flush(func(points []Sample) error {
+				return a.uploadMetrics(int(resolution.Seconds()), points)
+			}); err != nil {
+				a.Logger.Debugln("Metrics upload:", err)
+			}
+		}
+	}
+}
+
+// uploadMetrics POSTs a batch of metric points to the server
+func (a *Agent) uploadMetrics(resolution int, points []Sample) error {
+	payload := MetricsBatch{
+		AgentID:    a.AgentID,
+		Resolution: resolution,
+		Points:     points,
+	}
+	r, err := a.RClient.R().SetBody(payload).Post(API_URL_METRICS)
+	if err != nil {
+		return err
+	}
+	if r.IsError() {
+		return fmt.Errorf("metrics response code: %v", r.StatusCode())
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func appendPoints(t *testing.T, m *MetricsStore, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if err := m.Append(Sample{CPU: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMetricsSegments(t *testing.T) {
+	m, err := NewMetricsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPoints(t, m, 0, METRICS_SEGMENT_POINTS*2+5)
+	segs, err := m.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 3 {
+		t.Fatalf("%d segments, want 3", len(segs))
+	}
+	points, err := readSegment(segs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != METRICS_SEGMENT_POINTS || points[0].CPU != 0 {
+		t.Errorf("first segment has %d points starting at %v", len(points), points[0].CPU)
+	}
+
+	// the oldest segments are dropped over the limit
+	m.maxSegments = 2
+	m.current = ""
+	appendPoints(t, m, 1000, 1)
+	if segs, _ := m.segments(); len(segs) != 2 {
+		t.Errorf("%d segments, want 2", len(segs))
+	}
+}
+
+func TestMetricsBackfillAfterFailedUpload(t *testing.T) {
+	m, err := NewMetricsStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPoints(t, m, 0, 10)
+	if err := m.Flush(func([]Sample) error { return errors.New("offline") }); err == nil {
+		t.Fatal("Flush() = nil with the upload failing")
+	}
+	appendPoints(t, m, 10, 10)
+
+	var got []Sample
+	if err := m.Flush(func(p []Sample) error {
+		got = append(got, p...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 20 {
+		t.Fatalf("uploaded %d points, want 20", len(got))
+	}
+	for i, p := range got {
+		if p.CPU != float64(i) {
+			t.Fatalf("point %d is %v, want the points in order", i, p.CPU)
+		}
+	}
+	if segs, _ := m.segments(); len(segs) != 0 {
+		t.Errorf("%d segments left after a successful flush", len(segs))
+	}
+}
+
+func TestMetricsFlushSkipsBadSegment(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMetricsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a line too long to scan makes the segment unreadable
+	bad := filepath.Join(dir, METRICS_SEGMENT_PREFIX+"0000000000000000001"+METRICS_SEGMENT_EXT)
+	if err := os.WriteFile(bad, []byte(strings.Repeat("x", 1<<17)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	appendPoints(t, m, 0, 5)
+
+	for i := 0; i < 2; i++ {
+		var got int
+		if err := m.Flush(func(p []Sample) error {
+			got += len(p)
+			return nil
+		}); err != nil {
+			t.Fatalf("Flush() = %v with a bad segment", err)
+		}
+		if i == 0 && got != 5 {
+			t.Errorf("uploaded %d points, want 5", got)
+		}
+	}
+}
+
+func TestMetricsSettings(t *testing.T) {
+	var c AgentConfig
+	AgentSettings{MetricsResolution: 10, MetricsUploadInterval: 120}.Apply(&c)
+	if c.MetricsResolution != 10 || c.MetricsUploadInterval != 120 {
+		t.Errorf("resolution %d, upload interval %d", c.MetricsResolution, c.MetricsUploadInterval)
+	}
+}
@@ -0,0 +1,311 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	NETCHECK_MAX_BODY = 1 << 20
+	DNS_DEFAULT_PORT  = "53"
+	TLS_DEFAULT_PORT  = 443
+)
+
+func msSince(start time.Time) float64 {
+	return math.Round(float64(time.Since(start).Microseconds())/10) / 100
+}
+
+// latencySeverity grades a network check that succeeded by its latency, it
+// is ok when there are no thresholds as reaching the target is the check
+func latencySeverity(latency float64, data shared.Check) string {
+	if severity := thresholdSeverity(latency, data.WarnThreshold, data.ErrorThreshold, false); severity != "" {
+		return severity
+	}
+	return CHECK_SEVERITY_OK
+}
+
+// TCPCheck connects to ip:port and grades the connect latency in ms
+func (a *Agent) TCPCheck(ctx context.Context, data shared.Check) CheckResult {
+	addr := net.JoinHostPort(data.IP, strconv.Itoa(data.Port))
+
+	dialer := &net.Dialer{Timeout: CheckTimeout(data)}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	latency := msSince(start)
+
+	payload := map[string]interface{}{
+		"latency_ms": latency,
+	}
+
+	severity := CHECK_SEVERITY_ERROR
+	if err != nil {
+		a.Logger.Debugln("TCPCheck", addr, err)
+		payload["error"] = err.Error()
+	} else {
+		conn.Close()
+		severity = latencySeverity(latency, data)
+	}
+
+	return CheckResultFor(severity, payload)
+}
+
+// HTTPCheck requests the check URL, verifying the status code and
+// optionally the body, and grades the response time in ms
+func (a *Agent) HTTPCheck(ctx context.Context, data shared.Check) CheckResult {
+	payload := map[string]interface{}{}
+	fail := func(err error) CheckResult {
+		a.Logger.Debugln("HTTPCheck", data.URL, err)
+		payload["error"] = err.Error()
+		return CheckResultFor(CHECK_SEVERITY_ERROR, payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, data.URL, nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	client := &http.Client{Timeout: CheckTimeout(data)}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, NETCHECK_MAX_BODY))
+	latency := msSince(start)
+	payload["status_code"] = resp.StatusCode
+	payload["latency_ms"] = latency
+	if err != nil {
+		return fail(err)
+	}
+
+	if data.ExpectedStatus != 0 && resp.StatusCode != data.ExpectedStatus {
+		return fail(fmt.Errorf("status code %d, expected %d", resp.StatusCode, data.ExpectedStatus))
+	}
+	if data.ExpectedStatus == 0 && resp.StatusCode >= 400 {
+		return fail(fmt.Errorf("status code %d", resp.StatusCode))
+	}
+
+	if data.BodyRegex != "" {
+		re, err := regexp.Compile(data.BodyRegex)
+		if err != nil {
+			return fail(err)
+		}
+		if !re.Match(body) {
+			return fail(fmt.Errorf("body does not match %q", data.BodyRegex))
+		}
+	}
+
+	severity := latencySeverity(latency, data)
+	return CheckResultFor(severity, payload)
+}
+
+// DNSCheck resolves the check's name and verifies every expected record
+// is returned, grading the lookup time in ms
+func (a *Agent) DNSCheck(ctx context.Context, data shared.Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout(data))
+	defer cancel()
+
+	start := time.Now()
+	records, err := LookupDNS(ctx, data.DNSServer, data.DNSRecordType, data.DNSName)
+	latency := msSince(start)
+
+	payload := map[string]interface{}{
+		"records":    records,
+		"latency_ms": latency,
+	}
+
+	severity := CHECK_SEVERITY_ERROR
+	if err != nil {
+		a.Logger.Debugln("DNSCheck", data.DNSName, err)
+		payload["error"] = err.Error()
+	} else if missing := missingRecords(data.ExpectedRecords, records); len(missing) > 0 {
+		payload["error"] = fmt.Sprintf("missing records: %s", strings.Join(missing, ", "))
+	} else {
+		severity = latencySeverity(latency, data)
+	}
+
+	return CheckResultFor(severity, payload)
+}
+
+// LookupDNS resolves name for the record type, using server instead of
+// the system resolver when set
+func LookupDNS(ctx context.Context, server, recordType, name string) ([]string, error) {
+	resolver := net.DefaultResolver
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, DNS_DEFAULT_PORT)
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	ret := make([]string, 0)
+	switch strings.ToUpper(recordType) {
+	case "", "A", "AAAA":
+		network := "ip"
+		switch strings.ToUpper(recordType) {
+		case "A":
+			network = "ip4"
+		case "AAAA":
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return ret, err
+		}
+		for _, ip := range ips {
+			ret = append(ret, ip.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return ret, err
+		}
+		for _, mx := range mxs {
+			ret = append(ret, mx.Host)
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return ret, err
+		}
+		for _, ns := range nss {
+			ret = append(ret, ns.Host)
+		}
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, txts...)
+	default:
+		return ret, fmt.Errorf("unsupported record type %q", recordType)
+	}
+	return ret, nil
+}
+
+// missingRecords returns the expected records that are not in got,
+// ignoring case and trailing dots
+func missingRecords(expected, got []string) []string {
+	norm := func(s string) string {
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	}
+	have := make([]string, 0, len(got))
+	for _, g := range got {
+		have = append(have, norm(g))
+	}
+
+	ret := make([]string, 0)
+	for _, e := range expected {
+		if !slices.Contains(have, norm(e)) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// TLSCheck connects to ip:port, verifies the certificate chain and grades
+// the number of days until the leaf certificate expires
+func (a *Agent) TLSCheck(ctx context.Context, data shared.Check) CheckResult {
+	port := data.Port
+	if port == 0 {
+		port = TLS_DEFAULT_PORT
+	}
+	serverName := data.DNSName
+	if serverName == "" {
+		serverName = data.IP
+	}
+
+	payload := map[string]interface{}{}
+
+	certs, err := getPeerCertificates(ctx, net.JoinHostPort(data.IP, strconv.Itoa(port)), serverName, CheckTimeout(data))
+	if err != nil {
+		a.Logger.Debugln("TLSCheck", data.IP, err)
+		payload["error"] = err.Error()
+		return CheckResultFor(CHECK_SEVERITY_ERROR, payload)
+	}
+
+	leaf := certs[0]
+	days := math.Floor(time.Until(leaf.NotAfter).Hours() / 24)
+	payload["subject"] = leaf.Subject.String()
+	payload["issuer"] = leaf.Issuer.String()
+	payload["not_after"] = leaf.NotAfter.UTC().Format(time.RFC3339)
+	payload["days_left"] = days
+
+	severity := thresholdSeverity(days, data.WarnThreshold, data.ErrorThreshold, true)
+	if severity == "" {
+		severity = CHECK_SEVERITY_OK
+	}
+	if err := verifyChain(certs, serverName); err != nil {
+		payload["chain_valid"] = false
+		payload["error"] = err.Error()
+		severity = CHECK_SEVERITY_ERROR
+	} else {
+		payload["chain_valid"] = true
+	}
+
+	return CheckResultFor(severity, payload)
+}
+
+// getPeerCertificates returns the certificates presented by addr without
+// verifying them, so expiry can still be reported for a broken chain
+func getPeerCertificates(ctx context.Context, addr, serverName string, timeout time.Duration) ([]*x509.Certificate, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout},
+		Config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates presented by %s", addr)
+	}
+	return certs, nil
+}
+
+// verifyChain verifies the leaf against the system roots using the
+// presented intermediates
+func verifyChain(certs []*x509.Certificate, serverName string) error {
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	return err
+}
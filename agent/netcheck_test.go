@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testAgent() *Agent {
+	return &Agent{AgentConfig: &AgentConfig{}, Logger: testLogger()}
+}
+
+// listenerAddr returns the ip and port of a local listener
+func listenerAddr(t *testing.T, addr net.Addr) (string, int) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port := listenerAddr(t, l.Addr())
+	l.Close()
+	return port
+}
+
+// silentListener accepts connections and never answers them
+func silentListener(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	return l
+}
+
+func TestTCPCheck(t *testing.T) {
+	a := testAgent()
+	l := silentListener(t)
+	ip, port := listenerAddr(t, l.Addr())
+
+	res := a.TCPCheck(context.Background(), shared.Check{IP: ip, Port: port})
+	if res.Severity != CHECK_SEVERITY_OK {
+		t.Errorf("TCPCheck() of a listener = %q %v, want %q", res.Severity, res.Fields, CHECK_SEVERITY_OK)
+	}
+
+	res = a.TCPCheck(context.Background(), shared.Check{IP: "127.0.0.1", Port: closedPort(t)})
+	if res.Severity != CHECK_SEVERITY_ERROR || res.Fields["error"] == nil {
+		t.Errorf("TCPCheck() of a closed port = %q %v, want an error", res.Severity, res.Fields)
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("status: healthy"))
+	})
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/created", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a := testAgent()
+	for _, tt := range []struct {
+		name  string
+		check shared.Check
+		want  string
+	}{
+		{"ok", shared.Check{URL: srv.URL + "/ok"}, CHECK_SEVERITY_OK},
+		{"body matches", shared.Check{URL: srv.URL + "/ok", BodyRegex: `status: (healthy|degraded)`}, CHECK_SEVERITY_OK},
+		{"body mismatch", shared.Check{URL: srv.URL + "/ok", BodyRegex: `status: degraded`}, CHECK_SEVERITY_ERROR},
+		{"bad body regex", shared.Check{URL: srv.URL + "/ok", BodyRegex: `(`}, CHECK_SEVERITY_ERROR},
+		{"error status", shared.Check{URL: srv.URL + "/down"}, CHECK_SEVERITY_ERROR},
+		{"unexpected status", shared.Check{URL: srv.URL + "/created", ExpectedStatus: http.StatusOK}, CHECK_SEVERITY_ERROR},
+		{"expected status", shared.Check{URL: srv.URL + "/down", ExpectedStatus: http.StatusServiceUnavailable}, CHECK_SEVERITY_OK},
+		{"timeout", shared.Check{URL: srv.URL + "/slow", Timeout: 1}, CHECK_SEVERITY_ERROR},
+		{"slow over threshold", shared.Check{URL: srv.URL + "/ok", WarnThreshold: 0.000001}, CHECK_SEVERITY_WARNING},
+	} {
+		res := a.HTTPCheck(context.Background(), tt.check)
+		if res.Severity != tt.want {
+			t.Errorf("%s: HTTPCheck() = %q %v, want %q", tt.name, res.Severity, res.Fields, tt.want)
+		}
+		if tt.want == CHECK_SEVERITY_ERROR && res.Fields["error"] == nil {
+			t.Errorf("%s: HTTPCheck() fields = %v, want an error", tt.name, res.Fields)
+		}
+	}
+}
+
+func TestTLSCheck(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	ip, port := listenerAddr(t, srv.Listener.Addr())
+
+	a := testAgent()
+
+	// httptest's certificate is not signed by a trusted root, its expiry is
+	// still reported
+	res := a.TLSCheck(context.Background(), shared.Check{IP: ip, Port: port, DNSName: "example.com"})
+	if res.Severity != CHECK_SEVERITY_ERROR || res.Fields["chain_valid"] != false {
+		t.Errorf("TLSCheck() of an untrusted certificate = %q %v, want an invalid chain", res.Severity, res.Fields)
+	}
+	if days, ok := res.Fields["days_left"].(float64); !ok || days <= 0 {
+		t.Errorf("TLSCheck() days_left = %v, want the days until expiry", res.Fields["days_left"])
+	}
+
+	// a server that never completes the handshake
+	l := silentListener(t)
+	ip, port = listenerAddr(t, l.Addr())
+	start := time.Now()
+	res = a.TLSCheck(context.Background(), shared.Check{IP: ip, Port: port, Timeout: 1})
+	if res.Severity != CHECK_SEVERITY_ERROR || res.Fields["error"] == nil {
+		t.Errorf("TLSCheck() of a silent server = %q %v, want an error", res.Severity, res.Fields)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("TLSCheck() of a silent server took %s, want the 1s timeout", d)
+	}
+
+	res = a.TLSCheck(context.Background(), shared.Check{IP: "127.0.0.1", Port: closedPort(t)})
+	if res.Severity != CHECK_SEVERITY_ERROR {
+		t.Errorf("TLSCheck() of a closed port = %q, want %q", res.Severity, CHECK_SEVERITY_ERROR)
+	}
+}
+
+// serveDNS answers A queries for name with ip over UDP on a local port,
+// other queries get NXDOMAIN. With silent set it never answers.
+func serveDNS(t *testing.T, name string, ip [4]byte, silent bool) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if silent {
+				continue
+			}
+			var p dnsmessage.Parser
+			hdr, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			resp := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true})
+			resp.EnableCompression()
+			found := q.Name.String() == name && q.Type == dnsmessage.TypeA
+			if !found && q.Name.String() != name {
+				resp = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeNameError})
+			}
+			resp.StartQuestions()
+			resp.Question(q)
+			if found {
+				resp.StartAnswers()
+				resp.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: ip})
+			}
+			msg, err := resp.Finish()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(msg, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSCheck(t *testing.T) {
+	server := serveDNS(t, "host.example.test.", [4]byte{192, 0, 2, 10}, false)
+	a := testAgent()
+
+	for _, tt := range []struct {
+		name  string
+		check shared.Check
+		want  string
+	}{
+		{"resolves", shared.Check{DNSServer: server, DNSName: "host.example.test", DNSRecordType: "A", ExpectedRecords: []string{"192.0.2.10"}}, CHECK_SEVERITY_OK},
+		{"missing record", shared.Check{DNSServer: server, DNSName: "host.example.test", DNSRecordType: "A", ExpectedRecords: []string{"192.0.2.11"}}, CHECK_SEVERITY_ERROR},
+		{"nxdomain", shared.Check{DNSServer: server, DNSName: "nope.example.test", DNSRecordType: "A"}, CHECK_SEVERITY_ERROR},
+		{"unsupported type", shared.Check{DNSServer: server, DNSName: "host.example.test", DNSRecordType: "SRV"}, CHECK_SEVERITY_ERROR},
+	} {
+		res := a.DNSCheck(context.Background(), tt.check)
+		if res.Severity != tt.want {
+			t.Errorf("%s: DNSCheck() = %q %v, want %q", tt.name, res.Severity, res.Fields, tt.want)
+		}
+	}
+
+	silent := serveDNS(t, "host.example.test.", [4]byte{192, 0, 2, 10}, true)
+	start := time.Now()
+	res := a.DNSCheck(context.Background(), shared.Check{DNSServer: silent, DNSName: "host.example.test", DNSRecordType: "A", Timeout: 1})
+	if res.Severity != CHECK_SEVERITY_ERROR || res.Fields["error"] == nil {
+		t.Errorf("DNSCheck() of a silent server = %q %v, want an error", res.Severity, res.Fields)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("DNSCheck() of a silent server took %s, want the 1s timeout", d)
+	}
+}
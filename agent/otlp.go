@@ -0,0 +1,406 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	OTLP_PATH_METRICS           = "/v1/metrics"
+	OTLP_PATH_LOGS              = "/v1/logs"
+	OTLP_SCOPE_NAME             = "github.com/jetrmm/rmm-agent"
+	OTLP_SERVICE_NAME           = "rmm-agent"
+	OTLP_EXPORT_INTERVAL        = 30 * time.Second
+	OTLP_TIMEOUT                = 10 * time.Second
+	OTLP_LOG_QUEUE              = 2048
+	OTLP_LOG_BATCH              = 512
+	OTLP_MAX_RETRIES            = 5
+	OTLP_BACKOFF_MIN            = 1 * time.Second
+	OTLP_BACKOFF_MAX            = 30 * time.Second
+	OTLP_TEMPORALITY_CUMULATIVE = 2
+)
+
+// OTLP/HTTP JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Unit        string       `json:"unit,omitempty"`
+	Gauge       *otlpGauge   `json:"gauge,omitempty"`
+	Sum         *otlpSum     `json:"sum,omitempty"`
+	Summary     *otlpSummary `json:"summary,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpLabels converts name/value label pairs to attributes
+func otlpLabels(labels []string) []otlpKeyValue {
+	var ret []otlpKeyValue
+	for i := 0; i+1 < len(labels); i += 2 {
+		ret = append(ret, otlpString(labels[i], labels[i+1]))
+	}
+	return ret
+}
+
+// otlpSeverity maps logrus levels onto OTLP severity numbers
+var otlpSeverity = map[logrus.Level]int{
+	logrus.TraceLevel: 1,
+	logrus.DebugLevel: 5,
+	logrus.InfoLevel:  9,
+	logrus.WarnLevel:  13,
+	logrus.ErrorLevel: 17,
+	logrus.FatalLevel: 21,
+	logrus.PanicLevel: 24,
+}
+
+// OTLPExporter pushes the agent's metrics and logs to an OTLP/HTTP endpoint.
+// It doubles as a logrus hook, queueing the entries it is fired with.
+type OTLPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	logger   *logrus.Logger
+	resource otlpResource
+	version  string
+	start    time.Time
+	logs     chan otlpLogRecord
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// NewOTLPExporter returns an exporter for the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318, identifying the agent with its resource attributes
+func NewOTLPExporter(endpoint string, headers map[string]string, a *Agent) *OTLPExporter {
+	attrs := []otlpKeyValue{
+		otlpString("service.name", OTLP_SERVICE_NAME),
+		otlpString("service.version", a.Version),
+		otlpString("service.instance.id", a.AgentID),
+		otlpString("host.name", a.GetHostname()),
+		otlpString("rmm.agent_id", a.AgentID),
+	}
+	if a.ClientName != "" {
+		attrs = append(attrs, otlpString("rmm.client", a.ClientName))
+	}
+	if a.SiteName != "" {
+		attrs = append(attrs, otlpString("rmm.site", a.SiteName))
+	}
+
+	return &OTLPExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		headers:  headers,
+		client:   &http.Client{Timeout: OTLP_TIMEOUT},
+		logger:   a.Logger,
+		resource: otlpResource{Attributes: attrs},
+		version:  a.Version,
+		start:    time.Now(),
+		logs:     make(chan otlpLogRecord, OTLP_LOG_QUEUE),
+	}
+}
+
+// Levels exports info and above, so the exporter's own debug logging about
+// failed exports doesn't feed back into the queue
+func (e *OTLPExporter) Levels() []logrus.Level {
+	return logrus.AllLevels[:logrus.InfoLevel+1]
+}
+
+// Fire queues a log entry, dropping it if the queue is full
+func (e *OTLPExporter) Fire(entry *logrus.Entry) error {
+	msg := entry.Message
+	rec := otlpLogRecord{
+		TimeUnixNano:   otlpTime(entry.Time),
+		SeverityNumber: otlpSeverity[entry.Level],
+		SeverityText:   strings.ToUpper(entry.Level.String()),
+		Body:           otlpAnyValue{StringValue: &msg},
+	}
+	for _, k := range sortedKeys(entry.Data) {
+		rec.Attributes = append(rec.Attributes, otlpString(k, fmt.Sprint(entry.Data[k])))
+	}
+
+	select {
+	case e.logs <- rec:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+	return nil
+}
+
+// Run exports metrics from collect every interval and logs in batches until
+// ctx is cancelled
+func (e *OTLPExporter) Run(ctx context.Context, interval time.Duration, collect func() []metricFamily) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]otlpLogRecord, 0, OTLP_LOG_BATCH)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.ExportLogs(ctx, batch); err != nil {
+			e.logger.Debugln("OTLP logs:", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rec := <-e.logs:
+			batch = append(batch, rec)
+			if len(batch) >= OTLP_LOG_BATCH {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if err := e.ExportMetrics(ctx, collect()); err != nil {
+				e.logger.Debugln("OTLP metrics:", err)
+			}
+			e.mu.Lock()
+			if e.dropped > 0 {
+				e.logger.Debugln("OTLP dropped", e.dropped, "log records")
+				e.dropped = 0
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+// ExportMetrics sends the metric families as one request
+func (e *OTLPExporter) ExportMetrics(ctx context.Context, families []metricFamily) error {
+	now := otlpTime(time.Now())
+	start := otlpTime(e.start)
+
+	metrics := make([]otlpMetric, 0, len(families))
+	for _, f := range families {
+		m := otlpMetric{Name: f.Name, Description: f.Help, Unit: f.Unit}
+		switch f.Type {
+		case METRIC_TYPE_SUMMARY:
+			m.Summary = &otlpSummary{}
+			for _, smp := range f.Samples {
+				m.Summary.DataPoints = append(m.Summary.DataPoints, otlpSummaryDataPoint{
+					Attributes:        otlpLabels(smp.Labels),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      now,
+					Count:             strconv.FormatUint(smp.Count, 10),
+					Sum:               smp.Value,
+				})
+			}
+		case METRIC_TYPE_COUNTER:
+			m.Sum = &otlpSum{AggregationTemporality: OTLP_TEMPORALITY_CUMULATIVE, IsMonotonic: true}
+			for _, smp := range f.Samples {
+				m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{
+					Attributes:        otlpLabels(smp.Labels),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      now,
+					AsDouble:          smp.Value,
+				})
+			}
+		default:
+			m.Gauge = &otlpGauge{}
+			for _, smp := range f.Samples {
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{
+					Attributes:   otlpLabels(smp.Labels),
+					TimeUnixNano: now,
+					AsDouble:     smp.Value,
+				})
+			}
+		}
+		metrics = append(metrics, m)
+	}
+
+	req := otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: e.resource,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: OTLP_SCOPE_NAME, Version: e.version},
+			Metrics: metrics,
+		}},
+	}}}
+	return e.post(ctx, OTLP_PATH_METRICS, req)
+}
+
+// ExportLogs sends a batch of log records as one request
+func (e *OTLPExporter) ExportLogs(ctx context.Context, records []otlpLogRecord) error {
+	req := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: e.resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: OTLP_SCOPE_NAME, Version: e.version},
+			LogRecords: records,
+		}},
+	}}}
+	return e.post(ctx, OTLP_PATH_LOGS, req)
+}
+
+// post sends an export request, retrying with exponential backoff on
+// network errors and the status codes OTLP marks as retryable
+func (e *OTLPExporter) post(ctx context.Context, path string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := OTLP_BACKOFF_MIN
+	for attempt := 0; ; attempt++ {
+		err = e.send(ctx, path, body)
+		if err == nil {
+			return nil
+		}
+		if _, retry := err.(otlpRetryable); !retry || attempt >= OTLP_MAX_RETRIES {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, OTLP_BACKOFF_MAX)
+	}
+}
+
+// otlpRetryable marks an export error worth retrying
+type otlpRetryable struct{ error }
+
+func (e *OTLPExporter) send(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return otlpRetryable{err}
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return otlpRetryable{fmt.Errorf("otlp response code: %v", resp.StatusCode)}
+	default:
+		return fmt.Errorf("otlp response code: %v", resp.StatusCode)
+	}
+}
+
+// RunOTLP exports the agent's metrics and logs to the configured OTLP
+// endpoint until ctx is cancelled. It does nothing when no endpoint is
+// configured.
+func (a *Agent) RunOTLP(ctx context.Context) {
+	if a.OTLPEndpoint == "" {
+		return
+	}
+	if a.Sampler != nil {
+		a.Sampler.Start(ctx)
+	}
+
+	exp := NewOTLPExporter(a.OTLPEndpoint, a.OTLPHeaders, a)
+	a.Logger.AddHook(exp)
+	a.Logger.Infoln("Exporting metrics and logs to", a.OTLPEndpoint)
+	exp.Run(ctx, OTLP_EXPORT_INTERVAL, a.collectMetrics)
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOTLPExportFromSettings(t *testing.T) {
+	var got otlpMetricsRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != OTLP_PATH_METRICS {
+			t.Errorf("export to %s, want %s", r.URL.Path, OTLP_PATH_METRICS)
+		}
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "settings.json")
+	settings := `{"otlp_endpoint": "` + srv.URL + `/", "otlp_headers": {"Authorization": "Bearer t0k"}, "client_name": "Acme", "site_name": "HQ"}`
+	if err := os.WriteFile(path, []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{AgentConfig: &AgentConfig{AgentID: "agent1", Version: "1.2.3"}, Logger: testLogger()}
+	s.Apply(a.AgentConfig)
+
+	exp := NewOTLPExporter(a.OTLPEndpoint, a.OTLPHeaders, a)
+	if err := exp.ExportMetrics(context.Background(), a.collectMetrics()); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "Bearer t0k" {
+		t.Errorf("Authorization = %q, want the configured header", auth)
+	}
+	if len(got.ResourceMetrics) != 1 {
+		t.Fatalf("got %d resource metrics, want 1", len(got.ResourceMetrics))
+	}
+	attrs := map[string]string{}
+	for _, kv := range got.ResourceMetrics[0].Resource.Attributes {
+		if kv.Value.StringValue != nil {
+			attrs[kv.Key] = *kv.Value.StringValue
+		}
+	}
+	for k, want := range map[string]string{"service.version": "1.2.3", "rmm.agent_id": "agent1", "rmm.client": "Acme", "rmm.site": "HQ"} {
+		if attrs[k] != want {
+			t.Errorf("resource attribute %s = %q, want %q", k, attrs[k], want)
+		}
+	}
+	metrics := got.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) == 0 || metrics[0].Name != "rmm_agent_info" || metrics[0].Gauge == nil {
+		t.Errorf("metrics = %+v, want rmm_agent_info first", metrics)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	got := ParseHeaders([]string{"Authorization=Bearer a=b, X-Org = 1", "bad", "=x"})
+	want := map[string]string{"Authorization": "Bearer a=b", "X-Org": "1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseHeaders() = %v, want %v", got, want)
+	}
+	if h := FormatHeaders(want); !reflect.DeepEqual(ParseHeaders(h), want) {
+		t.Errorf("FormatHeaders() = %v does not round trip", h)
+	}
+}
@@ -0,0 +1,527 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	OUTBOX_DIR         = "outbox"
+	OUTBOX_EXT         = ".json"
+	OUTBOX_MAX_ITEMS   = 1000
+	OUTBOX_MAX_BYTES   = 50 << 20
+	OUTBOX_TTL         = 7 * 24 * time.Hour
+	OUTBOX_BACKOFF_MIN = 5 * time.Second
+	OUTBOX_BACKOFF_MAX = 10 * time.Minute
+
+	// Outbox item kinds
+	OUTBOX_KIND_HTTP = "http"
+	OUTBOX_KIND_NATS = "nats"
+)
+
+// ErrQueued is returned when an item could not be delivered right away and
+// was left in the outbox for a later attempt
+var ErrQueued = errors.New("queued for delivery")
+
+// rejectedError is returned for an item the server refused, it is dropped
+// as resending it would not help
+type rejectedError struct{ error }
+
+// OutboxItem is a result waiting to be delivered to the server, either
+// as an HTTP request or a NATS publish
+type OutboxItem struct {
+	Seq     uint64          `json:"seq"`
+	Key     string          `json:"key"` // a newer item with the same key replaces an undelivered one
+	Kind    string          `json:"kind"`
+	Method  string          `json:"method,omitempty"` // http
+	URL     string          `json:"url,omitempty"`    // http
+	Subject string          `json:"subject,omitempty"`
+	Reply   string          `json:"reply,omitempty"` // nats
+	Body    json.RawMessage `json:"body"`            // nats: the encoded message as base64
+	Created time.Time       `json:"created"`
+
+	size int
+	// called with the response once the item is delivered, not persisted
+	onDelivered func(resp []byte)
+}
+
+// Outbox is a durable queue of results. Items are written to disk before
+// they are sent and are removed once the server has them, so nothing is
+// lost while the server or network is down. Each transport has its own
+// ordered queue, so NATS being down doesn't hold up the HTTP results.
+type Outbox struct {
+	dir    string // empty keeps the items in memory only
+	logger *logrus.Logger
+	client *resty.Client
+	kick   chan struct{}
+	once   sync.Once
+
+	// caps on all the queues together, and the age items are dropped at
+	maxItems int
+	maxBytes int
+	ttl      time.Duration
+
+	mu     sync.Mutex
+	nc     *nats.Conn
+	queues map[string]*outboxQueue // by item kind
+	count  int
+	bytes  int
+	seq    uint64
+}
+
+// outboxQueue holds the items of one transport in delivery order
+type outboxQueue struct {
+	items   []*OutboxItem
+	backoff time.Duration
+	retryAt time.Time
+	sending bool // the head is being delivered
+}
+
+// NewOutbox opens the outbox in dir, loading the items left from a
+// previous run. HTTP items are sent with client.
+func NewOutbox(dir string, logger *logrus.Logger, client *resty.Client) (*Outbox, error) {
+	o := &Outbox{
+		dir:      dir,
+		logger:   logger,
+		client:   client,
+		kick:     make(chan struct{}, 1),
+		maxItems: OUTBOX_MAX_ITEMS,
+		maxBytes: OUTBOX_MAX_BYTES,
+		ttl:      OUTBOX_TTL,
+		queues:   make(map[string]*outboxQueue),
+	}
+	if dir == "" {
+		return o, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// OpenOutbox sets up the agent's outbox in its state dir, falling back to
+// an in-memory one if the directory can't be used
+func (a *Agent) OpenOutbox() {
+	dir, err := a.stateDir(OUTBOX_DIR)
+	var ob *Outbox
+	if err == nil {
+		ob, err = NewOutbox(dir, a.Logger, a.RClient)
+	}
+	if err != nil {
+		a.Logger.Errorln("Outbox:", err)
+		ob, _ = NewOutbox("", a.Logger, a.RClient)
+	}
+	a.Outbox = ob
+}
+
+func (o *Outbox) load() error {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), OUTBOX_EXT) {
+			continue
+		}
+		path := filepath.Join(o.dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		item := &OutboxItem{}
+		if err := json.Unmarshal(b, item); err != nil {
+			// a partial write from a crash
+			os.Remove(path)
+			continue
+		}
+		if err := item.check(); err != nil {
+			o.logger.Debugln("Outbox: dropping", e.Name(), err)
+			os.Remove(path)
+			continue
+		}
+		item.size = len(b)
+		q := o.queue(item.Kind)
+		q.items = append(q.items, item)
+		o.count++
+		o.bytes += item.size
+		o.seq = max(o.seq, item.Seq)
+	}
+	for _, q := range o.queues {
+		sort.Slice(q.items, func(i, j int) bool { return q.items[i].Seq < q.items[j].Seq })
+	}
+	return nil
+}
+
+// queue returns the queue of kind, creating it. Called with o.mu held.
+func (o *Outbox) queue(kind string) *outboxQueue {
+	q, ok := o.queues[kind]
+	if !ok {
+		q = &outboxQueue{}
+		o.queues[kind] = q
+	}
+	return q
+}
+
+// kinds returns the kinds of the queues in a stable order. Called with
+// o.mu held.
+func (o *Outbox) kinds() []string {
+	ret := make([]string, 0, len(o.queues))
+	for k := range o.queues {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (o *Outbox) path(item *OutboxItem) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", item.Seq, OUTBOX_EXT))
+}
+
+// SetConn sets the NATS connection NATS items are published on
+func (o *Outbox) SetConn(nc *nats.Conn) {
+	o.mu.Lock()
+	o.nc = nc
+	o.mu.Unlock()
+	o.Kick()
+}
+
+// Kick asks the delivery loop to retry now, e.g. after a reconnect
+func (o *Outbox) Kick() {
+	o.mu.Lock()
+	for _, q := range o.queues {
+		q.backoff = 0
+		q.retryAt = time.Time{}
+	}
+	o.mu.Unlock()
+	o.wake()
+}
+
+// wake asks the delivery loop to look at the queues, without cutting short
+// a backoff
+func (o *Outbox) wake() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of undelivered items
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.count
+}
+
+// HTTP queues an HTTP request, see Send
+func (o *Outbox) HTTP(key, method, url string, body any, onDelivered func(resp []byte)) ([]byte, error) {
+	return o.Send(&OutboxItem{Key: key, Kind: OUTBOX_KIND_HTTP, Method: method, URL: url, onDelivered: onDelivered}, body)
+}
+
+// NATS queues a NATS publish, see Send. data is already encoded, msgpack
+// isn't valid UTF-8 so it is kept as base64.
+func (o *Outbox) NATS(key, subject, reply string, data []byte) error {
+	_, err := o.Send(&OutboxItem{Key: key, Kind: OUTBOX_KIND_NATS, Subject: subject, Reply: reply}, data)
+	return err
+}
+
+// check rejects an HTTP item that isn't for the API server, items only ever
+// go to a path relative to the client's base URL
+func (item *OutboxItem) check() error {
+	if item.Kind != OUTBOX_KIND_HTTP {
+		return nil
+	}
+	u, err := url.Parse(item.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "" || u.Host != "" || u.User != nil || !strings.HasPrefix(item.URL, "/") || strings.HasPrefix(item.URL, "//") {
+		return fmt.Errorf("outbox URL %q is not relative to the API server", item.URL)
+	}
+	return nil
+}
+
+// natsData returns the message a NATS item publishes
+func (item *OutboxItem) natsData() ([]byte, error) {
+	var data []byte
+	if err := json.Unmarshal(item.Body, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Send writes item to the outbox and, unless older items of its transport
+// are still waiting, delivers it right away and returns the response.
+// Otherwise it returns ErrQueued and the item is delivered in order by Run.
+func (o *Outbox) Send(item *OutboxItem, body any) ([]byte, error) {
+	if err := item.check(); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	item.Body = raw
+	item.Created = time.Now()
+
+	o.mu.Lock()
+	q := o.queue(item.Kind)
+	if err := o.add(q, item); err != nil {
+		o.mu.Unlock()
+		return nil, err
+	}
+	first := len(q.items) == 1 && !q.sending
+	if first {
+		q.sending = true
+	}
+	o.mu.Unlock()
+
+	if !first {
+		o.wake()
+		return nil, ErrQueued
+	}
+
+	resp, err := o.deliverHead(q)
+	if err != nil {
+		o.logger.Debugln("Outbox:", err)
+		if _, ok := err.(rejectedError); ok {
+			return resp, err
+		}
+		return nil, ErrQueued
+	}
+	return resp, nil
+}
+
+// add persists item in q, dropping an undelivered item with the same key
+// and the oldest items over the size caps. Called with o.mu held.
+func (o *Outbox) add(q *outboxQueue, item *OutboxItem) error {
+	if item.Key != "" {
+		for i, old := range q.items {
+			// the head may be in flight, leave it be
+			if old.Key == item.Key && !(i == 0 && q.sending) {
+				o.remove(q, i)
+				break
+			}
+		}
+	}
+
+	o.seq++
+	item.Seq = o.seq
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	item.size = len(b)
+	if o.dir != "" {
+		tmp := o.path(item) + ".tmp"
+		if err := os.WriteFile(tmp, b, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, o.path(item)); err != nil {
+			return err
+		}
+	}
+	q.items = append(q.items, item)
+	o.count++
+	o.bytes += item.size
+
+	for o.count > o.maxItems || o.bytes > o.maxBytes {
+		if !o.dropOldest(item) {
+			break
+		}
+	}
+	return nil
+}
+
+// dropOldest drops the oldest item of any queue other than keep and the
+// heads in flight, returning false if there is none. Called with o.mu held.
+func (o *Outbox) dropOldest(keep *OutboxItem) bool {
+	var oldest *outboxQueue
+	var at int
+	for _, q := range o.queues {
+		i := 0
+		if q.sending {
+			i = 1
+		}
+		if i >= len(q.items) || q.items[i] == keep {
+			continue
+		}
+		if oldest == nil || q.items[i].Seq < oldest.items[at].Seq {
+			oldest, at = q, i
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	o.logger.Debugln("Outbox full, dropping", oldest.items[at].Key)
+	o.remove(oldest, at)
+	return true
+}
+
+// remove drops the i-th item of q. Called with o.mu held.
+func (o *Outbox) remove(q *outboxQueue, i int) {
+	item := q.items[i]
+	if o.dir != "" {
+		os.Remove(o.path(item))
+	}
+	o.count--
+	o.bytes -= item.size
+	q.items = append(q.items[:i], q.items[i+1:]...)
+}
+
+// deliverHead sends the oldest item of q, removing it on success. The
+// caller must have set q.sending.
+func (o *Outbox) deliverHead(q *outboxQueue) ([]byte, error) {
+	o.mu.Lock()
+	item := q.items[0]
+	nc := o.nc
+	o.mu.Unlock()
+
+	resp, err := o.deliver(item, nc)
+
+	o.mu.Lock()
+	q.sending = false
+	if _, ok := err.(rejectedError); ok {
+		o.remove(q, 0)
+		o.mu.Unlock()
+		return resp, err
+	}
+	if err != nil {
+		if q.backoff == 0 {
+			q.backoff = OUTBOX_BACKOFF_MIN
+		} else {
+			q.backoff = min(q.backoff*2, OUTBOX_BACKOFF_MAX)
+		}
+		q.retryAt = time.Now().Add(q.backoff)
+		o.mu.Unlock()
+		return nil, err
+	}
+	q.backoff = 0
+	q.retryAt = time.Time{}
+	o.remove(q, 0)
+	o.mu.Unlock()
+
+	if item.onDelivered != nil {
+		item.onDelivered(resp)
+	}
+	return resp, nil
+}
+
+func (o *Outbox) deliver(item *OutboxItem, nc *nats.Conn) ([]byte, error) {
+	switch item.Kind {
+	case OUTBOX_KIND_HTTP:
+		r, err := o.client.R().
+			SetHeader("Content-Type", "application/json").
+			SetBody([]byte(item.Body)).
+			Execute(item.Method, item.URL)
+		if err != nil {
+			return nil, err
+		}
+		if r.StatusCode() >= http.StatusInternalServerError || r.StatusCode() == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%s %s response code: %v", item.Method, item.URL, r.StatusCode())
+		}
+		if r.IsError() {
+			return r.Body(), rejectedError{fmt.Errorf("%s %s rejected, response code: %v", item.Method, item.URL, r.StatusCode())}
+		}
+		return r.Body(), nil
+	case OUTBOX_KIND_NATS:
+		if nc == nil || !nc.IsConnected() {
+			return nil, nats.ErrConnectionClosed
+		}
+		data, err := item.natsData()
+		if err != nil {
+			// left by an older agent, resending it would never work
+			return nil, rejectedError{err}
+		}
+		return nil, nc.PublishRequest(item.Subject, item.Reply, data)
+	default:
+		o.logger.Debugln("Outbox: dropping unknown item kind", item.Kind)
+		return nil, nil
+	}
+}
+
+// expire drops items older than the TTL. Called with o.mu held.
+func (o *Outbox) expire() {
+	cutoff := time.Now().Add(-o.ttl)
+	for _, q := range o.queues {
+		for i := 0; i < len(q.items); {
+			if q.items[i].Created.Before(cutoff) && !(i == 0 && q.sending) {
+				o.logger.Debugln("Outbox: expired", q.items[i].Key)
+				o.remove(q, i)
+				continue
+			}
+			i++
+		}
+	}
+}
+
+// Start runs the delivery loop in the background, calling it again is a
+// no-op
+func (o *Outbox) Start(ctx context.Context) {
+	o.once.Do(func() {
+		go o.Run(ctx)
+	})
+}
+
+// Run delivers the queued items in order, backing off exponentially while
+// the server can't be reached, until ctx is cancelled
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(OUTBOX_BACKOFF_MIN)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.kick:
+		}
+
+		o.mu.Lock()
+		o.expire()
+		kinds := o.kinds()
+		o.mu.Unlock()
+		for _, kind := range kinds {
+			o.flush(kind)
+		}
+	}
+}
+
+// flush delivers the items of the kind's queue in order, until one fails
+// or the queue is backing off
+func (o *Outbox) flush(kind string) {
+	for {
+		o.mu.Lock()
+		q := o.queue(kind)
+		ready := len(q.items) > 0 && !q.sending && !time.Now().Before(q.retryAt)
+		if ready {
+			q.sending = true
+		}
+		o.mu.Unlock()
+		if !ready {
+			return
+		}
+		if _, err := o.deliverHead(q); err != nil {
+			o.logger.Debugln("Outbox:", err)
+			if _, ok := err.(rejectedError); !ok {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l
+}
+
+func TestOutboxNATSRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	ob, err := NewOutbox(dir, testLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// msgpack for {"id": 1, ...} followed by a bin8 marker, not valid UTF-8
+	data := []byte{0x82, 0xa2, 0x69, 0x64, 0x01, 0xc4, 0xff, 0x00}
+	// there's no NATS connection, so the item stays queued
+	if err := ob.NATS("key", "subject", "reply", data); err != ErrQueued {
+		t.Fatalf("NATS() = %v, want ErrQueued", err)
+	}
+
+	reloaded, err := NewOutbox(dir, testLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 1 {
+		t.Fatalf("reloaded %d items, want 1", reloaded.Len())
+	}
+	got, err := reloaded.queues[OUTBOX_KIND_NATS].items[0].natsData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("natsData() = % x, want % x", got, data)
+	}
+}
+
+func TestOutboxRejectsForeignURLs(t *testing.T) {
+	ob, err := NewOutbox("", testLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"https://evil.example/steal", "//evil.example/steal", "api/v3/checkin/", "http:/api"} {
+		if _, err := ob.HTTP("key", "POST", url, nil, nil); err == nil || err == ErrQueued {
+			t.Errorf("HTTP(%q) = %v, want an error", url, err)
+		}
+	}
+	if ob.Len() != 0 {
+		t.Errorf("%d items queued, want none", ob.Len())
+	}
+}
+
+func TestOutboxDropsPlantedItems(t *testing.T) {
+	dir := t.TempDir()
+	planted := `{"seq":1,"kind":"http","method":"POST","url":"https://evil.example/steal","body":null}`
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001"+OUTBOX_EXT), []byte(planted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ob, err := NewOutbox(dir, testLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ob.Len() != 0 {
+		t.Errorf("loaded %d items, want the planted one dropped", ob.Len())
+	}
+}
+
+func TestOutboxTransportsAreIndependent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	ob, err := NewOutbox("", testLogger(), resty.New().SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NATS is down, its item waits
+	if err := ob.NATS("nats", "subject", "reply", []byte{1}); err != ErrQueued {
+		t.Fatalf("NATS() = %v, want ErrQueued", err)
+	}
+	resp, err := ob.HTTP("http", resty.MethodPost, "/api/v3/checkin/", nil, nil)
+	if err != nil || string(resp) != "ok" {
+		t.Errorf("HTTP() = %q, %v behind a queued NATS item, want it delivered", resp, err)
+	}
+	if ob.Len() != 1 {
+		t.Errorf("%d items left, want the NATS one", ob.Len())
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ob, err := NewOutbox("", testLogger(), resty.New().SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ob.HTTP("a", resty.MethodPost, "/api/v3/checkin/", nil, nil); err != ErrQueued {
+		t.Fatalf("HTTP() = %v, want ErrQueued", err)
+	}
+	q := ob.queues[OUTBOX_KIND_HTTP]
+	if q.backoff != OUTBOX_BACKOFF_MIN || !q.retryAt.After(time.Now()) {
+		t.Fatalf("backoff %s, retry at %s", q.backoff, q.retryAt)
+	}
+
+	// nothing is retried while backing off, new items included
+	if _, err := ob.HTTP("b", resty.MethodPost, "/api/v3/checkin/", nil, nil); err != ErrQueued {
+		t.Fatalf("HTTP() = %v, want ErrQueued", err)
+	}
+	ob.flush(OUTBOX_KIND_HTTP)
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("%d requests while backing off, want 1", n)
+	}
+
+	want := OUTBOX_BACKOFF_MIN
+	for i := 0; i < 10; i++ {
+		q.retryAt = time.Time{}
+		ob.flush(OUTBOX_KIND_HTTP)
+		want = min(want*2, OUTBOX_BACKOFF_MAX)
+		if q.backoff != want {
+			t.Fatalf("backoff %s after %d failures, want %s", q.backoff, i+2, want)
+		}
+	}
+	if ob.Len() != 2 {
+		t.Errorf("%d items, want both kept", ob.Len())
+	}
+
+	ob.Kick()
+	if q.backoff != 0 || !q.retryAt.IsZero() {
+		t.Errorf("Kick() left backoff %s", q.backoff)
+	}
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	ob, err := NewOutbox(t.TempDir(), testLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.NATS("old", "subject", "reply", []byte{1})
+	ob.NATS("new", "subject", "reply", []byte{2})
+	ob.queues[OUTBOX_KIND_NATS].items[0].Created = time.Now().Add(-OUTBOX_TTL - time.Minute)
+
+	ob.expire()
+	q := ob.queues[OUTBOX_KIND_NATS]
+	if ob.Len() != 1 || q.items[0].Key != "new" {
+		t.Errorf("%d items left, want only the new one", ob.Len())
+	}
+	if files, _ := filepath.Glob(filepath.Join(ob.dir, "*"+OUTBOX_EXT)); len(files) != 1 {
+		t.Errorf("%d files left, want 1", len(files))
+	}
+}
+
+func TestOutboxCaps(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ob, err := NewOutbox("", testLogger(), resty.New().SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.maxItems = 3
+	for i := 0; i < 5; i++ {
+		ob.NATS(fmt.Sprintf("key-%d", i), "subject", "reply", []byte{byte(i)})
+	}
+	ob.HTTP("http", resty.MethodPost, "/api/v3/checkin/", nil, nil)
+	var keys []string
+	for _, kind := range ob.kinds() {
+		for _, item := range ob.queues[kind].items {
+			keys = append(keys, item.Key)
+		}
+	}
+	// the oldest go first, whatever their transport
+	if want := []string{"http", "key-3", "key-4"}; fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("kept %v, want %v", keys, want)
+	}
+
+	ob, _ = NewOutbox("", testLogger(), nil)
+	ob.maxBytes = 1000
+	for i := 0; i < 5; i++ {
+		ob.NATS(fmt.Sprintf("key-%d", i), "subject", "reply", make([]byte, 300))
+	}
+	if ob.bytes > ob.maxBytes || ob.Len() == 0 {
+		t.Errorf("%d items of %d bytes, over the %d byte cap", ob.Len(), ob.bytes, ob.maxBytes)
+	}
+	if items := ob.queues[OUTBOX_KIND_NATS].items; items[len(items)-1].Key != "key-4" {
+		t.Errorf("newest item dropped")
+	}
+}
+
+func TestOutboxDedup(t *testing.T) {
+	ob, err := NewOutbox("", testLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.NATS("checkin-osinfo", "subject", "reply", []byte{1})
+	ob.NATS("other", "subject", "reply", []byte{2})
+	ob.NATS("checkin-osinfo", "subject", "reply", []byte{3})
+
+	items := ob.queues[OUTBOX_KIND_NATS].items
+	if len(items) != 2 || items[0].Key != "other" || items[1].Key != "checkin-osinfo" {
+		t.Fatalf("%d items, want the older check-in replaced", len(items))
+	}
+	if data, _ := items[1].natsData(); !bytes.Equal(data, []byte{3}) {
+		t.Errorf("kept % x, want the newer check-in", data)
+	}
+}
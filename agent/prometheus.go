@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	PROMETHEUS_PATH         = "/metrics"
+	PROMETHEUS_DEFAULT_HOST = "127.0.0.1"
+	PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// promWriter writes metrics in the Prometheus text exposition format
+type promWriter struct {
+	w *bufio.Writer
+}
+
+// family writes the HELP and TYPE lines of a metric
+func (p *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value, labels are name/value pairs
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			fmt.Fprintf(p.w, "%s=\"%s\"", labels[i], promEscape(labels[i+1]))
+		}
+		p.w.WriteByte('}')
+	}
+	fmt.Fprintf(p.w, " %g\n", value)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promEscape escapes backslashes, quotes and newlines in a label value
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
+
+// writePrometheus writes the agent's metrics, summaries as _sum and _count
+func (a *Agent) writePrometheus(p *promWriter) {
+	for _, m := range a.collectMetrics() {
+		p.family(m.Name, m.Type, m.Help)
+		for _, smp := range m.Samples {
+			if m.Type == METRIC_TYPE_SUMMARY {
+				p.sample(m.Name+"_sum", smp.Value, smp.Labels...)
+				p.sample(m.Name+"_count", float64(smp.Count), smp.Labels...)
+				continue
+			}
+			p.sample(m.Name, smp.Value, smp.Labels...)
+		}
+	}
+}
+
+// prometheusAddr returns the listen address, binding to localhost when the
+// configured address has no host
+func prometheusAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// a bare port
+		return net.JoinHostPort(PROMETHEUS_DEFAULT_HOST, addr)
+	}
+	if host == "" {
+		host = PROMETHEUS_DEFAULT_HOST
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// prometheusHandler serves the metrics on PROMETHEUS_PATH
+func (a *Agent) prometheusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PROMETHEUS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+		bw := bufio.NewWriter(w)
+		a.writePrometheus(&promWriter{w: bw})
+		bw.Flush()
+	})
+	return mux
+}
+
+// ServePrometheus serves the metrics endpoint on the configured address
+// until ctx is cancelled. It does nothing when no address is configured.
+func (a *Agent) ServePrometheus(ctx context.Context) error {
+	if a.PrometheusListen == "" {
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:              prometheusAddr(a.PrometheusListen),
+		Handler:           a.prometheusHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	a.Logger.Infoln("Serving Prometheus metrics on", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		a.Logger.Errorln("Prometheus:", err)
+		return err
+	}
+	return nil
+}
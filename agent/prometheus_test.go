@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusScrape(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{AgentID: "agent\"1", Version: "1.2.3"}, Logger: testLogger()}
+	Stats.ObserveCheck("ping", 250*time.Millisecond)
+
+	srv := httptest.NewServer(a.prometheusHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + PROMETHEUS_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != PROMETHEUS_CONTENT_TYPE {
+		t.Errorf("Content-Type = %q, want %q", ct, PROMETHEUS_CONTENT_TYPE)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	body := string(b)
+	for _, want := range []string{
+		"# TYPE rmm_agent_info gauge\n",
+		`rmm_agent_info{version="1.2.3",agent_id="agent\"1"} 1` + "\n",
+		"# TYPE rmm_agent_check_duration_seconds summary\n",
+		`rmm_agent_check_duration_seconds_count{type="ping"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape is missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestServePrometheusFromSettings(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(path, []byte(`{"prometheus_listen": "`+addr+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{AgentConfig: &AgentConfig{}, Logger: testLogger()}
+	settings.Apply(a.AgentConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.ServePrometheus(ctx)
+
+	var resp *http.Response
+	waitFor(t, func() bool {
+		resp, err = http.Get("http://" + addr + PROMETHEUS_PATH)
+		return err == nil
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("scrape status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestLoadSettingsMissingFile(t *testing.T) {
+	s, err := LoadSettings(filepath.Join(t.TempDir(), "none.json"))
+	if err != nil || !reflect.DeepEqual(s, AgentSettings{}) {
+		t.Errorf("LoadSettings() = %+v, %v, want no settings", s, err)
+	}
+}
@@ -26,6 +26,10 @@ func (a *Agent) SetupNatsOptions() []nats.Option {
 	}))
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
 		a.Logger.Printf("NATS Reconnected [%s]", nc.ConnectedUrl())
+		Stats.NatsReconnected()
+		if a.Outbox != nil {
+			a.Outbox.Kick()
+		}
 	}))
 	opts = append(opts, nats.ErrorHandler(func(conn *nats.Conn, subscription *nats.Subscription, err error) {
 		a.Logger.Fatalf("NATS Error: %v", err)
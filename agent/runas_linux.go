@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/shirou/gopsutil/v3/host"
+)
+
+const (
+	SYSTEMD_SESSIONS_DIR = "/run/systemd/sessions"
+	USER_RUNTIME_DIR     = "/run/user"
+	USER_DEFAULT_PATH    = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	USER_DEFAULT_SHELL   = "/bin/sh"
+)
+
+var ErrNoLoggedOnUser = errors.New("no user is logged on")
+
+// loginSession is a logind session, as found in /run/systemd/sessions
+type loginSession struct {
+	User    string
+	Active  bool
+	Seat    string
+	Class   string
+	Display string
+}
+
+// runAs makes cmd run as the named user, or the user of the active session,
+// with the user's groups and a login-like environment. The user is given
+// the files cmd needs, owned.
+func runAs(cmd *exec.Cmd, name string, owned ...string) (func(), error) {
+	var session *loginSession
+	if name == "" {
+		s, err := activeSession()
+		if err != nil {
+			return nil, err
+		}
+		session = s
+		name = s.User
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := userCredential(u)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range owned {
+		if err := os.Chown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	cmd.Env = userEnvironment(u, session)
+	if cmd.Dir == "" && FileExists(u.HomeDir) {
+		cmd.Dir = u.HomeDir
+	}
+	return func() {}, nil
+}
+
+// activeSession returns the session of the user at the console, falling
+// back to any user session and then to utmp on systems without logind
+func activeSession() (*loginSession, error) {
+	sessions, err := loginSessions()
+	if err == nil && len(sessions) > 0 {
+		best := sessions[0]
+		for _, s := range sessions[1:] {
+			if sessionRank(s) > sessionRank(best) {
+				best = s
+			}
+		}
+		return best, nil
+	}
+
+	users, err := host.Users()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoLoggedOnUser, err)
+	}
+	for _, u := range users {
+		if u.User != "" && u.User != "root" {
+			return &loginSession{User: u.User}, nil
+		}
+	}
+	return nil, ErrNoLoggedOnUser
+}
+
+func sessionRank(s *loginSession) int {
+	rank := 0
+	if s.Active {
+		rank += 2
+	}
+	if s.Seat != "" {
+		rank++
+	}
+	return rank
+}
+
+// loginSessions reads the user sessions logind knows about, greeters and
+// the like left out
+func loginSessions() ([]*loginSession, error) {
+	entries, err := os.ReadDir(SYSTEMD_SESSIONS_DIR)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasSuffix(e.Name(), ".ref") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	ret := make([]*loginSession, 0, len(names))
+	for _, name := range names {
+		kv, err := readEnvFile(filepath.Join(SYSTEMD_SESSIONS_DIR, name))
+		if err != nil {
+			continue
+		}
+		s := &loginSession{
+			User:    kv["USER"],
+			Active:  kv["ACTIVE"] == "1",
+			Seat:    kv["SEAT"],
+			Class:   kv["CLASS"],
+			Display: kv["DISPLAY"],
+		}
+		if s.User == "" || s.Class != "user" || kv["STATE"] == "closing" {
+			continue
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// readEnvFile reads a file of KEY=VALUE lines
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kv := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			kv[k] = v
+		}
+	}
+	return kv, scanner.Err()
+}
+
+// userCredential returns the uid, gid and supplementary groups of u
+func userCredential(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("groups of %s: %w", u.Username, err)
+	}
+	for _, g := range groups {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+	return cred, nil
+}
+
+// userEnvironment is the environment a login shell of u would start with,
+// plus what's needed to reach the user's session bus and display
+func userEnvironment(u *user.User, session *loginSession) []string {
+	env := []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"SHELL=" + loginShell(u.Username),
+		"PATH=" + USER_DEFAULT_PATH,
+	}
+	for _, k := range []string{"LANG", "LC_ALL", "TZ"} {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+
+	runtimeDir := filepath.Join(USER_RUNTIME_DIR, u.Uid)
+	if FileExists(runtimeDir) {
+		env = append(env, "XDG_RUNTIME_DIR="+runtimeDir)
+		if bus := filepath.Join(runtimeDir, "bus"); FileExists(bus) {
+			env = append(env, "DBUS_SESSION_BUS_ADDRESS=unix:path="+bus)
+		}
+		if FileExists(filepath.Join(runtimeDir, "wayland-0")) {
+			env = append(env, "WAYLAND_DISPLAY=wayland-0")
+		}
+	}
+	if session != nil && session.Display != "" {
+		env = append(env, "DISPLAY="+session.Display)
+	}
+	return env
+}
+
+// loginShell returns the user's shell from /etc/passwd
+func loginShell(username string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return USER_DEFAULT_SHELL
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == username && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return USER_DEFAULT_SHELL
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package agent
+
+import (
+	"os/exec"
+)
+
+func runAs(cmd *exec.Cmd, name string, owned ...string) (func(), error) {
+	return nil, ErrRunAsUnsupported
+}
@@ -0,0 +1,317 @@
+package agent
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SAMPLE_INTERVAL  = 10 * time.Second
+	SAMPLE_RETENTION = 15 * time.Minute
+
+	// Sample metrics
+	SAMPLE_METRIC_CPU        = "cpu"
+	SAMPLE_METRIC_MEM        = "mem"
+	SAMPLE_METRIC_SWAP       = "swap"
+	SAMPLE_METRIC_DISK_READ  = "disk_read"
+	SAMPLE_METRIC_DISK_WRITE = "disk_write"
+	SAMPLE_METRIC_NET_RECV   = "net_recv"
+	SAMPLE_METRIC_NET_SENT   = "net_sent"
+	SAMPLE_METRIC_LOAD1      = "load1"
+)
+
+// Sample is one reading of the host's resource usage. Rates are computed
+// from the counters of the previous reading.
+type Sample struct {
+	Time      time.Time `json:"time"`
+	CPU       float64   `json:"cpu"`        // percent
+	Mem       float64   `json:"mem"`        // percent
+	Swap      float64   `json:"swap"`       // percent
+	DiskRead  float64   `json:"disk_read"`  // bytes/s
+	DiskWrite float64   `json:"disk_write"` // bytes/s
+	NetRecv   float64   `json:"net_recv"`   // bytes/s
+	NetSent   float64   `json:"net_sent"`   // bytes/s
+	Load1     float64   `json:"load1"`      // 0 where the OS has no load average
+	Load5     float64   `json:"load5"`
+	Load15    float64   `json:"load15"`
+}
+
+// SampleStats summarizes one metric over a window of samples
+type SampleStats struct {
+	Count int     `json:"count"`
+	Avg   float64 `json:"avg"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// counters are the cumulative values a sample's rates are derived from
+type counters struct {
+	time                time.Time
+	cpuBusy, cpuTotal   float64
+	diskRead, diskWrite uint64
+	netRecv, netSent    uint64
+}
+
+// Sampler keeps a rolling ring buffer of resource usage samples taken in
+// the background, so checks can look at averages instead of one reading
+type Sampler struct {
+	logger   *logrus.Logger
+	interval time.Duration
+	once     sync.Once
+
+	mu   sync.RWMutex
+	ring []Sample
+	next int
+	full bool
+	prev *counters
+}
+
+// NewSampler returns a sampler that keeps SAMPLE_RETENTION worth of samples
+func NewSampler(logger *logrus.Logger) *Sampler {
+	return &Sampler{
+		logger:   logger,
+		interval: SAMPLE_INTERVAL,
+		ring:     make([]Sample, int(SAMPLE_RETENTION/SAMPLE_INTERVAL)),
+	}
+}
+
+// Start runs the sampler in the background, calling it again is a no-op
+func (s *Sampler) Start(ctx context.Context) {
+	s.once.Do(func() {
+		go s.run(ctx)
+	})
+}
+
+func (s *Sampler) run(ctx context.Context) {
+	// prime the counters so the first sample has rates
+	s.collect()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.collect()
+		}
+	}
+}
+
+// collect takes a reading and adds a sample to the ring
+func (s *Sampler) collect() {
+	cur := counters{time: time.Now()}
+	var err error
+	if cur.cpuBusy, cur.cpuTotal, err = readCPUTimes(); err != nil {
+		s.logger.Debugln("Sampler cpu:", err)
+	}
+	if io, err := disk.IOCounters(); err == nil {
+		for _, d := range io {
+			cur.diskRead += d.ReadBytes
+			cur.diskWrite += d.WriteBytes
+		}
+	} else {
+		s.logger.Debugln("Sampler disk:", err)
+	}
+	if io, err := net.IOCounters(false); err == nil && len(io) > 0 {
+		cur.netRecv = io[0].BytesRecv
+		cur.netSent = io[0].BytesSent
+	} else if err != nil {
+		s.logger.Debugln("Sampler net:", err)
+	}
+
+	smp := Sample{Time: cur.time}
+	if vm, err := mem.VirtualMemory(); err == nil {
+		smp.Mem = vm.UsedPercent
+	}
+	if sw, err := mem.SwapMemory(); err == nil {
+		smp.Swap = sw.UsedPercent
+	}
+	if smp.Load1, smp.Load5, smp.Load15, err = readLoadAvg(); err != nil {
+		s.logger.Debugln("Sampler load:", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.prev
+	s.prev = &cur
+	if prev == nil {
+		return
+	}
+
+	secs := cur.time.Sub(prev.time).Seconds()
+	if total := cur.cpuTotal - prev.cpuTotal; total > 0 {
+		smp.CPU = math.Max(0, math.Min(100, (cur.cpuBusy-prev.cpuBusy)/total*100))
+	}
+	smp.DiskRead = counterRate(prev.diskRead, cur.diskRead, secs)
+	smp.DiskWrite = counterRate(prev.diskWrite, cur.diskWrite, secs)
+	smp.NetRecv = counterRate(prev.netRecv, cur.netRecv, secs)
+	smp.NetSent = counterRate(prev.netSent, cur.netSent, secs)
+
+	s.push(smp)
+}
+
+// push adds smp to the ring, overwriting the oldest sample once it is full.
+// The caller holds the lock.
+func (s *Sampler) push(smp Sample) {
+	s.ring[s.next] = smp
+	s.next = (s.next + 1) % len(s.ring)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// counterRate returns the per second rate of a counter, 0 if it wrapped
+// or was reset
+func counterRate(prev, cur uint64, secs float64) float64 {
+	if cur < prev || secs <= 0 {
+		return 0
+	}
+	return float64(cur-prev) / secs
+}
+
+// Samples returns the samples taken within window, oldest first
+func (s *Sampler) Samples(window time.Duration) []Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := s.next
+	start := 0
+	if s.full {
+		n = len(s.ring)
+		start = s.next
+	}
+
+	since := time.Now().Add(-window)
+	ret := make([]Sample, 0, n)
+	for i := 0; i < n; i++ {
+		smp := s.ring[(start+i)%len(s.ring)]
+		if smp.Time.After(since) {
+			ret = append(ret, smp)
+		}
+	}
+	return ret
+}
+
+// Latest returns the most recent sample, false if none was taken yet
+func (s *Sampler) Latest() (Sample, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.full && s.next == 0 {
+		return Sample{}, false
+	}
+	return s.ring[(s.next-1+len(s.ring))%len(s.ring)], true
+}
+
+// Stats summarizes metric over window, false if there are no samples in it
+// or the metric is unknown
+func (s *Sampler) Stats(metric string, window time.Duration) (SampleStats, bool) {
+	values, ok := s.sortedValues(metric, window)
+	if !ok {
+		return SampleStats{}, false
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return SampleStats{
+		Count: len(values),
+		Avg:   sum / float64(len(values)),
+		Min:   values[0],
+		Max:   values[len(values)-1],
+		P50:   percentile(values, 50),
+		P95:   percentile(values, 95),
+		P99:   percentile(values, 99),
+	}, true
+}
+
+// Percentile returns the p-th percentile of metric over window
+func (s *Sampler) Percentile(metric string, window time.Duration, p float64) (float64, bool) {
+	values, ok := s.sortedValues(metric, window)
+	if !ok {
+		return 0, false
+	}
+	return percentile(values, p), true
+}
+
+// sortedValues returns the values of metric within window in ascending order
+func (s *Sampler) sortedValues(metric string, window time.Duration) ([]float64, bool) {
+	get, ok := sampleMetrics[metric]
+	if !ok {
+		return nil, false
+	}
+	samples := s.Samples(window)
+	if len(samples) == 0 {
+		return nil, false
+	}
+	values := make([]float64, len(samples))
+	for i, smp := range samples {
+		values[i] = get(smp)
+	}
+	sort.Float64s(values)
+	return values, true
+}
+
+// CPULoadAvg returns the average CPU usage over the last minutes
+func (s *Sampler) CPULoadAvg(minutes int) (float64, bool) {
+	st, ok := s.Stats(SAMPLE_METRIC_CPU, time.Duration(minutes)*time.Minute)
+	return st.Avg, ok
+}
+
+// SampledCPULoad returns the agent's CPU usage averaged over the last
+// minutes, or the given percentile of it when pct is set. false if the
+// sampler has no samples yet.
+func (a *Agent) SampledCPULoad(minutes int, pct float64) (int, bool) {
+	if a.Sampler == nil {
+		return 0, false
+	}
+	window := time.Duration(minutes) * time.Minute
+	var v float64
+	var ok bool
+	if pct > 0 {
+		v, ok = a.Sampler.Percentile(SAMPLE_METRIC_CPU, window, pct)
+	} else {
+		v, ok = a.Sampler.CPULoadAvg(minutes)
+	}
+	return int(math.Round(v)), ok
+}
+
+var sampleMetrics = map[string]func(Sample) float64{
+	SAMPLE_METRIC_CPU:        func(s Sample) float64 { return s.CPU },
+	SAMPLE_METRIC_MEM:        func(s Sample) float64 { return s.Mem },
+	SAMPLE_METRIC_SWAP:       func(s Sample) float64 { return s.Swap },
+	SAMPLE_METRIC_DISK_READ:  func(s Sample) float64 { return s.DiskRead },
+	SAMPLE_METRIC_DISK_WRITE: func(s Sample) float64 { return s.DiskWrite },
+	SAMPLE_METRIC_NET_RECV:   func(s Sample) float64 { return s.NetRecv },
+	SAMPLE_METRIC_NET_SENT:   func(s Sample) float64 { return s.NetSent },
+	SAMPLE_METRIC_LOAD1:      func(s Sample) float64 { return s.Load1 },
+}
+
+// percentile returns the p-th percentile of sorted values using the
+// nearest-rank method
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readCPUTimes returns the busy and total jiffies of all CPUs from the
+// aggregate line of /proc/stat
+func readCPUTimes() (busy, total float64, err error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	line, _, _ := strings.Cut(string(b), "\n")
+	return parseProcStatCPU(line)
+}
+
+// parseProcStatCPU parses "cpu user nice system idle iowait irq softirq
+// steal guest guest_nice". guest time is already counted in user.
+func parseProcStatCPU(line string) (busy, total float64, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, fmt.Errorf("unexpected /proc/stat line: %q", line)
+	}
+
+	var idle float64
+	for i, f := range fields[1:] {
+		if i >= 8 {
+			break
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return total - idle, total, nil
+}
+
+// readLoadAvg returns the 1, 5 and 15 minute run queue averages from
+// /proc/loadavg
+func readLoadAvg() (load1, load5, load15 float64, err error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return 0, 0, 0, fmt.Errorf("unexpected /proc/loadavg: %q", b)
+	}
+	var loads [3]float64
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return loads[0], loads[1], loads[2], nil
+}
@@ -0,0 +1,32 @@
+package agent
+
+import "testing"
+
+func TestParseProcStatCPU(t *testing.T) {
+	for _, tt := range []struct {
+		line        string
+		busy, total float64
+		wantErr     bool
+	}{
+		// user nice system idle iowait irq softirq steal guest guest_nice
+		{"cpu  74608 2520 24433 1117073 6176 4054 0 0 0 0", 105615, 1228864, false},
+		// guest time is already counted in user
+		{"cpu  100 0 50 800 50 0 0 10 40 5", 160, 1010, false},
+		// older kernels without steal and guest
+		{"cpu  100 20 30 800 50 0 0", 150, 1000, false},
+		{"cpu  100 20 30 800", 150, 950, false},
+		{"cpu0 100 20 30 800 50 0 0 0 0 0", 0, 0, true},
+		{"cpu  100 20 30", 0, 0, true},
+		{"cpu  100 x 30 800 50", 0, 0, true},
+		{"", 0, 0, true},
+	} {
+		busy, total, err := parseProcStatCPU(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProcStatCPU(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if busy != tt.busy || total != tt.total {
+			t.Errorf("parseProcStatCPU(%q) = %v, %v, want %v, %v", tt.line, busy, total, tt.busy, tt.total)
+		}
+	}
+}
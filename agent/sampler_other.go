@@ -0,0 +1,34 @@
+//go:build !linux
+
+package agent
+
+import (
+	"runtime"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/load"
+)
+
+// readCPUTimes returns the busy and total CPU seconds of all CPUs
+func readCPUTimes() (busy, total float64, err error) {
+	times, err := cpu.Times(false)
+	if err != nil || len(times) == 0 {
+		return 0, 0, err
+	}
+	t := times[0]
+	total = t.User + t.Nice + t.System + t.Idle + t.Iowait + t.Irq + t.Softirq + t.Steal
+	return total - t.Idle - t.Iowait, total, nil
+}
+
+// readLoadAvg returns the 1, 5 and 15 minute run queue averages. Windows
+// has no load average, so it is left at 0.
+func readLoadAvg() (load1, load5, load15 float64, err error) {
+	if runtime.GOOS == "windows" {
+		return 0, 0, 0, nil
+	}
+	avg, err := load.Avg()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return avg.Load1, avg.Load5, avg.Load15, nil
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+// testSampler returns a sampler with a ring of size samples, filled with n
+// samples taken SAMPLE_INTERVAL apart and ending now. The CPU of each
+// sample is its index.
+func testSampler(size, n int) *Sampler {
+	s := &Sampler{logger: testLogger(), interval: SAMPLE_INTERVAL, ring: make([]Sample, size)}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		s.push(Sample{
+			Time: now.Add(-time.Duration(n-1-i) * SAMPLE_INTERVAL),
+			CPU:  float64(i),
+		})
+	}
+	return s
+}
+
+func sampleCPUs(samples []Sample) []float64 {
+	ret := make([]float64, len(samples))
+	for i, smp := range samples {
+		ret[i] = smp.CPU
+	}
+	return ret
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSamplerRingWraps(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		size   int
+		taken  int
+		window time.Duration
+		want   []float64
+	}{
+		{"empty", 4, 0, time.Hour, []float64{}},
+		{"partly filled", 4, 3, time.Hour, []float64{0, 1, 2}},
+		{"exactly full", 4, 4, time.Hour, []float64{0, 1, 2, 3}},
+		{"wrapped", 4, 6, time.Hour, []float64{2, 3, 4, 5}},
+		{"wrapped many times", 4, 11, time.Hour, []float64{7, 8, 9, 10}},
+		{"window shorter than the ring", 4, 6, SAMPLE_INTERVAL + SAMPLE_INTERVAL/2, []float64{4, 5}},
+		{"window longer than the samples taken", 10, 3, SAMPLE_RETENTION, []float64{0, 1, 2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSampler(tt.size, tt.taken)
+			if got := sampleCPUs(s.Samples(tt.window)); !equalFloats(got, tt.want) {
+				t.Errorf("Samples() = %v, want %v", got, tt.want)
+			}
+
+			latest, ok := s.Latest()
+			if ok != (tt.taken > 0) {
+				t.Fatalf("Latest() ok = %v after %d samples", ok, tt.taken)
+			}
+			if ok && latest.CPU != float64(tt.taken-1) {
+				t.Errorf("Latest() = %v, want %v", latest.CPU, tt.taken-1)
+			}
+		})
+	}
+}
+
+func TestSamplerStats(t *testing.T) {
+	// a window longer than what was recorded uses every sample
+	s := testSampler(90, 5)
+	st, ok := s.Stats(SAMPLE_METRIC_CPU, SAMPLE_RETENTION)
+	if !ok {
+		t.Fatal("Stats() found no samples")
+	}
+	want := SampleStats{Count: 5, Avg: 2, Min: 0, Max: 4, P50: 2, P95: 4, P99: 4}
+	if st != want {
+		t.Errorf("Stats() = %+v, want %+v", st, want)
+	}
+
+	if _, ok := s.Stats("bogus", time.Hour); ok {
+		t.Error("Stats() of an unknown metric succeeded")
+	}
+	if _, ok := testSampler(4, 0).Stats(SAMPLE_METRIC_CPU, time.Hour); ok {
+		t.Error("Stats() of an empty sampler succeeded")
+	}
+
+	// samples older than the window are left out
+	s = testSampler(4, 4)
+	s.ring[0].Time = time.Now().Add(-2 * SAMPLE_RETENTION)
+	if v, _ := s.Percentile(SAMPLE_METRIC_CPU, SAMPLE_RETENTION, 0); v != 1 {
+		t.Errorf("Percentile(0) = %v, want 1", v)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tt := range []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 50, 0},
+		{[]float64{42}, 0, 42},
+		{[]float64{42}, 99, 42},
+		{values, 0, 1},
+		{values, 10, 1},
+		{values, 11, 2},
+		{values, 50, 5},
+		{values, 95, 10},
+		{values, 100, 10},
+		{values, 150, 10},
+		{[]float64{1, 2, 3}, 50, 2},
+		{[]float64{1, 2, 3}, 67, 3},
+	} {
+		if got := percentile(tt.sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	for _, tt := range []struct {
+		prev, cur uint64
+		secs      float64
+		want      float64
+	}{
+		{100, 300, 10, 20},
+		{300, 100, 10, 0},
+		{100, 300, 0, 0},
+	} {
+		if got := counterRate(tt.prev, tt.cur, tt.secs); got != tt.want {
+			t.Errorf("counterRate(%d, %d, %v) = %v, want %v", tt.prev, tt.cur, tt.secs, got, tt.want)
+		}
+	}
+}
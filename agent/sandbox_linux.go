@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	CGROUP_ROOT          = "/sys/fs/cgroup"
+	CGROUP_SCRIPTS       = "rmm-scripts"
+	CGROUP_POLL_INTERVAL = 250 * time.Millisecond
+	SANDBOX_SHELL        = "/bin/sh"
+	// exit code of the sandbox shell when it can't set the script up,
+	// distinct from the SCRIPT_EXIT_ codes
+	SANDBOX_SETUP_FAIL = 96
+)
+
+// the system paths made read-only for ReadOnlySystem scripts
+var sandboxReadOnlyPaths = []string{"/usr", "/etc", "/boot", "/opt", "/bin", "/sbin", "/lib", "/lib32", "/lib64"}
+
+var (
+	errNoCgroup2 = errors.New("cgroup v2 is not available")
+	// RLIMIT_NPROC doesn't apply to root
+	errProcsAsRoot = errors.New("the process limit needs cgroup v2 for scripts running as root")
+)
+
+// sandbox enforces a script's limits for one run, through a cgroup of its
+// own when cgroup v2 is there and through rlimits otherwise
+type sandbox struct {
+	limits   shared.ScriptLimits
+	cgroup   string // empty when rlimits are used
+	cgroupFD *os.File
+	done     chan struct{}
+}
+
+// newSandbox sets cmd up to run under limits, it must be called before
+// cmd is started. Without cgroup v2 the limits are set as rlimits by the
+// sandbox shell before it execs the script, any other cgroup error fails
+// the run rather than leaving the script unlimited.
+func newSandbox(cmd *exec.Cmd, limits shared.ScriptLimits) (*sandbox, error) {
+	s := &sandbox{limits: limits, done: make(chan struct{})}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	var prelude strings.Builder
+	if limits.ReadOnlySystem {
+		// the bind mounts need root, which the script no longer has
+		if cmd.SysProcAttr.Credential != nil {
+			return nil, errors.New("read-only system paths can't be combined with running as a user")
+		}
+		readOnlySystem(cmd, &prelude)
+	}
+
+	if limits.CPUSeconds > 0 || limits.MemoryMB > 0 || limits.MaxProcs > 0 {
+		dir, err := newScriptCgroup(limits)
+		switch {
+		case errors.Is(err, errNoCgroup2):
+			if limits.MaxProcs > 0 && runsAsRoot(cmd) {
+				return nil, errProcsAsRoot
+			}
+			rlimits(limits, &prelude)
+		case err != nil:
+			return nil, fmt.Errorf("script cgroup: %w", err)
+		default:
+			fd, err := os.Open(dir)
+			if err != nil {
+				os.Remove(dir)
+				return nil, fmt.Errorf("script cgroup: %w", err)
+			}
+			s.cgroup = dir
+			s.cgroupFD = fd
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(fd.Fd())
+		}
+	}
+
+	if prelude.Len() > 0 {
+		prelude.WriteString(`exec "$@"`)
+		cmd.Args = append([]string{SANDBOX_SHELL, "-c", prelude.String(), "sh", cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = SANDBOX_SHELL
+	}
+	return s, nil
+}
+
+// runsAsRoot reports whether cmd will run with uid 0
+func runsAsRoot(cmd *exec.Cmd) bool {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		return cmd.SysProcAttr.Credential.Uid == 0
+	}
+	return os.Geteuid() == 0
+}
+
+// readOnlySystem runs cmd in a mount namespace of its own, the sandbox
+// shell remounts the system paths read-only before it execs the script
+func readOnlySystem(cmd *exec.Cmd, prelude *strings.Builder) {
+	for _, p := range sandboxReadOnlyPaths {
+		if fi, err := os.Lstat(p); err != nil || !fi.IsDir() {
+			continue // missing, or a symlink into /usr
+		}
+		fmt.Fprintf(prelude, "{ mount --bind %[1]s %[1]s && mount -o remount,bind,ro %[1]s; } || exit %[2]d; ", p, SANDBOX_SETUP_FAIL)
+	}
+	// Go makes the new namespace's mounts private, so nothing leaks out
+	cmd.SysProcAttr.Unshareflags |= syscall.CLONE_NEWNS
+}
+
+// rlimits has the sandbox shell set the limits as rlimits, which the
+// script inherits. The soft limit goes first, the hard one can't be set
+// below it.
+func rlimits(limits shared.ScriptLimits, prelude *strings.Builder) {
+	if n := limits.CPUSeconds; n > 0 {
+		// SIGXCPU at the limit, SIGKILL a second later
+		fmt.Fprintf(prelude, "{ ulimit -S -t %d && ulimit -H -t %d; } || exit %d; ", n, n+1, SANDBOX_SETUP_FAIL)
+	}
+	if n := limits.MemoryMB; n > 0 {
+		fmt.Fprintf(prelude, "ulimit -v %d || exit %d; ", n<<10, SANDBOX_SETUP_FAIL)
+	}
+	if n := limits.MaxProcs; n > 0 {
+		// counts all the user's processes. bash and busybox call it -u,
+		// dash -p.
+		fmt.Fprintf(prelude, "{ ulimit -S -u %[1]d && ulimit -H -u %[1]d; } 2>/dev/null || { ulimit -S -p %[1]d && ulimit -H -p %[1]d; } || exit %[2]d; ", n, SANDBOX_SETUP_FAIL)
+	}
+}
+
+// newScriptCgroup creates a cgroup with the memory and process limits set.
+// Scripts get their own subtree at the top, the agent's own cgroup can't
+// have children with controllers while it has processes in it.
+func newScriptCgroup(limits shared.ScriptLimits) (string, error) {
+	if !FileExists(filepath.Join(CGROUP_ROOT, "cgroup.controllers")) {
+		return "", errNoCgroup2
+	}
+	parent := filepath.Join(CGROUP_ROOT, CGROUP_SCRIPTS)
+	if err := os.Mkdir(parent, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	// one at a time, a write with an unavailable controller fails whole
+	for _, d := range []string{CGROUP_ROOT, parent} {
+		for _, c := range []string{"+cpu", "+memory", "+pids"} {
+			os.WriteFile(filepath.Join(d, "cgroup.subtree_control"), []byte(c), 0644)
+		}
+	}
+
+	dir, err := os.MkdirTemp(parent, SCRIPT_TEMP_PREFIX)
+	if err != nil {
+		return "", err
+	}
+	set := func(file, value string) error {
+		return os.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+	}
+	if limits.MemoryMB > 0 {
+		if err := set("memory.max", strconv.Itoa(limits.MemoryMB<<20)); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+		// off when swap accounting is
+		set("memory.swap.max", "0")
+	}
+	if limits.MaxProcs > 0 {
+		if err := set("pids.max", strconv.Itoa(limits.MaxProcs)); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Started starts watching the script's CPU time in its cgroup, kill is
+// called with the limit the script broke
+func (s *sandbox) Started(cmd *exec.Cmd, kill func(limit string)) error {
+	if s.cgroup != "" && s.limits.CPUSeconds > 0 {
+		go s.watchCPU(kill)
+	}
+	return nil
+}
+
+// watchCPU kills the script once its processes have used up their CPU time
+func (s *sandbox) watchCPU(kill func(limit string)) {
+	ticker := time.NewTicker(CGROUP_POLL_INTERVAL)
+	defer ticker.Stop()
+	limit := uint64(s.limits.CPUSeconds) * uint64(time.Second/time.Microsecond)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		stat, err := readKeyedFile(filepath.Join(s.cgroup, "cpu.stat"))
+		if err != nil {
+			continue
+		}
+		if stat["usage_usec"] >= limit {
+			kill(SCRIPT_LIMIT_CPU)
+			return
+		}
+	}
+}
+
+// Violation returns the limit the script broke, if any, once it has exited
+func (s *sandbox) Violation(state *os.ProcessState) string {
+	if s.cgroup != "" {
+		if events, err := readKeyedFile(filepath.Join(s.cgroup, "memory.events")); err == nil && events["oom_kill"] > 0 {
+			return SCRIPT_LIMIT_MEMORY
+		}
+		if events, err := readKeyedFile(filepath.Join(s.cgroup, "pids.events")); err == nil && events["max"] > 0 && !state.Success() {
+			return SCRIPT_LIMIT_PROCS
+		}
+		return ""
+	}
+
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() && s.limits.CPUSeconds > 0 {
+		if ws.Signal() == syscall.SIGXCPU || state.SystemTime()+state.UserTime() >= time.Duration(s.limits.CPUSeconds)*time.Second {
+			return SCRIPT_LIMIT_CPU
+		}
+	}
+	return ""
+}
+
+// Release kills whatever is left of the script and removes its cgroup
+func (s *sandbox) Release() {
+	close(s.done)
+	if s.cgroup == "" {
+		return
+	}
+	s.cgroupFD.Close()
+	// kernels before 5.14 have no cgroup.kill, the process group kill has
+	// to do there
+	os.WriteFile(filepath.Join(s.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	for i := 0; i < 20; i++ {
+		if err := os.Remove(s.cgroup); err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// readKeyedFile reads a cgroup file of "key value" lines
+func readKeyedFile(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			ret[k] = n
+		}
+	}
+	return ret, scanner.Err()
+}
@@ -0,0 +1,25 @@
+package agent
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestRlimitsSetBeforeExec(t *testing.T) {
+	var prelude strings.Builder
+	rlimits(shared.ScriptLimits{CPUSeconds: 5, MemoryMB: 100, MaxProcs: 50}, &prelude)
+	prelude.WriteString(`exec "$@"`)
+
+	// the script is a shell, as it would be exec'ed by the sandbox shell
+	out, err := exec.Command(SANDBOX_SHELL, "-c", prelude.String(), "sh",
+		SANDBOX_SHELL, "-c", "ulimit -S -t; ulimit -H -t; ulimit -v; ulimit -u 2>/dev/null || ulimit -p").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(out)), []string{"5", "6", "102400", "50"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("limits in the script = %v, want %v", got, want)
+	}
+}
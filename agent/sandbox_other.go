@@ -0,0 +1,27 @@
+//go:build !linux
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// sandbox only limits a script's output on this platform, which RunScriptOpts
+// does everywhere
+type sandbox struct{}
+
+func newSandbox(cmd *exec.Cmd, limits shared.ScriptLimits) (*sandbox, error) {
+	if limits.CPUSeconds > 0 || limits.MemoryMB > 0 || limits.MaxProcs > 0 || limits.ReadOnlySystem {
+		return nil, ErrLimitsUnsupported
+	}
+	return &sandbox{}, nil
+}
+
+func (s *sandbox) Started(cmd *exec.Cmd, kill func(limit string)) error { return nil }
+
+func (s *sandbox) Violation(state *os.ProcessState) string { return "" }
+
+func (s *sandbox) Release() {}
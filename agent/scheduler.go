@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	CHECK_SCHEDULER_TICK   = 15 * time.Second
+	CHECK_DEFAULT_INTERVAL = 120 // seconds
+	// definitions are still polled once the server pushes updates, in case
+	// one was missed
+	CHECK_PUSH_POLL_INTERVAL = 15 * time.Minute
+)
+
+// CheckScheduler runs checks in-process on their own intervals. A check is
+// never started while its previous run is still in progress.
+type CheckScheduler struct {
+	a       *Agent
+	trigger chan struct{}
+
+	mu        sync.Mutex
+	checks    []shared.Check
+	interval  time.Duration // agent-wide default and definition refresh interval
+	refreshed time.Time
+	lastRun   map[int]time.Time
+	running   map[int]bool
+	version   int64 // of the check definitions, 0 if the server doesn't version them
+	pushed    bool  // the server pushes updates over NATS
+}
+
+// NewCheckScheduler returns a scheduler that runs checks through a.Checks
+func NewCheckScheduler(a *Agent) *CheckScheduler {
+	return &CheckScheduler{
+		a:        a,
+		trigger:  make(chan struct{}, 1),
+		interval: CHECK_DEFAULT_INTERVAL * time.Second,
+		lastRun:  make(map[int]time.Time),
+		running:  make(map[int]bool),
+	}
+}
+
+// Run schedules checks until ctx is cancelled
+func (s *CheckScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(CHECK_SCHEDULER_TICK)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.trigger:
+			force = true
+		}
+
+		if force || s.refreshDue() {
+			s.refresh(force)
+		}
+		s.runDue(ctx, force)
+	}
+}
+
+// RunNow asks the scheduler to run every check that is not already
+// running, those are skipped. It returns false if a run is already pending.
+func (s *CheckScheduler) RunNow() bool {
+	select {
+	case s.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Busy reports whether any check is currently running
+func (s *CheckScheduler) Busy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.running) > 0
+}
+
+func (s *CheckScheduler) refreshDue() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	every := s.interval
+	if s.pushed {
+		every = max(every, CHECK_PUSH_POLL_INTERVAL)
+	}
+	return time.Since(s.refreshed) >= every
+}
+
+// refresh retrieves the check definitions, through the runchecks endpoint
+// when a run was forced. If the server can't be reached the previous ones
+// are kept, or the cached ones are used after a restart.
+func (s *CheckScheduler) refresh(force bool) {
+	data, err := s.a.GetChecks(force)
+	if err == nil {
+		s.SetChecks(data)
+		return
+	}
+	s.a.Logger.Debugln("CheckScheduler", err)
+
+	s.mu.Lock()
+	loaded := !s.refreshed.IsZero()
+	s.mu.Unlock()
+	if loaded {
+		return
+	}
+
+	data, err = s.a.LoadCheckCache()
+	if err != nil {
+		s.a.Logger.Debugln("CheckScheduler: no usable check cache:", err)
+		return
+	}
+	s.a.Logger.Infoln("Server unreachable, running cached check definitions")
+	s.SetChecks(data)
+}
+
+// SetChecks replaces the scheduled check definitions. Definitions older
+// than the current version, such as a poll that was in flight while an
+// update was pushed, are ignored.
+func (s *CheckScheduler) SetChecks(data shared.AllChecks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if data.Version > 0 && data.Version < s.version {
+		s.a.Logger.Debugln("Ignoring stale check definitions", data.Version, "current", s.version)
+		return
+	}
+	s.checks = data.Checks
+	s.refreshed = time.Now()
+	if data.Interval > 0 {
+		s.interval = time.Duration(data.Interval) * time.Second
+	}
+	if data.Version > 0 {
+		s.version = data.Version
+	}
+	s.forgetRemoved()
+}
+
+// forgetRemoved drops the state of checks that were removed on the
+// server. Called with s.mu held.
+func (s *CheckScheduler) forgetRemoved() {
+	current := make(map[int]bool, len(s.checks))
+	for _, c := range s.checks {
+		current[c.CheckPK] = true
+	}
+	for pk := range s.lastRun {
+		if !current[pk] {
+			delete(s.lastRun, pk)
+		}
+	}
+	s.a.Checks.Forget(s.checks)
+}
+
+// ApplyUpdate applies check definitions pushed by the server and returns
+// the version now in effect. Updates older than the current version are
+// ignored. New checks run on the next tick, modified ones keep their
+// schedule.
+func (s *CheckScheduler) ApplyUpdate(u shared.CheckUpdate) int64 {
+	s.mu.Lock()
+	s.pushed = true
+	if u.Version > 0 && u.Version <= s.version {
+		defer s.mu.Unlock()
+		s.a.Logger.Debugln("Ignoring stale check update", u.Version, "current", s.version)
+		return s.version
+	}
+
+	if u.Full {
+		s.checks = u.Checks
+	} else {
+		removed := make(map[int]bool, len(u.Removed))
+		for _, pk := range u.Removed {
+			removed[pk] = true
+		}
+		changed := make(map[int]shared.Check, len(u.Checks))
+		for _, c := range u.Checks {
+			changed[c.CheckPK] = c
+		}
+
+		checks := make([]shared.Check, 0, len(s.checks)+len(u.Checks))
+		for _, c := range s.checks {
+			if removed[c.CheckPK] {
+				continue
+			}
+			if nc, ok := changed[c.CheckPK]; ok {
+				c = nc
+				delete(changed, c.CheckPK)
+			}
+			checks = append(checks, c)
+		}
+		for _, c := range u.Checks {
+			if _, ok := changed[c.CheckPK]; ok && !removed[c.CheckPK] {
+				checks = append(checks, c)
+			}
+		}
+		s.checks = checks
+	}
+	if u.Interval > 0 {
+		s.interval = time.Duration(u.Interval) * time.Second
+	}
+	s.version = u.Version
+	s.refreshed = time.Now()
+	s.forgetRemoved()
+
+	data := shared.AllChecks{
+		CheckInfo: shared.CheckInfo{
+			Interval: int(s.interval.Seconds()),
+			Version:  s.version,
+		},
+		Checks: append([]shared.Check(nil), s.checks...),
+	}
+	s.mu.Unlock()
+
+	if err := s.a.SaveCheckCache(data); err != nil {
+		s.a.Logger.Debugln("Check cache:", err)
+	}
+	return data.Version
+}
+
+// runDue starts the checks whose interval has elapsed, or every idle check
+// when force is set, without blocking the scheduler loop
+func (s *CheckScheduler) runDue(ctx context.Context, force bool) {
+	s.mu.Lock()
+	now := time.Now()
+	due := make([]shared.Check, 0)
+	for _, c := range s.checks {
+		if s.running[c.CheckPK] {
+			continue
+		}
+		interval := s.interval
+		if c.RunInterval > 0 {
+			interval = time.Duration(c.RunInterval) * time.Second
+		}
+		if !force && now.Sub(s.lastRun[c.CheckPK]) < interval {
+			continue
+		}
+		s.running[c.CheckPK] = true
+		s.lastRun[c.CheckPK] = now
+		due = append(due, c)
+	}
+	s.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	// each check is released as it finishes, so a slow one doesn't hold
+	// back the next run of the others
+	go s.a.Checks.Run(ctx, due, func(c shared.Check) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.running, c.CheckPK)
+	})
+}
+
+// CheckRunner schedules the agent's checks in-process for the lifetime of
+// the agent service
+func (a *Agent) CheckRunner() {
+	if a.Sampler != nil {
+		a.Sampler.Start(context.Background())
+	}
+	if a.Outbox != nil {
+		a.Outbox.Start(context.Background())
+	}
+	a.Logger.Infoln("CheckRunner service started.")
+	sleepDelay := 14 + rand.Intn(8)
+	a.Logger.Debugf("Sleeping for %v seconds", sleepDelay)
+	time.Sleep(time.Duration(sleepDelay) * time.Second)
+
+	a.Scheduler.RunNow()
+	a.Scheduler.Run(context.Background())
+}
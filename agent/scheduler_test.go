@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestSchedulerReleasesChecksAsTheyFinish(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	ob, err := NewOutbox("", testLogger(), resty.New().SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewCheckEngine(testLogger(), ob, nil, testLocks(t))
+	block := make(chan struct{})
+	defer close(block)
+	var fast atomic.Int32
+	engine.Register("slow", func(ctx context.Context, _ shared.Check) CheckResult {
+		select {
+		case <-block:
+		case <-ctx.Done():
+		}
+		return CheckResult{}
+	})
+	engine.Register("fast", func(context.Context, shared.Check) CheckResult {
+		fast.Add(1)
+		return CheckResult{}
+	})
+
+	s := NewCheckScheduler(&Agent{AgentConfig: &AgentConfig{}, Logger: testLogger(), Checks: engine})
+	s.SetChecks(shared.AllChecks{Checks: []shared.Check{
+		{CheckPK: 990001, CheckType: "slow"},
+		{CheckPK: 990002, CheckType: "fast"},
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.runDue(ctx, true)
+	waitFor(t, func() bool { return fast.Load() == 1 && !s.isRunning(990002) })
+
+	// the slow check is still in flight, the fast one runs again
+	if !s.isRunning(990001) {
+		t.Fatal("slow check not running")
+	}
+	if !s.RunNow() {
+		t.Fatal("RunNow() = false while no run is pending")
+	}
+	if s.RunNow() {
+		t.Error("RunNow() = true with a run already pending")
+	}
+	<-s.trigger
+	s.runDue(ctx, true)
+	waitFor(t, func() bool { return fast.Load() == 2 })
+}
+
+func (s *CheckScheduler) isRunning(pk int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running[pk]
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulerIgnoresStalePoll(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger(), Checks: NewCheckEngine(testLogger(), nil, nil, testLocks(t))}
+	s := NewCheckScheduler(a)
+
+	// a poll started before the push returns after it
+	s.ApplyUpdate(shared.CheckUpdate{Version: 5, Full: true, Checks: []shared.Check{{CheckPK: 1}, {CheckPK: 2}}})
+	s.SetChecks(shared.AllChecks{CheckInfo: shared.CheckInfo{Version: 4}, Checks: []shared.Check{{CheckPK: 1}}})
+	if len(s.checks) != 2 || s.version != 5 {
+		t.Errorf("%d checks at version %d, want the pushed 2 at version 5", len(s.checks), s.version)
+	}
+
+	s.SetChecks(shared.AllChecks{CheckInfo: shared.CheckInfo{Version: 6}, Checks: []shared.Check{{CheckPK: 3}}})
+	if len(s.checks) != 1 || s.version != 6 {
+		t.Errorf("%d checks at version %d, want the polled 1 at version 6", len(s.checks), s.version)
+	}
+}
+
+func TestSchedulerRefreshEndpoints(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"checks":[]}`))
+	}))
+	defer srv.Close()
+	a := &Agent{
+		AgentConfig: &AgentConfig{AgentID: "agent1", StateDir: t.TempDir()},
+		Logger:      testLogger(),
+		RClient:     resty.New().SetBaseURL(srv.URL),
+		Checks:      NewCheckEngine(testLogger(), nil, nil, testLocks(t)),
+	}
+	s := NewCheckScheduler(a)
+
+	s.refresh(false)
+	s.refresh(true)
+	want := []string{"/api/v3/agent1/checkrunner/", "/api/v3/agent1/runchecks/"}
+	if len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("requested %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,473 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	// RunScript exit codes for failures of the agent rather than the script
+	SCRIPT_EXIT_DEFAULT        = 1
+	SCRIPT_EXIT_START          = 65
+	SCRIPT_EXIT_RUNAS          = 77
+	SCRIPT_EXIT_CONFIG         = 78
+	SCRIPT_EXIT_LIMIT          = 97
+	SCRIPT_EXIT_CANCELLED      = 130
+	SCRIPT_EXIT_TEMPFILE       = 85
+	SCRIPT_EXIT_TIMEOUT        = 98
+	SCRIPT_EXIT_SIGNATURE      = 126
+	SCRIPT_EXIT_INTERPRETER    = 127
+	SCRIPT_DEFAULT_TIMEOUT     = 60 // seconds
+	SCRIPT_WAIT_DELAY          = 5 * time.Second
+	SCRIPT_TEMP_PREFIX         = "script-"
+	SCRIPT_SHEBANG             = "#!"
+	SCRIPT_INTERPRETER_SHEBANG = "shebang"
+	SCRIPT_WORKDIR_PREFIX      = "work-"
+
+	// why a script was killed: its timeout, or the limit it broke out of
+	// shared.ScriptLimits
+	SCRIPT_KILL_TIMEOUT   = "timeout"
+	SCRIPT_KILL_CANCELLED = "cancelled"
+	SCRIPT_LIMIT_CPU      = "cpu"
+	SCRIPT_LIMIT_MEMORY   = "memory"
+	SCRIPT_LIMIT_PROCS    = "procs"
+	SCRIPT_LIMIT_OUTPUT   = "output"
+)
+
+// Interpreter describes how to run a script file
+type Interpreter struct {
+	Name string
+	// candidate executables, the first one found in PATH is used. Empty
+	// runs the script file itself.
+	Exes []string
+	Ext  string
+	// placed before the script path
+	Args []string
+	// prints the interpreter's version, defaults to the executable found
+	// with --version
+	VersionCmd []string
+}
+
+var (
+	interpretersMu sync.RWMutex
+	interpreters   = make(map[string]*Interpreter)
+)
+
+// RegisterInterpreter adds or replaces an interpreter under its name and
+// any aliases
+func RegisterInterpreter(i *Interpreter, aliases ...string) {
+	interpretersMu.Lock()
+	defer interpretersMu.Unlock()
+	interpreters[i.Name] = i
+	for _, alias := range aliases {
+		interpreters[alias] = i
+	}
+}
+
+// Interpreters returns the names the registered interpreters are known by
+func Interpreters() []string {
+	interpretersMu.RLock()
+	defer interpretersMu.RUnlock()
+	ret := make([]string, 0, len(interpreters))
+	for name := range interpreters {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ErrInterpreterNotFound is returned for scripts whose interpreter is
+// unknown or not installed
+var ErrInterpreterNotFound = errors.New("interpreter not found")
+
+const (
+	// ScriptError codes
+	SCRIPT_ERR_INTERPRETER_NOT_FOUND = "interpreter_not_found"
+	SCRIPT_ERR_SECRET_UNAVAILABLE    = "secret_unavailable"
+	SCRIPT_ERR_INVALID_ENV           = "invalid_env"
+	SCRIPT_ERR_LIMITS                = "limits_unavailable"
+	SCRIPT_ERR_UNSIGNED              = "unsigned"
+	SCRIPT_ERR_SIGNATURE             = "signature_invalid"
+	SCRIPT_ERR_SCRIPT_UNAVAILABLE    = "script_unavailable"
+)
+
+// ScriptError is a script request the agent refused to run, it is sent back
+// to the server as is
+type ScriptError struct {
+	Code        string   `json:"code"`
+	Interpreter string   `json:"interpreter"`
+	Message     string   `json:"message"`
+	Available   []string `json:"available,omitempty"` // the interpreters found on this agent
+	err         error
+}
+
+func (e *ScriptError) Error() string { return e.Message }
+
+func (e *ScriptError) Unwrap() error { return e.err }
+
+// interpreterNotFound wraps err, a failure to find interpreter, with the
+// interpreters that are available
+func interpreterNotFound(interpreter string, err error) *ScriptError {
+	e := &ScriptError{
+		Code:        SCRIPT_ERR_INTERPRETER_NOT_FOUND,
+		Interpreter: interpreter,
+		Message:     err.Error(),
+		err:         err,
+	}
+	for _, i := range discoveredInterpreters() {
+		e.Available = append(e.Available, i.Name)
+	}
+	return e
+}
+
+// LookupInterpreter returns the interpreter registered as name
+func LookupInterpreter(name string) (*Interpreter, error) {
+	interpretersMu.RLock()
+	defer interpretersMu.RUnlock()
+	i, ok := interpreters[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInterpreterNotFound, name)
+	}
+	return i, nil
+}
+
+// Command returns the executable and arguments that run the script at path
+func (i *Interpreter) Command(path string) (string, []string, error) {
+	if len(i.Exes) == 0 {
+		return path, nil, nil
+	}
+	for _, exe := range i.Exes {
+		if p, err := exec.LookPath(exe); err == nil {
+			return p, append(append([]string{}, i.Args...), path), nil
+		}
+	}
+	return "", nil, fmt.Errorf("%w: %s is not installed", ErrInterpreterNotFound, i.Name)
+}
+
+// ErrRunAsUnsupported is returned for scripts that should run as a user
+// this platform can't run them as
+var ErrRunAsUnsupported = errors.New("running as this user is not supported on this platform")
+
+// ErrLimitsUnsupported is returned for scripts with limits this platform
+// can't enforce
+var ErrLimitsUnsupported = errors.New("script limits are not supported on this platform")
+
+// ScriptOptions are the optional settings of a script run
+type ScriptOptions struct {
+	RunAsUser bool   // run as the logged-on user
+	User      string // run as this user instead, implies RunAsUser
+	Env       map[string]string
+	// set in the script's environment only, and redacted from its output
+	Secrets []shared.SecretRef
+	Limits  shared.ScriptLimits
+	// base64 ed25519 signature of the run's shared.ScriptEnvelope, checked
+	// against the agent's ScriptPublisherKeys
+	Signature string
+	// hex SHA-256 of the code, which is looked up in the local script cache
+	// when empty
+	Hash string
+	// called with the output as it is produced, in order, instead of it
+	// all being kept. Only its tail is returned then.
+	Stream func(stream, data string)
+
+	job *runningJob // set by RunScriptJob
+}
+
+// ScriptOptionsFor returns the options a script from the server asks for
+func ScriptOptionsFor(s shared.Script) ScriptOptions {
+	return ScriptOptions{RunAsUser: s.RunAsUser, User: s.RunAs, Env: s.Env, Secrets: s.Secrets, Limits: s.Limits, Signature: s.Signature, Hash: s.Hash}
+}
+
+// RunScript writes code to a temp file and runs it with interpreter. On
+// timeout the script and every process it started are killed.
+// A script killed for breaking one of its limits exits with
+// SCRIPT_EXIT_LIMIT rather than SCRIPT_EXIT_TIMEOUT.
+func (a *Agent) RunScript(code string, interpreter string, args []string, timeout int) (stdout, stderr string, exitcode int, e error) {
+	return a.RunScriptOpts(code, interpreter, args, timeout, ScriptOptions{})
+}
+
+// RunScriptOpts is RunScript with options
+func (a *Agent) RunScriptOpts(code string, interpreter string, args []string, timeout int, opts ScriptOptions) (stdout, stderr string, exitcode int, e error) {
+	interp, err := LookupInterpreter(interpreter)
+	if err != nil {
+		e := interpreterNotFound(interpreter, err)
+		return "", e.Error(), SCRIPT_EXIT_INTERPRETER, e
+	}
+	if timeout <= 0 {
+		timeout = SCRIPT_DEFAULT_TIMEOUT
+	}
+	if opts.Hash != "" {
+		if code, err = a.scriptCode(code, opts.Hash); err != nil {
+			e := &ScriptError{Code: SCRIPT_ERR_SCRIPT_UNAVAILABLE, Interpreter: interpreter, Message: err.Error(), err: err}
+			return "", e.Error(), SCRIPT_EXIT_CONFIG, e
+		}
+	}
+	envelope := shared.NewScriptEnvelope(shared.Script{Code: code, Interpreter: interpreter, Env: opts.Env, Secrets: opts.Secrets}, args)
+	if err := a.VerifyScript(envelope, opts.Signature); err != nil {
+		e := a.scriptRejected(code, interpreter, err)
+		return "", e.Error(), SCRIPT_EXIT_SIGNATURE, e
+	}
+
+	secrets, err := a.ResolveSecrets(opts.Secrets)
+	if err != nil {
+		e := &ScriptError{Code: SCRIPT_ERR_SECRET_UNAVAILABLE, Interpreter: interpreter, Message: err.Error(), err: err}
+		return "", e.Error(), SCRIPT_EXIT_CONFIG, e
+	}
+	redact, values := secretRedactor(secrets), secretValues(secrets)
+
+	dir := filepath.Join(os.TempDir(), AGENT_TEMP_DIR)
+	if !FileExists(dir) {
+		a.CreateAgentTempDir()
+	}
+
+	path, err := writeScript(dir, interp, code)
+	if err != nil {
+		a.Logger.Errorln(err)
+		return "", err.Error(), SCRIPT_EXIT_TEMPFILE, err
+	}
+	defer os.Remove(path)
+
+	exe, cmdArgs, err := interp.Command(path)
+	if err != nil {
+		e := interpreterNotFound(interpreter, err)
+		return "", e.Error(), SCRIPT_EXIT_INTERPRETER, e
+	}
+	cmdArgs = append(cmdArgs, args...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var outb, errb bytes.Buffer
+	cmd := exec.Command(exe, cmdArgs...)
+	// don't hang on children that inherited the output pipes
+	cmd.WaitDelay = SCRIPT_WAIT_DELAY
+	setProcessGroup(cmd)
+
+	owned := []string{path}
+	if opts.Limits.PrivateDir {
+		workDir, err := os.MkdirTemp(dir, SCRIPT_WORKDIR_PREFIX)
+		if err != nil {
+			a.Logger.Errorln(err)
+			return "", err.Error(), SCRIPT_EXIT_TEMPFILE, err
+		}
+		defer os.RemoveAll(workDir)
+		cmd.Dir = workDir
+		owned = append(owned, workDir)
+	}
+
+	if opts.RunAsUser || opts.User != "" {
+		release, err := runAs(cmd, opts.User, owned...)
+		if err != nil {
+			a.Logger.Debugln("Script run as user:", err)
+			return "", err.Error(), SCRIPT_EXIT_RUNAS, err
+		}
+		defer release()
+	}
+	if cmd.Dir == "" {
+		cmd.Dir = dir
+	}
+
+	if len(opts.Env) > 0 || len(secrets) > 0 {
+		base := cmd.Env
+		if base == nil {
+			base = os.Environ()
+		}
+		env, err := scriptEnv(base, opts.Env, secrets)
+		if err != nil {
+			e := &ScriptError{Code: SCRIPT_ERR_INVALID_ENV, Interpreter: interpreter, Message: err.Error(), err: err}
+			return "", e.Error(), SCRIPT_EXIT_CONFIG, e
+		}
+		cmd.Env = env
+	}
+
+	box, err := newSandbox(cmd, opts.Limits)
+	if err != nil {
+		e := &ScriptError{Code: SCRIPT_ERR_LIMITS, Interpreter: interpreter, Message: err.Error(), err: err}
+		return "", e.Error(), SCRIPT_EXIT_CONFIG, e
+	}
+
+	// the first reason the script was killed for wins
+	var killedFor atomic.Pointer[string]
+	kill := func(reason string) {
+		if killedFor.CompareAndSwap(nil, &reason) {
+			if err := killProcessGroup(cmd); err != nil {
+				a.Logger.Debugln("Script kill:", err)
+			}
+		}
+	}
+	output := &outputLimiter{max: opts.Limits.MaxOutputKB << 10, exceeded: func() { kill(SCRIPT_LIMIT_OUTPUT) }}
+	var streamer *scriptStreamer
+	if opts.Stream != nil {
+		streamer = newScriptStreamer(opts.Stream, secrets)
+		cmd.Stdout = output.writer(streamer.writer(SCRIPT_STREAM_STDOUT))
+		cmd.Stderr = output.writer(streamer.writer(SCRIPT_STREAM_STDERR))
+	} else {
+		cmd.Stdout = output.writer(&outb)
+		cmd.Stderr = output.writer(&errb)
+	}
+	if opts.job != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, opts.job.output(SCRIPT_STREAM_STDOUT))
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, opts.job.output(SCRIPT_STREAM_STDERR))
+	}
+
+	if err := cmd.Start(); err != nil {
+		if streamer != nil {
+			streamer.Close(false)
+		}
+		box.Release()
+		a.Logger.Debugln(err)
+		return "", err.Error(), SCRIPT_EXIT_START, err
+	}
+	defer box.Release()
+	if err := box.Started(cmd, kill); err != nil {
+		kill(err.Error())
+		cmd.Wait()
+		e := &ScriptError{Code: SCRIPT_ERR_LIMITS, Interpreter: interpreter, Message: err.Error(), err: err}
+		return "", e.Error(), SCRIPT_EXIT_CONFIG, e
+	}
+	if opts.job != nil {
+		// kills the process tree, through KillProc on Windows and the
+		// process group elsewhere
+		opts.job.started(cmd.Process.Pid, secrets, func() { kill(SCRIPT_KILL_CANCELLED) })
+	}
+
+	// exec.CommandContext only kills the direct child, batch files and
+	// shells would leave their children running
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			kill(SCRIPT_KILL_TIMEOUT)
+		case <-done:
+		}
+	}()
+
+	waitErr := cmd.Wait()
+	if streamer != nil {
+		streamer.Close(output.CutOff())
+		stdout = streamer.Tail(SCRIPT_STREAM_STDOUT)
+		stderr = streamer.Tail(SCRIPT_STREAM_STDERR)
+	} else if output.CutOff() {
+		stdout = redactCut(redact, values, outb.String())
+		stderr = redactCut(redact, values, errb.String())
+	} else {
+		stdout = redact.Replace(outb.String())
+		stderr = redact.Replace(errb.String())
+	}
+
+	limit := ""
+	if reason := killedFor.Load(); reason != nil {
+		limit = *reason
+	}
+	if limit == SCRIPT_KILL_TIMEOUT {
+		a.Logger.Debugln("Script timeout:", ctx.Err())
+		return stdout, fmt.Sprintf("%s\nScript timed out after %d seconds", stderr, timeout), SCRIPT_EXIT_TIMEOUT, nil
+	}
+	if limit == SCRIPT_KILL_CANCELLED {
+		a.Logger.Debugln("Script cancelled")
+		return stdout, stderr + "\nScript was cancelled", SCRIPT_EXIT_CANCELLED, nil
+	}
+	if limit == "" {
+		limit = box.Violation(cmd.ProcessState)
+	}
+	if limit != "" {
+		a.Logger.Debugln("Script exceeded its limit:", limit)
+		return stdout, fmt.Sprintf("%s\nScript exceeded its %s limit", stderr, limit), SCRIPT_EXIT_LIMIT, nil
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case waitErr == nil:
+		exitcode = cmd.ProcessState.ExitCode()
+	case errors.As(waitErr, &exitErr) && exitErr.ExitCode() >= 0:
+		exitcode = exitErr.ExitCode()
+	default:
+		exitcode = SCRIPT_EXIT_DEFAULT
+	}
+	return stdout, stderr, exitcode, nil
+}
+
+// outputLimiter caps the combined size of a script's stdout and stderr,
+// calling exceeded once the script writes past max. Zero max is unlimited.
+type outputLimiter struct {
+	mu       sync.Mutex
+	max      int
+	total    int
+	exceeded func()
+	once     sync.Once
+	cutOff   bool
+}
+
+type limitedWriter struct {
+	l *outputLimiter
+	w io.Writer
+}
+
+func (l *outputLimiter) writer(w io.Writer) io.Writer {
+	return &limitedWriter{l: l, w: w}
+}
+
+// Write keeps what fits and drops the rest, it never fails so the copying
+// from the script's pipes carries on until the script is killed
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.l.mu.Lock()
+	keep := p
+	if w.l.max > 0 && w.l.total+len(p) > w.l.max {
+		keep = p[:max(w.l.max-w.l.total, 0)]
+		w.l.cutOff = true
+		w.l.once.Do(func() { go w.l.exceeded() })
+	}
+	w.l.total += len(keep)
+	w.w.Write(keep)
+	w.l.mu.Unlock()
+	return len(p), nil
+}
+
+// CutOff returns whether any output was dropped
+func (l *outputLimiter) CutOff() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cutOff
+}
+
+// writeScript writes code to a new temp file in dir with the interpreter's
+// extension and returns its path
+func writeScript(dir string, interp *Interpreter, code string) (string, error) {
+	f, err := os.CreateTemp(dir, SCRIPT_TEMP_PREFIX+"*"+interp.Ext)
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+
+	code, err = prepareScript(interp, code)
+	if err == nil {
+		_, err = f.WriteString(code)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	if err := setScriptMode(path, interp); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
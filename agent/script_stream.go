@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	SCRIPT_STREAM_CHUNK_SIZE     = 16 << 10
+	SCRIPT_STREAM_FLUSH_INTERVAL = 250 * time.Millisecond
+	SCRIPT_STREAM_TAIL           = 4 << 10 // of each stream, kept for RunScriptOpts to return
+
+	SCRIPT_STREAM_STDOUT = "stdout"
+	SCRIPT_STREAM_STDERR = "stderr"
+)
+
+// ScriptStreamMsg is published for each chunk of a streamed script's
+// output, and once more with Final set when the script has exited
+type ScriptStreamMsg struct {
+	JobID    string       `json:"job_id"`
+	Seq      uint64       `json:"seq"`
+	Stream   string       `json:"stream,omitempty"` // stdout, stderr
+	Data     string       `json:"data,omitempty"`
+	Final    bool         `json:"final"`
+	Retcode  int          `json:"retcode"`
+	ExecTime float64      `json:"execution_time"`
+	Error    *ScriptError `json:"error,omitempty"`
+}
+
+// ScriptStreamAck answers a streamed script request right away when the
+// output goes to a stream subject of its own
+type ScriptStreamAck struct {
+	JobID   string `json:"job_id"`
+	Subject string `json:"stream_subject"`
+}
+
+// StreamScript runs a script as job id, or a generated one when id is
+// empty, publishing its output to subject as it is produced and then its
+// exit code and runtime. When subject isn't the reply subject the request
+// is acked with the job id at once.
+func (a *Agent) StreamScript(nc *nats.Conn, reply *RpcReply, subject string, id string, code string, interpreter string, args []string, timeout int, opts ScriptOptions) {
+	if id == "" {
+		id = NewJobID()
+	}
+	acked := false
+	if subject != reply.Reply && reply.Reply != "" {
+		var b []byte
+		if err := codec.NewEncoderBytes(&b, new(codec.MsgpackHandle)).Encode(ScriptStreamAck{JobID: id, Subject: subject}); err != nil {
+			a.Logger.Debugln("Script stream:", err)
+		} else if err := reply.Respond(b); err != nil {
+			a.Logger.Debugln("Script stream:", err)
+		} else {
+			acked = true
+		}
+	}
+	var seq uint64
+	publish := func(m ScriptStreamMsg) error {
+		seq++
+		m.JobID = id
+		m.Seq = seq
+		var b []byte
+		if err := codec.NewEncoderBytes(&b, new(codec.MsgpackHandle)).Encode(m); err != nil {
+			return err
+		}
+		if m.Final && subject == reply.Reply {
+			return reply.Respond(b)
+		}
+		return nc.Publish(subject, b)
+	}
+
+	opts.Stream = func(stream, data string) {
+		if err := publish(ScriptStreamMsg{Stream: stream, Data: data}); err != nil {
+			a.Logger.Debugln("Script stream:", err)
+		}
+	}
+	start := time.Now()
+	_, _, retcode, err := a.RunScriptJob(id, JOB_KIND_SCRIPT, interpreter, code, interpreter, args, timeout, opts)
+
+	final := ScriptStreamMsg{Final: true, Retcode: retcode, ExecTime: time.Since(start).Seconds()}
+	errors.As(err, &final.Error)
+	if err := publish(final); err != nil {
+		a.Logger.Debugln("Script stream:", err)
+	}
+	if subject != reply.Reply && !acked {
+		Stats.ObserveRPC(reply.fn, time.Since(reply.start))
+	}
+}
+
+// scriptStreamer batches a script's output into chunks for its Stream
+// callback, holding on to no more than a chunk of each stream. Secrets are
+// redacted, and never split across two chunks where they'd escape it.
+type scriptStreamer struct {
+	mu      sync.Mutex
+	emit    func(stream, data string)
+	secrets []string
+	redact  *strings.Replacer
+	pending map[string]*strings.Builder
+	tails   map[string]string
+	order   []string
+	done    chan struct{}
+}
+
+func newScriptStreamer(emit func(stream, data string), secrets map[string]string) *scriptStreamer {
+	s := &scriptStreamer{
+		emit:    emit,
+		redact:  secretRedactor(secrets),
+		pending: make(map[string]*strings.Builder),
+		tails:   make(map[string]string),
+		done:    make(chan struct{}),
+	}
+	s.secrets = secretValues(secrets)
+	go s.run()
+	return s
+}
+
+// writer returns the writer for the named stream
+func (s *scriptStreamer) writer(stream string) *streamWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[stream] = &strings.Builder{}
+	s.order = append(s.order, stream)
+	return &streamWriter{s: s, stream: stream}
+}
+
+type streamWriter struct {
+	s      *scriptStreamer
+	stream string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	buf := w.s.pending[w.stream]
+	buf.Write(p)
+	if buf.Len() >= SCRIPT_STREAM_CHUNK_SIZE {
+		w.s.flush(w.stream, false, false)
+	}
+	return len(p), nil
+}
+
+func (s *scriptStreamer) run() {
+	ticker := time.NewTicker(SCRIPT_STREAM_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for _, stream := range s.order {
+				s.flush(stream, false, false)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flush emits what is pending on stream, or all but a secret that may
+// not be complete yet unless final. Final output that was cut off may end
+// in the start of a secret, which is redacted. Called with s.mu held.
+func (s *scriptStreamer) flush(stream string, final, cutOff bool) {
+	buf := s.pending[stream]
+	p := buf.String()
+	cut := len(p)
+	if !final {
+		cut = safeCut(p, s.secrets)
+	}
+	if cut == 0 {
+		return
+	}
+
+	data := s.redact.Replace(p[:cut])
+	if cutOff {
+		data = redactCut(s.redact, s.secrets, p[:cut])
+	}
+	buf.Reset()
+	buf.WriteString(p[cut:])
+
+	tail := s.tails[stream] + data
+	s.tails[stream] = tail[max(len(tail)-SCRIPT_STREAM_TAIL, 0):]
+	s.emit(stream, data)
+}
+
+// Close emits everything still pending, cutOff when the output limit cut
+// the script's output short
+func (s *scriptStreamer) Close(cutOff bool) {
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stream := range s.order {
+		s.flush(stream, true, cutOff)
+	}
+}
+
+// Tail returns the end of what was emitted for stream
+func (s *scriptStreamer) Tail(stream string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tails[stream]
+}
+
+// safeCut returns how much of p can be redacted and sent on its own: up to
+// the start of a secret that p may end in the middle of, and not through
+// the middle of a secret
+func safeCut(p string, secrets []string) int {
+	cut := len(p)
+	for _, s := range secrets {
+		for l := min(len(s)-1, len(p)); l > 0; l-- {
+			if strings.HasSuffix(p, s[:l]) {
+				cut = min(cut, len(p)-l)
+				break
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range secrets {
+			for i := max(cut-len(s)+1, 0); i < cut; i++ {
+				if strings.HasPrefix(p[i:], s) {
+					cut = i
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return cut
+}
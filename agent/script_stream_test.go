@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunkRecorder collects what a scriptStreamer emits
+type chunkRecorder struct {
+	mu     sync.Mutex
+	chunks []string
+}
+
+func (r *chunkRecorder) emit(stream, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chunks = append(r.chunks, data)
+}
+
+func (r *chunkRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.chunks...)
+}
+
+func TestScriptStreamerNeverSplitsSecrets(t *testing.T) {
+	// the output around the secret has no digits, so any digit in a chunk
+	// is part of it
+	const secret = "90817263"
+	hasSecret := func(chunks []string) bool {
+		for _, c := range chunks {
+			if strings.ContainsAny(c, "0123456789") {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tt := range []struct {
+		name   string
+		writes []string
+		tick   bool // wait for a flush between the writes
+	}{
+		{"across two writes", []string{"token: 9081", "7263 done\n"}, false},
+		{"across a flush tick", []string{"token: 9081", "7263 done\n"}, true},
+		{"a byte at a time across a tick", []string{"token: 9", "0", "8", "1", "7", "2", "6", "3", " done\n"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &chunkRecorder{}
+			s := newScriptStreamer(rec.emit, map[string]string{"TOKEN": secret})
+			w := s.writer(SCRIPT_STREAM_STDOUT)
+
+			for i, p := range tt.writes {
+				w.Write([]byte(p))
+				if tt.tick && i == 0 {
+					// what comes before the secret goes out with the tick
+					waitFor(t, func() bool { return strings.Join(rec.get(), "") == "token: " })
+					time.Sleep(2 * SCRIPT_STREAM_FLUSH_INTERVAL)
+					if chunks := rec.get(); hasSecret(chunks) {
+						t.Fatalf("chunks %q hold part of the secret", chunks)
+					}
+				}
+			}
+			s.Close(false)
+
+			chunks := rec.get()
+			if hasSecret(chunks) {
+				t.Errorf("chunks %q hold part of the secret", chunks)
+			}
+			want := strings.ReplaceAll(strings.Join(tt.writes, ""), secret, SECRET_REDACTED)
+			if got := strings.Join(chunks, ""); got != want {
+				t.Errorf("streamed %q, want %q", got, want)
+			}
+			if got := s.Tail(SCRIPT_STREAM_STDOUT); got != strings.Join(chunks, "") {
+				t.Errorf("Tail() = %q, want %q", got, strings.Join(chunks, ""))
+			}
+		})
+	}
+}
+
+func TestScriptStreamerReleasesHeldPrefix(t *testing.T) {
+	rec := &chunkRecorder{}
+	s := newScriptStreamer(rec.emit, map[string]string{"TOKEN": "90817263"})
+	w := s.writer(SCRIPT_STREAM_STDOUT)
+
+	// the start of the secret is held back until the output moves past it
+	w.Write([]byte("build 908"))
+	waitFor(t, func() bool { return strings.Join(rec.get(), "") == "build " })
+	w.Write([]byte("x done\n"))
+	waitFor(t, func() bool { return strings.Join(rec.get(), "") == "build 908x done\n" })
+	s.Close(false)
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	RegisterInterpreter(&Interpreter{Name: "sh", Exes: []string{"sh"}, Ext: ".sh"})
+	RegisterInterpreter(&Interpreter{Name: "bash", Exes: []string{"bash"}, Ext: ".sh"})
+	RegisterInterpreter(&Interpreter{Name: "zsh", Exes: []string{"zsh"}, Ext: ".zsh"})
+	RegisterInterpreter(&Interpreter{Name: "python3", Exes: []string{"python3"}, Ext: ".py"}, "python")
+	RegisterInterpreter(&Interpreter{Name: "perl", Exes: []string{"perl"}, Ext: ".pl"})
+	RegisterInterpreter(&Interpreter{Name: "node", Exes: []string{"node", "nodejs"}, Ext: ".js"})
+	RegisterInterpreter(&Interpreter{
+		Name: "pwsh",
+		Exes: []string{"pwsh"},
+		Ext:  ".ps1",
+		Args: []string{"-NonInteractive", "-NoProfile", "-File"},
+	}, "powershell")
+	// runs the script itself, picking the interpreter from its #! line
+	RegisterInterpreter(&Interpreter{Name: SCRIPT_INTERPRETER_SHEBANG})
+}
+
+// prepareScript converts Windows line endings, which break the #! line and
+// shell scripts, and makes sure scripts run by their #! line have one
+func prepareScript(interp *Interpreter, code string) (string, error) {
+	code = strings.ReplaceAll(code, "\r\n", "\n")
+	if len(interp.Exes) == 0 && !strings.HasPrefix(code, SCRIPT_SHEBANG) {
+		return "", fmt.Errorf("%s script has no %s line", interp.Name, SCRIPT_SHEBANG)
+	}
+	return code, nil
+}
+
+// setScriptMode lets the owner execute the script, so it can be run by its
+// #! line, and keeps everyone else out
+func setScriptMode(path string, interp *Interpreter) error {
+	return os.Chmod(path, 0700)
+}
+
+// setProcessGroup starts the script in its own process group, so it can be
+// killed along with everything it started
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/jetrmm/go-wintoken"
+	"golang.org/x/sys/windows"
+)
+
+func init() {
+	RegisterInterpreter(&Interpreter{
+		Name: "powershell",
+		Exes: []string{"powershell.exe"},
+		Ext:  ".ps1",
+		// todo: 2021-12-31: allow ExecutionPolicy to be chosen by the sysadmin
+		Args:       []string{"-NonInteractive", "-NoProfile", "-ExecutionPolicy", "Bypass"},
+		VersionCmd: []string{"powershell.exe", "-NoProfile", "-Command", "$PSVersionTable.PSVersion.ToString()"},
+	})
+	RegisterInterpreter(&Interpreter{
+		Name: "pwsh",
+		Exes: []string{"pwsh.exe"},
+		Ext:  ".ps1",
+		Args: []string{"-NonInteractive", "-NoProfile", "-ExecutionPolicy", "Bypass", "-File"},
+	})
+	RegisterInterpreter(&Interpreter{Name: "cmd", Ext: ".bat", VersionCmd: []string{"cmd.exe", "/c", "ver"}}) // todo: .cmd?
+	RegisterInterpreter(&Interpreter{Name: "python3", Exes: []string{"python.exe", "py.exe"}, Ext: ".py"}, "python")
+	RegisterInterpreter(&Interpreter{Name: "node", Exes: []string{"node.exe"}, Ext: ".js"})
+}
+
+func prepareScript(interp *Interpreter, code string) (string, error) {
+	return code, nil
+}
+
+func setScriptMode(path string, interp *Interpreter) error {
+	return nil
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the script and its children
+func killProcessGroup(cmd *exec.Cmd) error {
+	return KillProc(int32(cmd.Process.Pid))
+}
+
+// runAs makes cmd run with the token of the interactive user, in the user's
+// profile unless it has a directory of its own. The script's files are in
+// SYSTEM's %TEMP%, the user is granted access to owned. Named users would
+// need their credentials.
+func runAs(cmd *exec.Cmd, name string, owned ...string) (func(), error) {
+	if name != "" {
+		return nil, ErrRunAsUnsupported
+	}
+	// https://learn.microsoft.com/en-us/windows/win32/api/processthreadsapi/nf-processthreadsapi-createprocessasusera
+	token, err := wintoken.GetInteractiveToken(wintoken.TokenImpersonation)
+	if err != nil {
+		return nil, err
+	}
+	user, err := token.Token().GetTokenUser()
+	if err != nil {
+		token.Close()
+		return nil, err
+	}
+	for _, path := range owned {
+		if err := grantUser(path, user.User.Sid); err != nil {
+			token.Close()
+			return nil, fmt.Errorf("grant %s: %w", path, err)
+		}
+	}
+	if cmd.Dir == "" {
+		if profile, err := token.Token().GetUserProfileDirectory(); err == nil {
+			cmd.Dir = profile
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Token: syscall.Token(token.Token()), HideWindow: true}
+	return token.Close, nil
+}
+
+// grantUser adds an entry for sid to the ACL of path, read and execute for
+// a file and full control, inherited, for a directory
+func grantUser(path string, sid *windows.SID) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	access := windows.EXPLICIT_ACCESS{
+		AccessPermissions: windows.FILE_GENERIC_READ | windows.FILE_GENERIC_EXECUTE,
+		AccessMode:        windows.GRANT_ACCESS,
+		Inheritance:       windows.NO_INHERITANCE,
+		Trustee: windows.TRUSTEE{
+			TrusteeForm:  windows.TRUSTEE_IS_SID,
+			TrusteeType:  windows.TRUSTEE_IS_USER,
+			TrusteeValue: windows.TrusteeValueFromSID(sid),
+		},
+	}
+	if fi.IsDir() {
+		access.AccessPermissions = windows.GENERIC_ALL
+		access.Inheritance = windows.SUB_CONTAINERS_AND_OBJECTS_INHERIT
+	}
+
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	acl, err := windows.ACLFromEntries([]windows.EXPLICIT_ACCESS{access}, dacl)
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.DACL_SECURITY_INFORMATION, nil, nil, acl, nil)
+}
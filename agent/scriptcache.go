@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	API_URL_SCRIPT = "/api/v3/scripts/%s/"
+
+	SCRIPT_CACHE_DIR         = "scripts"
+	SCRIPT_CACHE_DEFAULT_MAX = 64 << 20 // bytes
+	// a temp file this old was left behind by a crashed writer
+	SCRIPT_CACHE_TEMP_MAX_AGE = time.Hour
+)
+
+var (
+	ErrScriptHashMismatch = errors.New("script does not match its hash")
+	ErrInvalidScriptHash  = errors.New("invalid script hash")
+
+	scriptCacheMu sync.Mutex
+)
+
+// scriptCacheDir returns the cache dir in the agent's state dir, where
+// nobody else can plant or swap the scripts it runs
+func (a *Agent) scriptCacheDir() (string, error) {
+	return a.stateDir(SCRIPT_CACHE_DIR)
+}
+
+// ScriptHash returns the hash scripts are referenced by, the hex SHA-256 of
+// their code
+func ScriptHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptCode returns the code of the script with hash. Code delivered with
+// it is checked against the hash and cached. Otherwise it comes from the
+// cache, and from the server on a miss, so cached scripts run offline.
+func (a *Agent) scriptCode(code, hash string) (string, error) {
+	hash = strings.ToLower(hash)
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%w: %q", ErrInvalidScriptHash, hash)
+	}
+
+	if code != "" {
+		if ScriptHash(code) != hash {
+			return "", fmt.Errorf("%w: %s", ErrScriptHashMismatch, hash)
+		}
+		if err := a.cacheScript(hash, code); err != nil {
+			a.Logger.Debugln("Script cache:", err)
+		}
+		return code, nil
+	}
+
+	if code, ok := a.cachedScript(hash); ok {
+		return code, nil
+	}
+	code, err := a.fetchScript(hash)
+	if err != nil {
+		return "", err
+	}
+	if err := a.cacheScript(hash, code); err != nil {
+		a.Logger.Debugln("Script cache:", err)
+	}
+	return code, nil
+}
+
+// cachedScript returns the cached script with hash if it is intact, a
+// corrupted one is dropped
+func (a *Agent) cachedScript(hash string) (string, bool) {
+	scriptCacheMu.Lock()
+	defer scriptCacheMu.Unlock()
+	dir, err := a.scriptCacheDir()
+	if err != nil {
+		a.Logger.Debugln("Script cache:", err)
+		return "", false
+	}
+	path := filepath.Join(dir, hash)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	if ScriptHash(string(b)) != hash {
+		a.Logger.Debugln("Script cache: dropping corrupted", hash)
+		os.Remove(path)
+		return "", false
+	}
+	// the modification time is when it was last used, for the eviction
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return string(b), true
+}
+
+// fetchScript downloads the script with hash from the server
+func (a *Agent) fetchScript(hash string) (string, error) {
+	if a.RClient == nil {
+		return "", fmt.Errorf("script %s is not cached", hash)
+	}
+	r, err := a.RClient.R().SetResult(&shared.Script{}).Get(fmt.Sprintf(API_URL_SCRIPT, hash))
+	if err != nil {
+		return "", err
+	}
+	if r.IsError() {
+		return "", fmt.Errorf("script %s: %s", hash, r.Status())
+	}
+	code := r.Result().(*shared.Script).Code
+	if ScriptHash(code) != hash {
+		return "", fmt.Errorf("%w: %s", ErrScriptHashMismatch, hash)
+	}
+	return code, nil
+}
+
+// cacheScript stores a script under its hash, then evicts the least
+// recently used scripts over the cache size
+func (a *Agent) cacheScript(hash, code string) error {
+	scriptCacheMu.Lock()
+	defer scriptCacheMu.Unlock()
+	dir, err := a.scriptCacheDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, hash)
+	if FileExists(path) {
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+
+	tmp, err := os.CreateTemp(dir, SCRIPT_TEMP_PREFIX)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(code); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	max := int64(a.ScriptCacheMB) << 20
+	if max <= 0 {
+		max = SCRIPT_CACHE_DEFAULT_MAX
+	}
+	return evictScripts(dir, max)
+}
+
+// evictScripts removes the least recently used scripts in dir until they
+// take up no more than max bytes. Temp files are left to their writer, which
+// may be another agent process, unless they are old enough to be abandoned.
+// Called with scriptCacheMu held.
+func evictScripts(dir string, max int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), SCRIPT_TEMP_PREFIX) {
+			if time.Since(fi.ModTime()) > SCRIPT_CACHE_TEMP_MAX_AGE {
+				os.Remove(filepath.Join(dir, fi.Name()))
+			}
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if total <= max {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err == nil {
+			total -= fi.Size()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestScriptCacheHitAndMiss(t *testing.T) {
+	code := "echo cached"
+	hash := ScriptHash(code)
+	var fetched atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		if !strings.Contains(r.URL.Path, hash) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared.Script{Code: code})
+	}))
+	defer srv.Close()
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger(), RClient: resty.New().SetBaseURL(srv.URL)}
+
+	// a miss is fetched from the server and cached
+	got, err := a.scriptCode("", strings.ToUpper(hash))
+	if err != nil || got != code {
+		t.Fatalf("scriptCode() = %q, %v", got, err)
+	}
+	dir, _ := a.scriptCacheDir()
+	if !FileExists(filepath.Join(dir, hash)) {
+		t.Fatal("fetched script not cached")
+	}
+
+	// a hit runs offline
+	srv.Close()
+	got, err = a.scriptCode("", hash)
+	if err != nil || got != code {
+		t.Errorf("scriptCode() = %q, %v from the cache", got, err)
+	}
+	if n := fetched.Load(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+
+	if _, err := a.scriptCode("", ScriptHash("echo other")); err == nil {
+		t.Error("scriptCode() = nil error for an uncached script with the server down")
+	}
+	if _, err := a.scriptCode("", "not-a-hash"); !errors.Is(err, ErrInvalidScriptHash) {
+		t.Errorf("scriptCode() = %v, want ErrInvalidScriptHash", err)
+	}
+}
+
+func TestScriptCacheHashMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared.Script{Code: "echo swapped"})
+	}))
+	defer srv.Close()
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger(), RClient: resty.New().SetBaseURL(srv.URL)}
+	hash := ScriptHash("echo original")
+
+	if _, err := a.scriptCode("echo swapped", hash); !errors.Is(err, ErrScriptHashMismatch) {
+		t.Errorf("scriptCode() with other code = %v, want ErrScriptHashMismatch", err)
+	}
+	if _, err := a.scriptCode("", hash); !errors.Is(err, ErrScriptHashMismatch) {
+		t.Errorf("scriptCode() with a swapped download = %v, want ErrScriptHashMismatch", err)
+	}
+
+	// a corrupted cache entry is dropped rather than run
+	dir, _ := a.scriptCacheDir()
+	path := filepath.Join(dir, hash)
+	if err := os.WriteFile(path, []byte("echo swapped"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.cachedScript(hash); ok {
+		t.Error("cachedScript() returned a corrupted script")
+	}
+	if FileExists(path) {
+		t.Error("corrupted script left in the cache")
+	}
+}
+
+func TestEvictScripts(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	write("oldest", 100, 3*time.Hour)
+	write("older", 100, 2*time.Hour)
+	write("newest", 100, time.Minute)
+	write(SCRIPT_TEMP_PREFIX+"writing", 1000, time.Second)
+	write(SCRIPT_TEMP_PREFIX+"abandoned", 10, 2*SCRIPT_CACHE_TEMP_MAX_AGE)
+
+	if err := evictScripts(dir, 150); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"oldest":                         false,
+		"older":                          false,
+		"newest":                         true,
+		SCRIPT_TEMP_PREFIX + "writing":   true,
+		SCRIPT_TEMP_PREFIX + "abandoned": false,
+	} {
+		if got := FileExists(filepath.Join(dir, name)); got != want {
+			t.Errorf("%s kept = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestScriptCacheSize(t *testing.T) {
+	var c AgentConfig
+	AgentSettings{ScriptCacheMB: 8}.Apply(&c)
+	if c.ScriptCacheMB != 8 {
+		t.Errorf("ScriptCacheMB = %d, want 8", c.ScriptCacheMB)
+	}
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const (
+	SECRET_STORE_FILE = "secrets.store"
+	SECRET_REDACTED   = "[REDACTED]"
+)
+
+var (
+	ErrSecretNotFound = errors.New("secret not found")
+	ErrSecretExpired  = errors.New("secret has expired")
+
+	secretStoreMu sync.Mutex
+)
+
+// secretStore is the on-disk form of the local secrets, sealed with a key
+// only this agent knows
+type secretStore struct {
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// secretStorePath returns where the secret store is kept, in the agent's
+// state dir, which has been checked to be private to the agent
+func (a *Agent) secretStorePath() (string, error) {
+	dir, err := a.stateDir("")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, SECRET_STORE_FILE), nil
+}
+
+func (a *Agent) secretCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("rmm-secret-store:" + a.AgentID + ":" + a.Token))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadSecrets opens the local secret store, a missing store is empty
+func (a *Agent) loadSecrets() (map[string]string, error) {
+	secrets := make(map[string]string)
+	path, err := a.secretStorePath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var store secretStore
+	if err := json.Unmarshal(b, &store); err != nil {
+		return nil, err
+	}
+	aead, err := a.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, store.Nonce, store.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("secret store: %w", err)
+	}
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func (a *Agent) saveSecrets(secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	aead, err := a.secretCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	b, err := json.Marshal(secretStore{Nonce: nonce, Data: aead.Seal(nil, nonce, plain, nil)})
+	if err != nil {
+		return err
+	}
+
+	path, err := a.secretStorePath()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// SetSecret stores a secret in the local secret store under key
+func (a *Agent) SetSecret(key, value string) error {
+	if key == "" {
+		return errors.New("secret key is empty")
+	}
+	secretStoreMu.Lock()
+	defer secretStoreMu.Unlock()
+	secrets, err := a.loadSecrets()
+	if err != nil {
+		return err
+	}
+	secrets[key] = value
+	return a.saveSecrets(secrets)
+}
+
+// DeleteSecret removes key from the local secret store
+func (a *Agent) DeleteSecret(key string) error {
+	secretStoreMu.Lock()
+	defer secretStoreMu.Unlock()
+	secrets, err := a.loadSecrets()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[key]; !ok {
+		return nil
+	}
+	delete(secrets, key)
+	return a.saveSecrets(secrets)
+}
+
+// ResolveSecrets returns the value of each secret reference by its env var
+// name. A reference carries its value when the server delivered it, and
+// is looked up in the local store otherwise.
+func (a *Agent) ResolveSecrets(refs []shared.SecretRef) (map[string]string, error) {
+	ret := make(map[string]string, len(refs))
+	var local map[string]string
+	for _, ref := range refs {
+		if ref.Value != "" {
+			if ref.Expires > 0 && time.Now().Unix() > ref.Expires {
+				return nil, fmt.Errorf("%w: %s", ErrSecretExpired, ref.Name)
+			}
+			ret[ref.Name] = ref.Value
+			continue
+		}
+
+		if local == nil {
+			secretStoreMu.Lock()
+			secrets, err := a.loadSecrets()
+			secretStoreMu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			local = secrets
+		}
+		key := ref.Key
+		if key == "" {
+			key = ref.Name
+		}
+		v, ok := local[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, key)
+		}
+		ret[ref.Name] = v
+	}
+	return ret, nil
+}
+
+// scriptEnv returns base with env and secrets set, later ones winning
+func scriptEnv(base []string, env, secrets map[string]string) ([]string, error) {
+	ret := append([]string{}, base...)
+	for _, vars := range []map[string]string{env, secrets} {
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			if name == "" || strings.ContainsAny(name, "=\x00") {
+				return nil, fmt.Errorf("invalid environment variable name %q", name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ret = append(ret, name+"="+vars[name])
+		}
+	}
+	return ret, nil
+}
+
+// secretValues returns the values of secrets to redact, longest first
+func secretValues(secrets map[string]string) []string {
+	values := make([]string, 0, len(secrets))
+	for _, v := range secrets {
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	// so a secret containing another is redacted whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
+
+// secretRedactor replaces the values of secrets with SECRET_REDACTED
+func secretRedactor(secrets map[string]string) *strings.Replacer {
+	values := secretValues(secrets)
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, SECRET_REDACTED)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// redactCut redacts output that was cut off, and so may end part way
+// through a secret: the start of a secret it ends in is redacted as well
+func redactCut(redact *strings.Replacer, values []string, s string) string {
+	cut := safeCut(s, values)
+	if cut == len(s) {
+		return redact.Replace(s)
+	}
+	return redact.Replace(s[:cut]) + SECRET_REDACTED
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestSecretRedactedWhenOutputIsCutOff(t *testing.T) {
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: t.TempDir()}, Logger: testLogger()}
+	// the 1KB limit falls three bytes into the secret
+	code := `printf '%1021s' '' | tr ' ' x; printf "$TOKEN"; sleep 5`
+	opts := ScriptOptions{
+		Secrets: []shared.SecretRef{{Name: "TOKEN", Value: "hunter22"}},
+		Limits:  shared.ScriptLimits{MaxOutputKB: 1},
+	}
+
+	stdout, _, _, err := a.RunScriptOpts(code, "sh", nil, 10, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stdout, "hun") {
+		t.Errorf("stdout ends in %q, want the cut off secret redacted", stdout[len(stdout)-10:])
+	}
+	if !strings.HasSuffix(stdout, SECRET_REDACTED) {
+		t.Errorf("stdout ends in %q, want %s", stdout[len(stdout)-10:], SECRET_REDACTED)
+	}
+
+	var streamed strings.Builder
+	opts.Stream = func(stream, data string) { streamed.WriteString(data) }
+	if _, _, _, err := a.RunScriptOpts(code, "sh", nil, 10, opts); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(streamed.String(), "hun") {
+		t.Errorf("streamed output has part of the secret")
+	}
+}
+
+func TestRedactCut(t *testing.T) {
+	secrets := map[string]string{"A": "hunter22", "B": "swordfish"}
+	redact, values := secretRedactor(secrets), secretValues(secrets)
+	for _, tt := range []struct{ in, want string }{
+		{"ok hunter22 ok", "ok [REDACTED] ok"},
+		{"ok hunter22 swo", "ok [REDACTED] [REDACTED]"},
+		{"ok hunt", "ok [REDACTED]"},
+		{"ok fine", "ok fine"},
+	} {
+		if got := redactCut(redact, values, tt.in); got != tt.want {
+			t.Errorf("redactCut(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
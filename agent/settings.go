@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AgentSettings are the optional agent settings, given at install time and
+// kept in the registry on Windows or in a JSON file elsewhere. Empty values
+// keep the defaults.
+type AgentSettings struct {
+	PrometheusListen string            `json:"prometheus_listen,omitempty"`
+	OTLPEndpoint     string            `json:"otlp_endpoint,omitempty"`
+	OTLPHeaders      map[string]string `json:"otlp_headers,omitempty"`
+	ClientName       string            `json:"client_name,omitempty"`
+	SiteName         string            `json:"site_name,omitempty"`
+	// base64 ed25519 keys scripts must be signed with
+	ScriptPublisherKeys []string `json:"script_publisher_keys,omitempty"`
+	ScriptCacheMB       int      `json:"script_cache_mb,omitempty"`
+	// seconds between recorded metric points and between their uploads
+	MetricsResolution     int `json:"metrics_resolution,omitempty"`
+	MetricsUploadInterval int `json:"metrics_upload_interval,omitempty"`
+	JobRetention          int `json:"job_retention,omitempty"` // seconds
+}
+
+// Apply copies the settings that are set into c
+func (s AgentSettings) Apply(c *AgentConfig) {
+	if s.PrometheusListen != "" {
+		c.PrometheusListen = s.PrometheusListen
+	}
+	if s.OTLPEndpoint != "" {
+		c.OTLPEndpoint = s.OTLPEndpoint
+	}
+	if len(s.OTLPHeaders) > 0 {
+		c.OTLPHeaders = s.OTLPHeaders
+	}
+	if s.ClientName != "" {
+		c.ClientName = s.ClientName
+	}
+	if s.SiteName != "" {
+		c.SiteName = s.SiteName
+	}
+	if len(s.ScriptPublisherKeys) > 0 {
+		c.ScriptPublisherKeys = s.ScriptPublisherKeys
+	}
+	if s.ScriptCacheMB > 0 {
+		c.ScriptCacheMB = s.ScriptCacheMB
+	}
+	if s.MetricsResolution > 0 {
+		c.MetricsResolution = s.MetricsResolution
+	}
+	if s.MetricsUploadInterval > 0 {
+		c.MetricsUploadInterval = s.MetricsUploadInterval
+	}
+	if s.JobRetention > 0 {
+		c.JobRetention = s.JobRetention
+	}
+}
+
+// ParseHeaders parses "name=value" headers, as given at install time either
+// one by one or comma separated
+func ParseHeaders(headers []string) map[string]string {
+	ret := make(map[string]string)
+	for _, h := range headers {
+		for _, kv := range strings.Split(h, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if k = strings.TrimSpace(k); ok && k != "" {
+				ret[k] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return ret
+}
+
+// FormatHeaders returns headers as sorted "name=value" strings
+func FormatHeaders(headers map[string]string) []string {
+	ret := make([]string, 0, len(headers))
+	for k, v := range headers {
+		ret = append(ret, k+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// LoadSettings reads settings from a JSON file, a missing file has none
+func LoadSettings(path string) (AgentSettings, error) {
+	var s AgentSettings
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+// SaveSettings writes settings to a JSON file only root can change
+func SaveSettings(path string, s AgentSettings) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+var (
+	ErrScriptUnsigned      = errors.New("script is not signed")
+	ErrScriptSignature     = errors.New("script signature does not match a trusted publisher key")
+	ErrInvalidPublisherKey = errors.New("invalid script publisher key")
+)
+
+// ParsePublisherKeys decodes base64 ed25519 public keys, as given at install
+// time either one by one or comma separated
+func ParsePublisherKeys(keys []string) ([]ed25519.PublicKey, error) {
+	var ret []ed25519.PublicKey
+	for _, k := range keys {
+		for _, s := range strings.Split(k, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidPublisherKey, s)
+			}
+			ret = append(ret, ed25519.PublicKey(b))
+		}
+	}
+	return ret, nil
+}
+
+// VerifyScript checks a script run against its detached base64 ed25519
+// signature when the agent has publisher keys configured, and accepts any
+// script when it has none. The signature is over the run's
+// shared.ScriptEnvelope, so the interpreter, args, env and secret names
+// can't be changed under a signed script either.
+func (a *Agent) VerifyScript(envelope shared.ScriptEnvelope, signature string) error {
+	// a broken key list rejects everything rather than nothing
+	keys, err := ParsePublisherKeys(a.ScriptPublisherKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if signature == "" {
+		return ErrScriptUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrScriptSignature
+	}
+	signed := envelope.Bytes()
+	for _, k := range keys {
+		if ed25519.Verify(k, signed, sig) {
+			return nil
+		}
+	}
+	return ErrScriptSignature
+}
+
+// scriptRejected audits a script that failed verification and returns the
+// error reported for it
+func (a *Agent) scriptRejected(code, interpreter string, err error) *ScriptError {
+	sum := sha256.Sum256([]byte(code))
+	a.Logger.Warnf("Script rejected: %v (interpreter %s, sha256 %s)", err, interpreter, hex.EncodeToString(sum[:]))
+
+	e := &ScriptError{Code: SCRIPT_ERR_SIGNATURE, Interpreter: interpreter, Message: err.Error(), err: err}
+	if errors.Is(err, ErrScriptUnsigned) {
+		e.Code = SCRIPT_ERR_UNSIGNED
+	}
+	return e
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestVerifyScript(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{AgentConfig: &AgentConfig{ScriptPublisherKeys: []string{base64.StdEncoding.EncodeToString(pub)}}, Logger: testLogger()}
+
+	script := shared.Script{
+		Code:        "echo $GREETING",
+		Interpreter: "sh",
+		Env:         map[string]string{"GREETING": "hello"},
+		Secrets:     []shared.SecretRef{{Name: "TOKEN"}},
+	}
+	args := []string{"-x"}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, shared.NewScriptEnvelope(script, args).Bytes()))
+
+	if err := a.VerifyScript(shared.NewScriptEnvelope(script, args), signature); err != nil {
+		t.Fatalf("VerifyScript() = %v for a signed script", err)
+	}
+	if err := a.VerifyScript(shared.NewScriptEnvelope(script, args), ""); !errors.Is(err, ErrScriptUnsigned) {
+		t.Errorf("VerifyScript() = %v for an unsigned script, want ErrScriptUnsigned", err)
+	}
+
+	tampered := map[string]func(s *shared.Script, args *[]string){
+		"code":        func(s *shared.Script, args *[]string) { s.Code += "; id" },
+		"interpreter": func(s *shared.Script, args *[]string) { s.Interpreter = "bash" },
+		"args":        func(s *shared.Script, args *[]string) { *args = append(*args, "-c", "id") },
+		"env": func(s *shared.Script, args *[]string) {
+			s.Env = map[string]string{"GREETING": "hello", "BASH_FUNC_echo%%": "() { id; }"}
+		},
+		"secrets": func(s *shared.Script, args *[]string) {
+			s.Secrets = append(s.Secrets, shared.SecretRef{Name: "PERL5OPT", Key: "TOKEN"})
+		},
+	}
+	for name, tamper := range tampered {
+		s := script
+		s.Secrets = append([]shared.SecretRef{}, script.Secrets...)
+		sargs := append([]string{}, args...)
+		tamper(&s, &sargs)
+		if err := a.VerifyScript(shared.NewScriptEnvelope(s, sargs), signature); !errors.Is(err, ErrScriptSignature) {
+			t.Errorf("VerifyScript() with tampered %s = %v, want ErrScriptSignature", name, err)
+		}
+	}
+
+	unconfigured := &Agent{AgentConfig: &AgentConfig{}}
+	if err := unconfigured.VerifyScript(shared.NewScriptEnvelope(script, args), ""); err != nil {
+		t.Errorf("VerifyScript() = %v without publisher keys, want any script allowed", err)
+	}
+}
+
+func TestEnvelopeIsCanonical(t *testing.T) {
+	a := shared.ScriptEnvelope{Code: "x", Secrets: []string{"B", "A"}}
+	b := shared.ScriptEnvelope{Code: "x", Args: []string{}, Env: map[string]string{}, Secrets: []string{"A", "B"}}
+	if string(a.Bytes()) != string(b.Bytes()) {
+		t.Errorf("%s != %s", a.Bytes(), b.Bytes())
+	}
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrStateDirInsecure is returned for a state dir others could tamper with
+var ErrStateDirInsecure = errors.New("agent state dir is not private to the agent")
+
+// stateDir returns the directory sub of the agent's state dir, creating
+// it. Unlike the temp dir, which anyone can create first, each level is
+// checked to belong to the agent and be closed to everyone else.
+func (a *Agent) stateDir(sub string) (string, error) {
+	root := a.StateDir
+	if root == "" {
+		root = defaultStateDir()
+	}
+	dir := filepath.Join(root, sub)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for _, d := range []string{root, dir} {
+		if err := checkPrivateDir(d); err != nil {
+			return "", fmt.Errorf("%s: %w", d, err)
+		}
+	}
+	return dir, nil
+}
+
+// StateSubdir is stateDir for the platform packages
+func (a *Agent) StateSubdir(sub string) (string, error) {
+	return a.stateDir(sub)
+}
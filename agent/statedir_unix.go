@@ -0,0 +1,31 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+const AGENT_STATE_DIR = "/var/lib/rmm-agent"
+
+func defaultStateDir() string {
+	return AGENT_STATE_DIR
+}
+
+// checkPrivateDir makes sure dir is a real directory owned by the agent's
+// user, and takes away any access others have to it
+func checkPrivateDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Geteuid() {
+		return ErrStateDirInsecure
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateDirIsPrivate(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(root, 0777); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(root, 0777)
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: root}, Logger: testLogger()}
+
+	dir, err := a.stateDir("outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{root, dir} {
+		fi, err := os.Stat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0700 {
+			t.Errorf("%s has mode %o, want 700", d, perm)
+		}
+	}
+}
+
+func TestStateDirRejectsSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "state")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), filepath.Join(root, "outbox")); err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{AgentConfig: &AgentConfig{StateDir: root}, Logger: testLogger()}
+	if _, err := a.stateDir("outbox"); !errors.Is(err, ErrStateDirInsecure) {
+		t.Errorf("stateDir() = %v, want ErrStateDirInsecure", err)
+	}
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	AGENT_STATE_FOLDER = "RMMAgent"
+	// SYSTEM and Administrators only, not inherited from ProgramData
+	AGENT_STATE_DIR_SDDL = "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+)
+
+func defaultStateDir() string {
+	return filepath.Join(os.Getenv("ProgramData"), AGENT_STATE_FOLDER)
+}
+
+// checkPrivateDir makes sure dir is a real directory owned by SYSTEM or
+// the Administrators, and restricts its ACL to them
+func checkPrivateDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return ErrStateDirInsecure
+	}
+
+	sd, err := windows.GetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return err
+	}
+	if !owner.IsWellKnown(windows.WinLocalSystemSid) && !owner.IsWellKnown(windows.WinBuiltinAdministratorsSid) {
+		return ErrStateDirInsecure
+	}
+
+	private, err := windows.SecurityDescriptorFromString(AGENT_STATE_DIR_SDDL)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := private.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
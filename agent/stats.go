@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Stats holds the agent's own counters, served on the Prometheus endpoint
+var Stats = NewAgentStats()
+
+// durationSummary accumulates observed durations
+type durationSummary struct {
+	Count uint64
+	Sum   float64 // seconds
+}
+
+// AgentStats counts what the agent itself is doing
+type AgentStats struct {
+	mu             sync.Mutex
+	checks         map[string]*durationSummary // by check type
+	rpcRequests    map[string]uint64           // by RPC func
+	rpcReplies     map[string]*durationSummary // by RPC func
+	natsReconnects uint64
+	lastCheckIn    time.Time
+}
+
+func NewAgentStats() *AgentStats {
+	return &AgentStats{
+		checks:      make(map[string]*durationSummary),
+		rpcRequests: make(map[string]uint64),
+		rpcReplies:  make(map[string]*durationSummary),
+	}
+}
+
+func observe(m map[string]*durationSummary, key string, d time.Duration) {
+	s, ok := m[key]
+	if !ok {
+		s = &durationSummary{}
+		m[key] = s
+	}
+	s.Count++
+	s.Sum += d.Seconds()
+}
+
+// ObserveCheck records how long a check of checkType took
+func (s *AgentStats) ObserveCheck(checkType string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	observe(s.checks, checkType, d)
+}
+
+// CountRPC records an incoming RPC request
+func (s *AgentStats) CountRPC(fn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rpcRequests[fn]++
+}
+
+// ObserveRPC records how long an RPC took to reply to
+func (s *AgentStats) ObserveRPC(fn string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	observe(s.rpcReplies, fn, d)
+}
+
+// NatsReconnected records a NATS reconnect
+func (s *AgentStats) NatsReconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.natsReconnects++
+}
+
+// CheckedIn records a successful check-in with the server
+func (s *AgentStats) CheckedIn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCheckIn = time.Now()
+}
+
+// statsSnapshot is a copy of the stats, safe to read without the lock
+type statsSnapshot struct {
+	checks         map[string]durationSummary
+	rpcRequests    map[string]uint64
+	rpcReplies     map[string]durationSummary
+	natsReconnects uint64
+	lastCheckIn    time.Time
+}
+
+func (s *AgentStats) snapshot() statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := statsSnapshot{
+		checks:         make(map[string]durationSummary, len(s.checks)),
+		rpcRequests:    make(map[string]uint64, len(s.rpcRequests)),
+		rpcReplies:     make(map[string]durationSummary, len(s.rpcReplies)),
+		natsReconnects: s.natsReconnects,
+		lastCheckIn:    s.lastCheckIn,
+	}
+	for k, v := range s.checks {
+		ret.checks[k] = *v
+	}
+	for k, v := range s.rpcRequests {
+		ret.rpcRequests[k] = v
+	}
+	for k, v := range s.rpcReplies {
+		ret.rpcReplies[k] = *v
+	}
+	return ret
+}
+
+// sortedKeys returns the keys of m in order, so the output is stable
+func sortedKeys[V any](m map[string]V) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RpcReply wraps an incoming RPC message to time its reply
+type RpcReply struct {
+	*nats.Msg
+	fn    string
+	start time.Time
+}
+
+// NewRpcReply counts the RPC fn and returns msg wrapped to time its reply
+func NewRpcReply(msg *nats.Msg, fn string) *RpcReply {
+	Stats.CountRPC(fn)
+	return &RpcReply{Msg: msg, fn: fn, start: time.Now()}
+}
+
+// Respond replies to the RPC and records its latency
+func (r *RpcReply) Respond(data []byte) error {
+	Stats.ObserveRPC(r.fn, time.Since(r.start))
+	return r.Msg.Respond(data)
+}
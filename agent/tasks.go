@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+const API_URL_TASKRUNNER = "/api/v3/%d/%s/taskrunner/"
+
+// RunTask runs an automated task's script and reports its result, through
+// the outbox when the server can't be reached
+func (a *Agent) RunTask(id int) error {
+	lock, err := a.AcquireLock(TaskLockName(id))
+	if err != nil {
+		a.Logger.Debugln("Run Task:", err)
+		return err
+	}
+	defer lock.Release()
+
+	data := shared.AutomatedTask{}
+	url := fmt.Sprintf(API_URL_TASKRUNNER, id, a.AgentID)
+
+	r1, gerr := a.RClient.R().Get(url)
+	if gerr != nil {
+		a.Logger.Debugln(gerr)
+		return gerr
+	}
+
+	if r1.IsError() {
+		a.Logger.Debugln("Run Task:", r1.String())
+		return nil
+	}
+
+	if err := json.Unmarshal(r1.Body(), &data); err != nil {
+		a.Logger.Debugln(err)
+		return err
+	}
+
+	start := time.Now()
+	stdout, stderr, retcode, _ := a.RunScriptJob("", JOB_KIND_TASK, strconv.Itoa(id), data.TaskScript.Code, data.TaskScript.Interpreter, data.Args, data.Timeout, ScriptOptionsFor(data.TaskScript))
+
+	type TaskResult struct {
+		Stdout   string  `json:"stdout"`
+		Stderr   string  `json:"stderr"`
+		RetCode  int     `json:"retcode"`
+		ExecTime float64 `json:"execution_time"`
+	}
+
+	payload := TaskResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		RetCode:  retcode,
+		ExecTime: time.Since(start).Seconds(),
+	}
+
+	_, perr := a.Outbox.HTTP(fmt.Sprintf("task-%d", id), resty.MethodPatch, url, payload, nil)
+	if perr != nil && perr != ErrQueued {
+		a.Logger.Debugln(perr)
+		return perr
+	}
+	return nil
+}
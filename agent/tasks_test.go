@@ -0,0 +1,51 @@
+//go:build !windows
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestRunTaskReportsResult(t *testing.T) {
+	const id = 990201
+	url := fmt.Sprintf(API_URL_TASKRUNNER, id, "agent1")
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != url {
+			t.Errorf("request to %s, want %s", r.URL.Path, url)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(shared.AutomatedTask{
+				ID:         id,
+				TaskScript: shared.Script{Interpreter: "sh", Code: `echo "hello $1"; exit 3`},
+				Args:       []string{"task"},
+				Timeout:    10,
+			})
+		case http.MethodPatch:
+			json.NewDecoder(r.Body).Decode(&got)
+		}
+	}))
+	defer srv.Close()
+
+	client := resty.New().SetBaseURL(srv.URL)
+	ob, err := NewOutbox("", testLogger(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{AgentConfig: &AgentConfig{AgentID: "agent1", StateDir: t.TempDir()}, Logger: testLogger(), RClient: client, Outbox: ob}
+	if err := a.RunTask(id); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(fmt.Sprint(got["stdout"])) != "hello task" || got["retcode"] != float64(3) {
+		t.Errorf("task result = %v, want its output and exit code", got)
+	}
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"fmt"
+)
+
+const (
+	METRIC_TYPE_GAUGE   = "gauge"
+	METRIC_TYPE_COUNTER = "counter"
+	METRIC_TYPE_SUMMARY = "summary"
+)
+
+// metricFamily is one metric as exported by the Prometheus and OTLP exporters
+type metricFamily struct {
+	Name    string
+	Help    string
+	Unit    string
+	Type    string
+	Samples []metricSample
+}
+
+// metricSample is one labelled value of a metric. For summaries Value is
+// the sum of the observations and Count their number.
+type metricSample struct {
+	Labels []string // name/value pairs
+	Value  float64
+	Count  uint64
+}
+
+func gaugeFamily(name, help, unit string, value float64) metricFamily {
+	return metricFamily{Name: name, Help: help, Unit: unit, Type: METRIC_TYPE_GAUGE, Samples: []metricSample{{Value: value}}}
+}
+
+// collectMetrics gathers the host metrics from the sampler and the agent's
+// own stats
+func (a *Agent) collectMetrics() []metricFamily {
+	ret := []metricFamily{{
+		Name:    "rmm_agent_info",
+		Help:    "Agent version and ID.",
+		Type:    METRIC_TYPE_GAUGE,
+		Samples: []metricSample{{Labels: []string{"version", a.Version, "agent_id", a.AgentID}, Value: 1}},
+	}}
+
+	if a.Sampler != nil {
+		if smp, ok := a.Sampler.Latest(); ok {
+			ret = append(ret,
+				gaugeFamily("rmm_host_cpu_percent", "CPU usage over the last sample interval.", "%", smp.CPU),
+				gaugeFamily("rmm_host_memory_percent", "Used memory.", "%", smp.Mem),
+				gaugeFamily("rmm_host_swap_percent", "Used swap.", "%", smp.Swap),
+				gaugeFamily("rmm_host_disk_read_bytes_per_second", "Disk read throughput of all disks.", "By/s", smp.DiskRead),
+				gaugeFamily("rmm_host_disk_write_bytes_per_second", "Disk write throughput of all disks.", "By/s", smp.DiskWrite),
+				gaugeFamily("rmm_host_network_receive_bytes_per_second", "Network receive throughput of all interfaces.", "By/s", smp.NetRecv),
+				gaugeFamily("rmm_host_network_transmit_bytes_per_second", "Network transmit throughput of all interfaces.", "By/s", smp.NetSent),
+				gaugeFamily("rmm_host_load1", "1 minute load average.", "", smp.Load1),
+				gaugeFamily("rmm_host_load5", "5 minute load average.", "", smp.Load5),
+				gaugeFamily("rmm_host_load15", "15 minute load average.", "", smp.Load15),
+			)
+		}
+
+		avg := metricFamily{Name: "rmm_host_cpu_average_percent", Help: "CPU usage averaged over a window of samples.", Unit: "%", Type: METRIC_TYPE_GAUGE}
+		for _, m := range []int{1, 5, 15} {
+			if v, ok := a.Sampler.CPULoadAvg(m); ok {
+				avg.Samples = append(avg.Samples, metricSample{Labels: []string{"window", fmt.Sprintf("%dm", m)}, Value: v})
+			}
+		}
+		ret = append(ret, avg)
+	}
+
+	st := Stats.snapshot()
+
+	checks := metricFamily{Name: "rmm_agent_check_duration_seconds", Help: "Time taken by checks, by check type.", Unit: "s", Type: METRIC_TYPE_SUMMARY}
+	for _, t := range sortedKeys(st.checks) {
+		checks.Samples = append(checks.Samples, metricSample{Labels: []string{"type", t}, Value: st.checks[t].Sum, Count: st.checks[t].Count})
+	}
+
+	requests := metricFamily{Name: "rmm_agent_rpc_requests_total", Help: "RPC requests received over NATS, by func.", Type: METRIC_TYPE_COUNTER}
+	for _, fn := range sortedKeys(st.rpcRequests) {
+		requests.Samples = append(requests.Samples, metricSample{Labels: []string{"func", fn}, Value: float64(st.rpcRequests[fn])})
+	}
+
+	replies := metricFamily{Name: "rmm_agent_rpc_duration_seconds", Help: "Time taken to reply to RPC requests, by func.", Unit: "s", Type: METRIC_TYPE_SUMMARY}
+	for _, fn := range sortedKeys(st.rpcReplies) {
+		replies.Samples = append(replies.Samples, metricSample{Labels: []string{"func", fn}, Value: st.rpcReplies[fn].Sum, Count: st.rpcReplies[fn].Count})
+	}
+
+	ret = append(ret, checks, requests, replies, metricFamily{
+		Name:    "rmm_agent_nats_reconnects_total",
+		Help:    "NATS reconnects since the agent started.",
+		Type:    METRIC_TYPE_COUNTER,
+		Samples: []metricSample{{Value: float64(st.natsReconnects)}},
+	})
+
+	if !st.lastCheckIn.IsZero() {
+		ret = append(ret, gaugeFamily("rmm_agent_last_checkin_timestamp_seconds", "Unix time of the last successful check-in.", "s", float64(st.lastCheckIn.Unix())))
+	}
+	return ret
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// checkState is the run history the engine keeps for a check, used to
+// damp its reported severity
+type checkState struct {
+	reported    string   // last severity sent to the server
+	consecutive int      // consecutive non-ok runs
+	history     []string // raw severities of the last FlapWindow runs
+}
+
+// severityTracker applies the consecutive failure and flap damping settings
+// of each check to the severity its latest run produced
+type severityTracker struct {
+	mu     sync.Mutex
+	states map[int]*checkState
+}
+
+func newSeverityTracker() *severityTracker {
+	return &severityTracker{states: make(map[int]*checkState)}
+}
+
+// Evaluate damps res according to the check's settings. Results without a
+// severity are left for the server to grade. The raw severity and damping
+// state are added to the result's fields.
+func (t *severityTracker) Evaluate(check shared.Check, res CheckResult) CheckResult {
+	if res.Severity == "" {
+		return res
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.states[check.CheckPK]
+	if !ok {
+		st = &checkState{reported: CHECK_SEVERITY_OK}
+		t.states[check.CheckPK] = st
+	}
+
+	raw := res.Severity
+	if raw == CHECK_SEVERITY_OK {
+		st.consecutive = 0
+	} else {
+		st.consecutive++
+	}
+
+	flapping := false
+	if check.FlapWindow > 1 && check.FlapThreshold > 0 {
+		st.history = append(st.history, raw)
+		if len(st.history) > check.FlapWindow {
+			st.history = st.history[len(st.history)-check.FlapWindow:]
+		}
+		flapping = stateChanges(st.history) >= check.FlapThreshold
+	} else {
+		st.history = nil
+	}
+
+	severity := raw
+	switch {
+	case flapping:
+		// hold the last reported state until the check settles
+		severity = st.reported
+	case raw != CHECK_SEVERITY_OK && st.consecutive < check.FailsBeforeAlert:
+		severity = st.reported
+	}
+	st.reported = severity
+
+	if res.Fields == nil {
+		res.Fields = make(map[string]interface{})
+	}
+	res.Fields["raw_severity"] = raw
+	res.Fields["consecutive_failures"] = st.consecutive
+	res.Fields["flapping"] = flapping
+	res.Severity = severity
+	res.Status = severityStatus(severity)
+	return res
+}
+
+// Forget drops the state of checks that are no longer assigned
+func (t *severityTracker) Forget(keep []shared.Check) {
+	ids := make(map[int]struct{}, len(keep))
+	for _, c := range keep {
+		ids[c.CheckPK] = struct{}{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id := range t.states {
+		if _, ok := ids[id]; !ok {
+			delete(t.states, id)
+		}
+	}
+}
+
+// stateChanges counts the transitions between consecutive severities
+func stateChanges(history []string) int {
+	n := 0
+	for i := 1; i < len(history); i++ {
+		if history[i] != history[i-1] {
+			n++
+		}
+	}
+	return n
+}
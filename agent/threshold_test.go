@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// short names for the severities in the run tables
+const (
+	sevOK   = CHECK_SEVERITY_OK
+	sevWarn = CHECK_SEVERITY_WARNING
+	sevErr  = CHECK_SEVERITY_ERROR
+)
+
+// evaluateRuns feeds raw severities through the tracker and returns what
+// was reported for each run
+func evaluateRuns(tr *severityTracker, check shared.Check, raw ...string) []string {
+	var got []string
+	for _, s := range raw {
+		got = append(got, tr.Evaluate(check, CheckResultFor(s, nil)).Severity)
+	}
+	return got
+}
+
+func assertSeverities(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d severities, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("run %d reported %q, want %q (all: %v)", i+1, got[i], want[i], got)
+		}
+	}
+}
+
+func TestSeverityTrackerFailsBeforeAlert(t *testing.T) {
+	tr := newSeverityTracker()
+	check := shared.Check{CheckPK: 1, FailsBeforeAlert: 3}
+
+	got := evaluateRuns(tr, check, sevErr, sevWarn, sevErr, sevErr)
+	assertSeverities(t, got, []string{sevOK, sevOK, sevErr, sevErr})
+
+	res := tr.Evaluate(check, CheckResultFor(sevErr, nil))
+	if n := res.Fields["consecutive_failures"]; n != 5 {
+		t.Errorf("consecutive_failures = %v, want 5", n)
+	}
+	if raw := res.Fields["raw_severity"]; raw != sevErr {
+		t.Errorf("raw_severity = %v, want %q", raw, sevErr)
+	}
+	if res.Status != severityStatus(sevErr) {
+		t.Errorf("Status = %q, want %q", res.Status, severityStatus(sevErr))
+	}
+}
+
+func TestSeverityTrackerRecoveryResetsCount(t *testing.T) {
+	tr := newSeverityTracker()
+	check := shared.Check{CheckPK: 1, FailsBeforeAlert: 3}
+
+	// an ok run between failures starts the count again
+	got := evaluateRuns(tr, check, sevErr, sevErr, sevOK, sevErr, sevErr, sevErr)
+	assertSeverities(t, got, []string{sevOK, sevOK, sevOK, sevOK, sevOK, sevErr})
+
+	// recovering is reported at once
+	got = evaluateRuns(tr, check, sevOK, sevErr)
+	assertSeverities(t, got, []string{sevOK, sevOK})
+}
+
+func TestSeverityTrackerAlertsAtOnceByDefault(t *testing.T) {
+	tr := newSeverityTracker()
+	for _, fails := range []int{0, 1} {
+		check := shared.Check{CheckPK: 10 + fails, FailsBeforeAlert: fails}
+		got := evaluateRuns(tr, check, sevWarn, sevOK, sevErr)
+		assertSeverities(t, got, []string{sevWarn, sevOK, sevErr})
+	}
+}
+
+func TestSeverityTrackerSuppressesFlapping(t *testing.T) {
+	tr := newSeverityTracker()
+	check := shared.Check{CheckPK: 1, FlapWindow: 6, FlapThreshold: 3}
+
+	// the third change within the window marks the check flapping and holds
+	// the last reported state until the window settles
+	got := evaluateRuns(tr, check, sevErr, sevOK, sevErr, sevOK, sevErr, sevOK, sevOK, sevOK, sevOK)
+	assertSeverities(t, got, []string{sevErr, sevOK, sevErr, sevErr, sevErr, sevErr, sevErr, sevErr, sevOK})
+
+	res := tr.Evaluate(check, CheckResultFor(sevOK, nil))
+	if res.Fields["flapping"] != false {
+		t.Errorf("flapping = %v after the check settled", res.Fields["flapping"])
+	}
+}
+
+func TestSeverityTrackerFlapDampingDisabled(t *testing.T) {
+	tr := newSeverityTracker()
+	for i, check := range []shared.Check{
+		{CheckPK: 1, FlapWindow: 1, FlapThreshold: 1},
+		{CheckPK: 2, FlapWindow: 6, FlapThreshold: 0},
+	} {
+		got := evaluateRuns(tr, check, sevErr, sevOK, sevErr, sevOK, sevErr)
+		assertSeverities(t, got, []string{sevErr, sevOK, sevErr, sevOK, sevErr})
+		if st := tr.states[check.CheckPK]; st.history != nil {
+			t.Errorf("check %d kept a history of %d runs", i, len(st.history))
+		}
+	}
+}
+
+func TestSeverityTrackerUngradedAndForget(t *testing.T) {
+	tr := newSeverityTracker()
+	check := shared.Check{CheckPK: 1, FailsBeforeAlert: 2}
+
+	res := tr.Evaluate(check, CheckResult{Status: "passing"})
+	if res.Severity != "" || res.Fields != nil {
+		t.Errorf("ungraded result was changed: %+v", res)
+	}
+	if len(tr.states) != 0 {
+		t.Error("ungraded result created check state")
+	}
+
+	evaluateRuns(tr, check, sevErr)
+	evaluateRuns(tr, shared.Check{CheckPK: 2}, sevErr)
+	tr.Forget([]shared.Check{{CheckPK: 2}})
+	if _, ok := tr.states[1]; ok {
+		t.Error("Forget() kept the state of an unassigned check")
+	}
+	if _, ok := tr.states[2]; !ok {
+		t.Error("Forget() dropped the state of an assigned check")
+	}
+
+	// a forgotten check starts counting again
+	assertSeverities(t, evaluateRuns(tr, check, sevErr), []string{sevOK})
+}
@@ -67,11 +67,12 @@ func NewAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent
 	restyC := resty.New()
 
 	if isAdmin {
-		regKeys, err := getRegKeys(logger)
+		keys, err := getRegKeys(logger)
 		if err != nil {
 			fmt.Println("Unable to retrieve registry keys (agent not installed?)", err)
 			logger.Debugln("Unable to retrieve registry keys (agent not installed?)")
 		} else {
+			regKeys = *keys
 			if len(regKeys.token) > 0 {
 				headers["Content-Type"] = "application/json"
 				headers["Authorization"] = fmt.Sprintf("Token %s", regKeys.token)
@@ -87,7 +88,7 @@ func NewAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent
 		}
 	}
 
-	return &windowsAgent{
+	a := &windowsAgent{
 		Agent: agent.Agent{
 			AgentConfig: &agent.AgentConfig{
 				AgentID: regKeys.agentId,
@@ -100,11 +101,16 @@ func NewAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent
 				Version: version,
 				Debug:   logger.IsLevelEnabled(logrus.DebugLevel),
 				Headers: headers,
+
+				ScriptPublisherKeys: regKeys.scriptKeys,
 			},
 			Logger:  logger,
 			RClient: restyC,
 		},
 	}
+	regKeys.settings.Apply(a.AgentConfig)
+	a.registerChecks()
+	return a
 }
 
 // New Initializes a new windowsAgent with logger
@@ -123,11 +129,12 @@ func (a *windowsAgent) New(logger *logrus.Logger, version string, isAdmin bool)
 	restyC := resty.New()
 
 	if isAdmin {
-		regKeys, err := getRegKeys(logger)
+		keys, err := getRegKeys(logger)
 		if err != nil {
 			fmt.Println("Unable to retrieve registry keys (agent not installed?)", err)
 			logger.Debugln("Unable to retrieve registry keys (agent not installed?)")
 		} else {
+			regKeys = *keys
 			if len(regKeys.token) > 0 {
 				headers["Content-Type"] = "application/json"
 				headers["Authorization"] = fmt.Sprintf("Token %s", regKeys.token)
@@ -143,7 +150,7 @@ func (a *windowsAgent) New(logger *logrus.Logger, version string, isAdmin bool)
 		}
 	}
 
-	return &windowsAgent{
+	w := &windowsAgent{
 		Agent: agent.Agent{
 			AgentConfig: &agent.AgentConfig{
 				AgentID: regKeys.agentId,
@@ -156,11 +163,16 @@ func (a *windowsAgent) New(logger *logrus.Logger, version string, isAdmin bool)
 				Version: version,
 				Debug:   logger.IsLevelEnabled(logrus.DebugLevel),
 				Headers: headers,
+
+				ScriptPublisherKeys: regKeys.scriptKeys,
 			},
 			Logger:  logger,
 			RClient: restyC,
 		},
 	}
+	regKeys.settings.Apply(w.AgentConfig)
+	w.registerChecks()
+	return w
 }
 
 // OSInfo returns formatted OS names
@@ -398,6 +410,10 @@ func (a *windowsAgent) LoggedOnUser() string {
 
 // GetCPULoadAvg Retrieve CPU load average
 func (a *windowsAgent) GetCPULoadAvg() int {
+	if load, ok := a.SampledCPULoad(1, 0); ok {
+		return load
+	}
+
 	fallback := false
 
 	// 2022-01-02: Works in PowerShell 5.x and Core 7.x
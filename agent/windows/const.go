@@ -10,13 +10,23 @@ const (
 	AGENT_SVC = "agentsvc"
 
 	// Registry strings
-	REG_RMM_PATH    = `SOFTWARE\RMMAgent`
-	REG_RMM_BASEURL = "BaseURL"
-	REG_RMM_AGENTID = "AgentID"
-	REG_RMM_AGENTPK = "AgentPK"
-	REG_RMM_APIURL  = "ApiURL"
-	REG_RMM_TOKEN   = "Token"
-	REG_RMM_CERT    = "RootCert"
+	REG_RMM_PATH        = `SOFTWARE\RMMAgent`
+	REG_RMM_BASEURL     = "BaseURL"
+	REG_RMM_AGENTID     = "AgentID"
+	REG_RMM_AGENTPK     = "AgentPK"
+	REG_RMM_APIURL      = "ApiURL"
+	REG_RMM_TOKEN       = "Token"
+	REG_RMM_CERT        = "RootCert"
+	REG_RMM_SCRIPT_KEYS = "ScriptPublisherKeys"
+	REG_RMM_PROMETHEUS  = "PrometheusListen"
+	REG_RMM_OTLP        = "OTLPEndpoint"
+	REG_RMM_OTLP_HEADER = "OTLPHeaders"
+	REG_RMM_CLIENT_NAME = "ClientName"
+	REG_RMM_SITE_NAME   = "SiteName"
+	REG_RMM_SCRIPT_MB   = "ScriptCacheMB"
+	REG_RMM_METRICS_RES = "MetricsResolution"
+	REG_RMM_METRICS_UP  = "MetricsUploadInterval"
+	REG_RMM_JOB_KEEP    = "JobRetention"
 
 	AGENT_FOLDER      = "RMMAgent"
 	RMM_SEARCH_PREFIX = "acmermm*"
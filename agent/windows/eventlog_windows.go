@@ -95,6 +95,31 @@ func (a *windowsAgent) GetEventLog(logName string, searchLastDays int) []rmm.Eve
 	return ret
 }
 
+// filterEventLog returns the events matching the check's event ID, type,
+// source and message filters. Empty filters match everything.
+func filterEventLog(evts []rmm.EventLogMsg, data rmm.Check) []rmm.EventLogMsg {
+	ret := make([]rmm.EventLogMsg, 0)
+	source := strings.ToLower(data.EventSource)
+	message := strings.ToLower(data.EventMessage)
+
+	for _, evt := range evts {
+		if !data.EventIDWildcard && evt.EventID != uint32(data.EventID) {
+			continue
+		}
+		if data.EventType != "" && !strings.EqualFold(evt.EventType, data.EventType) {
+			continue
+		}
+		if source != "" && !strings.Contains(strings.ToLower(evt.Source), source) {
+			continue
+		}
+		if message != "" && !strings.Contains(strings.ToLower(evt.Message), message) {
+			continue
+		}
+		ret = append(ret, evt)
+	}
+	return ret
+}
+
 func getEventType(et uint16) string {
 	switch et {
 	case windows.EVENTLOG_INFORMATION_TYPE:
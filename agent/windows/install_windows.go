@@ -22,13 +22,15 @@ import (
 )
 
 type WinRegKeys struct {
-	baseUrl  string
-	agentId  string
-	apiUrl   string
-	token    string
-	agentPK  string
-	pk       int // int(agentPK)
-	rootCert string
+	baseUrl    string
+	agentId    string
+	apiUrl     string
+	token      string
+	agentPK    string
+	pk         int // int(agentPK)
+	rootCert   string
+	scriptKeys []string // trusted script publisher keys
+	settings   agent.AgentSettings
 }
 
 func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
@@ -111,6 +113,10 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 		rClient.SetRootCertificate(i.RootCert)
 	}
 
+	if _, err := agent.ParsePublisherKeys(i.ScriptKeys); err != nil {
+		a.installerMsg(err.Error(), "error", i.Silent)
+	}
+
 	a.Logger.Infoln("Adding agent to the dashboard")
 
 	type NewAgentResp struct {
@@ -141,7 +147,7 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 	// a.Logger.Debugln("Agent Token:", authToken)
 	a.Logger.Debugln("Agent PK:", agentPK)
 
-	createRegKeys(baseURL, a.AgentID, i.ApiURL, authToken, strconv.Itoa(agentPK), i.RootCert)
+	createRegKeys(baseURL, a.AgentID, i.ApiURL, authToken, strconv.Itoa(agentPK), i.RootCert, i.ScriptKeys, i.Settings)
 
 	// Refresh our agent with new values
 	a = a.New(a.Logger, a.Version, true)
@@ -222,7 +228,7 @@ func (a *windowsAgent) checkExistingAndRemove(silent bool) {
 	}
 }
 
-func createRegKeys(baseUrl, agentId, apiUrl, token, agentPK, rootCert string) {
+func createRegKeys(baseUrl, agentId, apiUrl, token, agentPK, rootCert string, scriptKeys []string, settings agent.AgentSettings) {
 	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, REG_RMM_PATH, registry.ALL_ACCESS)
 	if err != nil {
 		log.Fatalln("Error creating registry key:", err)
@@ -265,6 +271,76 @@ func createRegKeys(baseUrl, agentId, apiUrl, token, agentPK, rootCert string) {
 			log.Fatalln("Error creating RootCert registry key:", err)
 		}
 	}
+
+	if len(scriptKeys) > 0 {
+		err = key.SetStringsValue(REG_RMM_SCRIPT_KEYS, scriptKeys)
+		if err != nil {
+			log.Fatalln("Error creating ScriptPublisherKeys registry key:", err)
+		}
+	}
+
+	if len(settings.PrometheusListen) > 0 {
+		err = key.SetStringValue(REG_RMM_PROMETHEUS, settings.PrometheusListen)
+		if err != nil {
+			log.Fatalln("Error creating PrometheusListen registry key:", err)
+		}
+	}
+
+	if len(settings.OTLPEndpoint) > 0 {
+		err = key.SetStringValue(REG_RMM_OTLP, settings.OTLPEndpoint)
+		if err != nil {
+			log.Fatalln("Error creating OTLPEndpoint registry key:", err)
+		}
+	}
+
+	if len(settings.OTLPHeaders) > 0 {
+		err = key.SetStringsValue(REG_RMM_OTLP_HEADER, agent.FormatHeaders(settings.OTLPHeaders))
+		if err != nil {
+			log.Fatalln("Error creating OTLPHeaders registry key:", err)
+		}
+	}
+
+	if len(settings.ClientName) > 0 {
+		err = key.SetStringValue(REG_RMM_CLIENT_NAME, settings.ClientName)
+		if err != nil {
+			log.Fatalln("Error creating ClientName registry key:", err)
+		}
+	}
+
+	if len(settings.SiteName) > 0 {
+		err = key.SetStringValue(REG_RMM_SITE_NAME, settings.SiteName)
+		if err != nil {
+			log.Fatalln("Error creating SiteName registry key:", err)
+		}
+	}
+
+	if settings.ScriptCacheMB > 0 {
+		err = key.SetDWordValue(REG_RMM_SCRIPT_MB, uint32(settings.ScriptCacheMB))
+		if err != nil {
+			log.Fatalln("Error creating ScriptCacheMB registry key:", err)
+		}
+	}
+
+	if settings.MetricsResolution > 0 {
+		err = key.SetDWordValue(REG_RMM_METRICS_RES, uint32(settings.MetricsResolution))
+		if err != nil {
+			log.Fatalln("Error creating MetricsResolution registry key:", err)
+		}
+	}
+
+	if settings.MetricsUploadInterval > 0 {
+		err = key.SetDWordValue(REG_RMM_METRICS_UP, uint32(settings.MetricsUploadInterval))
+		if err != nil {
+			log.Fatalln("Error creating MetricsUploadInterval registry key:", err)
+		}
+	}
+
+	if settings.JobRetention > 0 {
+		err = key.SetDWordValue(REG_RMM_JOB_KEEP, uint32(settings.JobRetention))
+		if err != nil {
+			log.Fatalln("Error creating JobRetention registry key:", err)
+		}
+	}
 }
 
 func getRegKeys(logger *logrus.Logger) (*WinRegKeys, error) {
@@ -306,15 +382,34 @@ func getRegKeys(logger *logrus.Logger) (*WinRegKeys, error) {
 	pk, _ := strconv.Atoi(agentPK)
 
 	rootCert, _, _ := key.GetStringValue(REG_RMM_CERT)
+	scriptKeys, _, _ := key.GetStringsValue(REG_RMM_SCRIPT_KEYS)
+
+	var settings agent.AgentSettings
+	settings.PrometheusListen, _, _ = key.GetStringValue(REG_RMM_PROMETHEUS)
+	settings.OTLPEndpoint, _, _ = key.GetStringValue(REG_RMM_OTLP)
+	otlpHeaders, _, _ := key.GetStringsValue(REG_RMM_OTLP_HEADER)
+	settings.OTLPHeaders = agent.ParseHeaders(otlpHeaders)
+	settings.ClientName, _, _ = key.GetStringValue(REG_RMM_CLIENT_NAME)
+	settings.SiteName, _, _ = key.GetStringValue(REG_RMM_SITE_NAME)
+	scriptMB, _, _ := key.GetIntegerValue(REG_RMM_SCRIPT_MB)
+	settings.ScriptCacheMB = int(scriptMB)
+	metricsRes, _, _ := key.GetIntegerValue(REG_RMM_METRICS_RES)
+	settings.MetricsResolution = int(metricsRes)
+	metricsUp, _, _ := key.GetIntegerValue(REG_RMM_METRICS_UP)
+	settings.MetricsUploadInterval = int(metricsUp)
+	jobKeep, _, _ := key.GetIntegerValue(REG_RMM_JOB_KEEP)
+	settings.JobRetention = int(jobKeep)
 
 	return &WinRegKeys{
-		baseUrl:  baseUrl,
-		agentId:  agentId,
-		apiUrl:   apiUrl,
-		token:    token,
-		agentPK:  agentPK,
-		pk:       pk,
-		rootCert: rootCert,
+		baseUrl:    baseUrl,
+		agentId:    agentId,
+		apiUrl:     apiUrl,
+		token:      token,
+		agentPK:    agentPK,
+		pk:         pk,
+		rootCert:   rootCert,
+		scriptKeys: scriptKeys,
+		settings:   settings,
 	}, nil
 }
 
@@ -1,6 +1,7 @@
 package windows
 
 import (
+	"errors"
 	"fmt"
 	. "github.com/jetrmm/rmm-agent/agent"
 	"github.com/jetrmm/rmm-agent/shared"
@@ -10,7 +11,6 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -19,21 +19,27 @@ type NatsMsg struct {
 	// Func            string            `json:"func"`
 	// Timeout         int               `json:"timeout"`
 	// Data            map[string]string `json:"payload"`
-	ScriptArgs      []string  `json:"script_args"`
-	ProcPID         int32     `json:"proc_pid"` // was: procpid
-	TaskId          int       `json:"task_id"`  // was: taskpk
-	ScheduledTask   SchedTask `json:"schedtaskpayload"`
-	RecoveryCommand string    `json:"recoverycommand"`
-	UpdateGUIDs     []string  `json:"guids"`           // todo: move
-	ChocoProgName   string    `json:"choco_prog_name"` // todo: move
-	PendingActionPK int       `json:"pending_action_pk"`
+	ScriptArgs      []string            `json:"script_args"`
+	ProcPID         int32               `json:"proc_pid"` // was: procpid
+	TaskId          int                 `json:"task_id"`  // was: taskpk
+	ScheduledTask   SchedTask           `json:"schedtaskpayload"`
+	RecoveryCommand string              `json:"recoverycommand"`
+	UpdateGUIDs     []string            `json:"guids"`           // todo: move
+	ChocoProgName   string              `json:"choco_prog_name"` // todo: move
+	PendingActionPK int                 `json:"pending_action_pk"`
+	CheckUpdate     shared.CheckUpdate  `json:"check_update"`
+	RunAsUser       bool                `json:"run_as_user"`
+	RunAs           string              `json:"run_as_username"`
+	Env             map[string]string   `json:"env_vars"`
+	Secrets         []shared.SecretRef  `json:"secrets"`
+	Limits          shared.ScriptLimits `json:"limits"`
+	Signature       string              `json:"signature"`
+	ScriptHash      string              `json:"script_hash"`
 }
 
-var (
-	agentUpdateLocker      uint32
-	getWinUpdateLocker     uint32
-	installWinUpdateLocker uint32
-)
+func (p *NatsMsg) scriptOptions() ScriptOptions {
+	return ScriptOptions{RunAsUser: p.RunAsUser, User: p.RunAs, Env: p.Env, Secrets: p.Secrets, Limits: p.Limits, Signature: p.Signature, Hash: p.ScriptHash}
+}
 
 // RunService handles incoming RPC (NATS) payloads from server and dispatches tasks
 func (a *windowsAgent) RunService() {
@@ -68,17 +74,18 @@ func (a *windowsAgent) RunService() {
 	runtime.Goexit()
 }
 
-func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
+func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, m *nats.Msg) {
 	a.Logger.SetOutput(os.Stdout)
 	var payload *NatsMsg
 	var mh codec.MsgpackHandle
 	mh.RawToString = true
 
-	dec := codec.NewDecoderBytes(msg.Data, &mh)
+	dec := codec.NewDecoderBytes(m.Data, &mh)
 	if err := dec.Decode(&payload); err != nil {
 		a.Logger.Errorln(err)
 		return
 	}
+	msg := NewRpcReply(m, payload.Func)
 
 	switch payload.Func {
 	case NATS_CMD_PING:
@@ -240,7 +247,7 @@ func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
 			var resp []byte
 			var retData string
 			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-			stdout, stderr, _, err := a.RunScript(p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout)
+			stdout, stderr, _, err := a.RunScriptJob(p.Data["job_id"], JOB_KIND_SCRIPT, p.Data["shell"], p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.scriptOptions())
 			if err != nil {
 				a.Logger.Debugln(err)
 				retData = err.Error()
@@ -256,14 +263,22 @@ func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
 		go func(p *NatsMsg) {
 			var resp []byte
 			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			jobID := p.Data["job_id"]
+			if jobID == "" {
+				jobID = NewJobID()
+			}
 			start := time.Now()
-			out, err, retcode, _ := a.RunScript(p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout)
+			out, err, retcode, runErr := a.RunScriptJob(jobID, JOB_KIND_SCRIPT, p.Data["shell"], p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.scriptOptions())
+			var scriptErr *ScriptError
+			errors.As(runErr, &scriptErr)
 			retData := struct {
-				Stdout   string  `json:"stdout"`
-				Stderr   string  `json:"stderr"`
-				Retcode  int     `json:"retcode"`
-				ExecTime float64 `json:"execution_time"`
-			}{out, err, retcode, time.Since(start).Seconds()}
+				JobID    string       `json:"job_id"`
+				Stdout   string       `json:"stdout"`
+				Stderr   string       `json:"stderr"`
+				Retcode  int          `json:"retcode"`
+				ExecTime float64      `json:"execution_time"`
+				Error    *ScriptError `json:"error,omitempty"`
+			}{jobID, out, err, retcode, time.Since(start).Seconds(), scriptErr}
 			a.Logger.Debugln(retData)
 			ret.Encode(retData)
 			msg.Respond(resp)
@@ -357,33 +372,118 @@ func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
 		}()
 
 	case NATS_CMD_CPULOADAVG:
-		go func() {
+		go func(p *NatsMsg) {
 			var resp []byte
 			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
 			a.Logger.Debugln("Getting CPU load average")
-			loadAvg := a.GetCPULoadAvg()
+			// optional window (1, 5 or 15 minutes) and percentile of the samples
+			minutes, _ := strconv.Atoi(p.Data["minutes"])
+			pct, _ := strconv.ParseFloat(p.Data["percentile"], 64)
+			loadAvg, ok := a.SampledCPULoad(minutes, pct)
+			if minutes <= 0 || !ok {
+				loadAvg = a.GetCPULoadAvg()
+			}
 			a.Logger.Debugln("CPU load average:", loadAvg)
 			ret.Encode(loadAvg)
 			msg.Respond(resp)
+		}(payload)
+
+	case NATS_CMD_SCRIPT_RUN_STREAM:
+		// output goes to stream_subject, or the reply subject, as it comes.
+		// A separate stream_subject gets the request acked with the job id.
+		go func(p *NatsMsg) {
+			subject := p.Data["stream_subject"]
+			if subject == "" {
+				subject = m.Reply
+			}
+			if subject == "" {
+				a.Logger.Debugln("Script stream: no subject to stream to")
+				return
+			}
+			a.StreamScript(nc, msg, subject, p.Data["job_id"], p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.scriptOptions())
+		}(payload)
+
+	case NATS_CMD_SECRET_SET:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if err := a.SetSecret(p.Data["key"], p.Data["value"]); err != nil {
+				a.Logger.Debugln("Set secret:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode("ok")
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case NATS_CMD_SECRET_DEL:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if err := a.DeleteSecret(p.Data["key"]); err != nil {
+				a.Logger.Debugln("Delete secret:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode("ok")
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case NATS_CMD_JOBS_LIST:
+		go func() {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			ret.Encode(a.Jobs.List())
+			msg.Respond(resp)
 		}()
 
+	case NATS_CMD_JOB_STATUS:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if job, err := a.Jobs.Get(p.Data["job_id"]); err != nil {
+				a.Logger.Debugln("Job status:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode(job)
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case NATS_CMD_JOB_CANCEL:
+		go func(p *NatsMsg) {
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			if err := a.Jobs.Cancel(p.Data["job_id"]); err != nil {
+				a.Logger.Debugln("Cancel job:", err)
+				ret.Encode(err.Error())
+			} else {
+				ret.Encode("ok")
+			}
+			msg.Respond(resp)
+		}(payload)
+
+	case NATS_CMD_CHECKS_UPDATE:
+		// applied in order, so an update is never overtaken by an older one
+		var resp []byte
+		ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+		version := a.Scheduler.ApplyUpdate(payload.CheckUpdate)
+		a.Logger.Debugln("Check definitions at version", version)
+		ret.Encode(version)
+		msg.Respond(resp)
+
 	case NATS_CMD_RUNCHECKS:
 		go func() {
 			var resp []byte
 			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-			if a.ChecksRunning() {
+			if !a.Scheduler.RunNow() {
 				ret.Encode("busy")
 				msg.Respond(resp)
-				a.Logger.Debugln("Checks are already running, please wait")
+				a.Logger.Debugln("A check run is already pending, please wait")
 			} else {
 				ret.Encode("ok")
 				msg.Respond(resp)
 				a.Logger.Debugln("Running checks")
-				// todo: verify:
-				_, checkerr := runExe(a.GetExePath(), []string{"-m", "runchecks"}, 600, false)
-				if checkerr != nil {
-					a.Logger.Errorln("RPC RunChecks", checkerr)
-				}
 			}
 		}()
 
@@ -418,22 +518,24 @@ func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
 
 	case NATS_CMD_GETWINUPDATES:
 		go func() {
-			if !atomic.CompareAndSwapUint32(&getWinUpdateLocker, 0, 1) {
-				a.Logger.Debugln("Already checking for Windows Updates")
+			lock, err := a.AcquireLock(LOCK_PATCH_SCAN)
+			if err != nil {
+				a.Logger.Debugln("Already checking for Windows Updates:", err)
 			} else {
 				a.Logger.Debugln("Checking for Windows Updates")
-				defer atomic.StoreUint32(&getWinUpdateLocker, 0)
+				defer lock.Release()
 				a.GetWinUpdates()
 			}
 		}()
 
 	case NATS_CMD_INSTALL_WINUPDATES:
 		go func(p *NatsMsg) {
-			if !atomic.CompareAndSwapUint32(&installWinUpdateLocker, 0, 1) {
-				a.Logger.Debugln("Already installing Windows Updates")
+			lock, err := a.AcquireLock(LOCK_PATCH_INSTALL)
+			if err != nil {
+				a.Logger.Debugln("Already installing Windows Updates:", err)
 			} else {
 				a.Logger.Debugln("Installing Windows Updates", p.UpdateGUIDs)
-				defer atomic.StoreUint32(&installWinUpdateLocker, 0)
+				defer lock.Release()
 				a.InstallUpdates(p.UpdateGUIDs)
 			}
 		}(payload)
@@ -442,15 +544,16 @@ func (a *windowsAgent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
 		go func(p *NatsMsg) {
 			var resp []byte
 			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-			if !atomic.CompareAndSwapUint32(&agentUpdateLocker, 0, 1) {
-				a.Logger.Debugln("Agent update already running")
+			lock, err := a.AcquireLock(LOCK_AGENT_UPDATE)
+			if err != nil {
+				a.Logger.Debugln("Agent update already running:", err)
 				ret.Encode("updaterunning") // todo: 2022-01-02: removed or renamed? no mention on server side
 				msg.Respond(resp)
 			} else {
 				ret.Encode("ok")
 				msg.Respond(resp)
 				a.AgentUpdate(p.Data["url"], p.Data["inno"], p.Data["version"])
-				atomic.StoreUint32(&agentUpdateLocker, 0)
+				lock.Release()
 				nc.Flush()
 				nc.Close()
 				os.Exit(0)
@@ -1,11 +1,14 @@
 package windows
 
 import (
+	"context"
 	"github.com/ugorji/go/codec"
 	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/agent"
 	rmm "github.com/jetrmm/rmm-agent/shared"
 	jrmm "github.com/jetrmm/rmm-shared"
 	"github.com/nats-io/nats.go"
@@ -14,6 +17,8 @@ import (
 const (
 	API_URL_CHECKIN = "/api/v3/checkin/"
 
+	CHECKIN_KEY_PREFIX = "checkin-"
+
 	CHECKIN_MODE_DISKS        = "disks"
 	CHECKIN_MODE_HELLO        = "hello"
 	CHECKIN_MODE_LOGGEDONUSER = "loggedonuser"
@@ -37,6 +42,12 @@ func (a *windowsAgent) RunAgentService(nc *nats.Conn) {
 	wg.Add(1)
 	go a.WinAgentSvc(nc)
 	go a.CheckRunner()
+	go a.RunMetrics(context.Background())
+	go a.ServePrometheus(context.Background())
+	go a.RunOTLP(context.Background())
+	go a.RunInterpreterDiscovery(context.Background())
+	a.Outbox.SetConn(nc)
+	a.Outbox.Start(context.Background())
 	wg.Wait()
 }
 
@@ -126,15 +137,18 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 		}
 
 		nMode = NATS_MODE_OSINFO
-		payload = jrmm.AgentInfoNats{
-			AgentId:       a.AgentID,
-			Username:      a.LoggedOnUser(),
-			Hostname:      a.GetHostname(),
-			OS:            osInfo,
-			Platform:      plat,
-			TotalRAM:      a.TotalRAM(),
-			BootTime:      a.BootTime(),
-			RebootPending: reboot,
+		payload = rmm.AgentInfo{
+			AgentInfoNats: jrmm.AgentInfoNats{
+				AgentId:       a.AgentID,
+				Username:      a.LoggedOnUser(),
+				Hostname:      a.GetHostname(),
+				OS:            osInfo,
+				Platform:      plat,
+				TotalRAM:      a.TotalRAM(),
+				BootTime:      a.BootTime(),
+				RebootPending: reboot,
+			},
+			Interpreters: a.InterpreterInventory(),
 		}
 
 	case CHECKIN_MODE_WINSERVICES:
@@ -193,7 +207,10 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 		if err != nil {
 			return
 		}
-		nc.PublishRequest(a.AgentID, nMode, response)
+		// newer check-ins of the same mode replace undelivered ones
+		if err := a.Outbox.NATS(CHECKIN_KEY_PREFIX+mode, a.AgentID, nMode, response); err == nil {
+			agent.Stats.CheckedIn()
+		}
 		// was testing with: nc.Publish(a.AgentID, cPayload)
 		// }
 		// mh.RawToString = true
@@ -212,13 +229,17 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 			// a.CheckIn(CHECKIN_MODE_HELLO)
 			// time.Sleep(200 * time.Millisecond)
 		} else if mode == CHECKIN_MODE_STARTUP {
-			_, rerr = a.RClient.R().SetBody(payload).Post(API_URL_CHECKIN)
+			_, rerr = a.Outbox.HTTP(CHECKIN_KEY_PREFIX+mode, resty.MethodPost, API_URL_CHECKIN, payload, nil)
 		} else {
 			// 'put' is deprecated as of 1.7.0
-			_, rerr = a.RClient.R().SetBody(payload).Put(API_URL_CHECKIN)
+			_, rerr = a.Outbox.HTTP(CHECKIN_KEY_PREFIX+mode, resty.MethodPut, API_URL_CHECKIN, payload, nil)
 		}
-		if rerr != nil {
+		if rerr == agent.ErrQueued {
+			a.Logger.Debugln("Checkin queued:", mode)
+		} else if rerr != nil {
 			a.Logger.Debugln("Checkin:", rerr)
+		} else {
+			agent.Stats.CheckedIn()
 		}
 	}
 }
@@ -1,7 +1,6 @@
 package windows
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/jetrmm/rmm-agent/agent"
 	"os"
@@ -10,54 +9,8 @@ import (
 	"time"
 
 	"github.com/jetrmm/go-taskmaster"
-	rmm "github.com/jetrmm/rmm-agent/shared"
 )
 
-func (a *windowsAgent) RunTask(id int) error {
-	data := rmm.AutomatedTask{}
-	url := fmt.Sprintf("/api/v3/%d/%s/taskrunner/", id, a.AgentID)
-
-	r1, gerr := a.RClient.R().Get(url)
-	if gerr != nil {
-		a.Logger.Debugln(gerr)
-		return gerr
-	}
-
-	if r1.IsError() {
-		a.Logger.Debugln("Run Task:", r1.String())
-		return nil
-	}
-
-	if err := json.Unmarshal(r1.Body(), &data); err != nil {
-		a.Logger.Debugln(err)
-		return err
-	}
-
-	start := time.Now()
-	stdout, stderr, retcode, _ := a.RunScript(data.TaskScript.Code, data.TaskScript.Interpreter, data.Args, data.Timeout)
-
-	type TaskResult struct {
-		Stdout   string  `json:"stdout"`
-		Stderr   string  `json:"stderr"`
-		RetCode  int     `json:"retcode"`
-		ExecTime float64 `json:"execution_time"`
-	}
-
-	payload := TaskResult{
-		Stdout:   stdout,
-		Stderr:   stderr,
-		RetCode:  retcode,
-		ExecTime: time.Since(start).Seconds(),
-	}
-
-	_, perr := a.RClient.R().SetBody(payload).Patch(url)
-	if perr != nil {
-		a.Logger.Debugln(perr)
-		return perr
-	}
-	return nil
-}
-
 // CreateInternalTask creates predefined RMM agent internal tasks
 func (a *windowsAgent) CreateInternalTask(name, args, repeat string, start int) (bool, error) {
 	conn, err := taskmaster.Connect()
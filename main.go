@@ -11,6 +11,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 var (
@@ -58,6 +59,16 @@ func main() {
 	timeout := installSet.Duration("timeout", 1000, "Installer timeout in seconds")
 	aDesc := installSet.String("desc", hostname, "Agent's description to display on the RMM server")
 	cert := installSet.String("cert", "", "Path to the Root Certificate Authority's .pem")
+	scriptKeys := installSet.String("script-keys", "", "Comma separated base64 ed25519 keys scripts must be signed with")
+	prometheus := installSet.String("prometheus", "", "Address to serve Prometheus metrics on, as [host]:port")
+	otlpEndpoint := installSet.String("otlp", "", "OTLP/HTTP endpoint to export metrics and logs to, e.g. http://localhost:4318")
+	otlpHeaders := installSet.String("otlp-headers", "", "Comma separated name=value headers sent with the OTLP export")
+	clientName := installSet.String("client-name", "", "Client name the OTLP export is labelled with")
+	siteName := installSet.String("site-name", "", "Site name the OTLP export is labelled with")
+	scriptCacheMB := installSet.Int("script-cache-mb", 0, "Size of the local script cache in MB, 0 uses the default")
+	metricsRes := installSet.Int("metrics-resolution", 0, "Seconds between recorded metric points, 0 uses the default")
+	metricsUpload := installSet.Int("metrics-upload", 0, "Seconds between metric uploads, 0 uses the default")
+	jobRetention := installSet.Int("job-retention", 0, "Seconds finished script and task jobs are kept, 0 uses the default")
 
 	// Update
 	updateSet := flag.NewFlagSet("update", flag.ContinueOnError)
@@ -218,8 +229,20 @@ func main() {
 				Description: *aDesc,
 				Token:       *token,
 				RootCert:    *cert,
+				ScriptKeys:  strings.FieldsFunc(*scriptKeys, func(r rune) bool { return r == ',' }),
 				Timeout:     *timeout,
 				Silent:      *silent,
+				Settings: agent.AgentSettings{
+					PrometheusListen:      *prometheus,
+					OTLPEndpoint:          *otlpEndpoint,
+					OTLPHeaders:           agent.ParseHeaders([]string{*otlpHeaders}),
+					ClientName:            *clientName,
+					SiteName:              *siteName,
+					ScriptCacheMB:         *scriptCacheMB,
+					MetricsResolution:     *metricsRes,
+					MetricsUploadInterval: *metricsUpload,
+					JobRetention:          *jobRetention,
+				},
 			},
 			agentULID.String(),
 		)
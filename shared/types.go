@@ -1,6 +1,11 @@
 package shared
 
-import jetrmm "github.com/jetrmm/rmm-shared"
+import (
+	"encoding/json"
+	"sort"
+
+	jetrmm "github.com/jetrmm/rmm-shared"
+)
 
 // from NatsMsg
 type RpcPayload struct {
@@ -43,38 +48,131 @@ type AssignedTask struct {
 }
 
 type Script struct {
-	Interpreter string `json:"interpreter"` // cmd, powershell, pwsh, sh, bash, tcsh, etc.
-	Code        string `json:"code"`        // base64-encoded
+	Interpreter string            `json:"interpreter"`     // cmd, powershell, pwsh, sh, bash, tcsh, etc.
+	Code        string            `json:"code"`            // base64-encoded, may be left out when Hash is set
+	Hash        string            `json:"hash"`            // hex SHA-256 of Code, for the agent's script cache
+	RunAsUser   bool              `json:"run_as_user"`     // run as the logged-on user instead of root/SYSTEM
+	RunAs       string            `json:"run_as_username"` // run as this user instead, Linux only
+	Env         map[string]string `json:"env_vars"`
+	Secrets     []SecretRef       `json:"secrets"`
+	Limits      ScriptLimits      `json:"limits"`
+	Signature   string            `json:"signature"` // base64 ed25519 signature of its ScriptEnvelope
+}
+
+// ScriptEnvelope is what a script's signature covers: everything that
+// decides what runs, so none of it can be swapped under a signed script.
+// Secret values and who it runs as are left out.
+type ScriptEnvelope struct {
+	Code        string            `json:"code"`
+	Interpreter string            `json:"interpreter"`
+	Args        []string          `json:"args"`
+	Env         map[string]string `json:"env"`
+	Secrets     []string          `json:"secrets"` // the env var names
+}
+
+// NewScriptEnvelope returns the envelope of a script run with args
+func NewScriptEnvelope(s Script, args []string) ScriptEnvelope {
+	e := ScriptEnvelope{Code: s.Code, Interpreter: s.Interpreter, Args: args, Env: s.Env}
+	for _, ref := range s.Secrets {
+		e.Secrets = append(e.Secrets, ref.Name)
+	}
+	return e
+}
+
+// Bytes returns the canonical form that is signed: compact JSON, with the
+// env sorted by name, the secrets sorted and nil lists and maps empty
+func (e ScriptEnvelope) Bytes() []byte {
+	if e.Args == nil {
+		e.Args = []string{}
+	}
+	if e.Env == nil {
+		e.Env = map[string]string{}
+	}
+	e.Secrets = append([]string{}, e.Secrets...)
+	sort.Strings(e.Secrets)
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// ScriptLimits are the resources a script may use, zero is unlimited. Only
+// MaxOutputKB and PrivateDir are supported outside Linux.
+type ScriptLimits struct {
+	CPUSeconds     int  `json:"cpu_seconds"`
+	MemoryMB       int  `json:"memory_mb"`
+	MaxProcs       int  `json:"max_procs"`
+	MaxOutputKB    int  `json:"max_output_kb"`    // stdout and stderr combined
+	PrivateDir     bool `json:"private_dir"`      // run in an empty dir of its own
+	ReadOnlySystem bool `json:"read_only_system"` // mount /usr, /etc etc. read-only for it
+}
+
+// SecretRef is a secret a script gets as the environment variable Name.
+// Its Value is either delivered with the script or kept in the agent's
+// local secret store under Key.
+type SecretRef struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`     // defaults to Name
+	Value   string `json:"value"`   // short-lived, server-delivered
+	Expires int64  `json:"expires"` // unix time the Value expires at, 0 never
 }
 
 type CheckInfo struct {
-	AgentPK  int `json:"agent"`
-	Interval int `json:"check_interval"`
+	AgentPK  int   `json:"agent"`
+	Interval int   `json:"check_interval"`
+	Version  int64 `json:"checks_version"`
 }
 
 type Check struct {
-	Script         Script         `json:"script"`
-	AssignedTasks  []AssignedTask `json:"assigned_tasks"`
-	CheckPK        int            `json:"id"`
-	CheckType      string         `json:"check_type"`
-	Storage        string         `json:"storage"`
-	IP             string         `json:"ip"`
-	ScriptArgs     []string       `json:"script_args"`
-	Timeout        int            `json:"timeout"`
-	ServiceName    string         `json:"svc_name"`
-	LogName        string         `json:"log_name"`
-	EventID        int            `json:"event_id"`
-	SearchLastDays int            `json:"search_last_days"`
-	Status         string         `json:"status"`
-	// Threshold        int            `json:"threshold"`
+	Script           Script          `json:"script"`
+	AssignedTasks    []AssignedTask  `json:"assigned_tasks"`
+	CheckPK          int             `json:"id"`
+	CheckType        string          `json:"check_type"`
+	Storage          string          `json:"storage"`
+	IP               string          `json:"ip"`
+	ScriptArgs       []string        `json:"script_args"`
+	Timeout          int             `json:"timeout"`
+	RunInterval      int             `json:"run_interval"` // seconds, 0 uses the agent's check interval
+	ServiceName      string          `json:"svc_name"`
+	LogName          string          `json:"log_name"`
+	EventID          int             `json:"event_id"`
+	SearchLastDays   int             `json:"search_last_days"`
+	Status           string          `json:"status"`
+	EventIDWildcard  bool            `json:"event_id_is_wildcard"`
+	EventType        string          `json:"event_type"`            // INFO, WARNING, ERROR, AUDIT_SUCCESS, AUDIT_FAILURE
+	EventSource      string          `json:"event_source"`          // case-insensitive substring
+	EventMessage     string          `json:"event_message"`         // case-insensitive substring
+	FailWhen         string          `json:"fail_when"`             // contains, not_contains
+	KernelLogCats    []string        `json:"kernel_log_categories"` // empty matches all
+	Mounts           []ExpectedMount `json:"mounts"`
+	Port             int             `json:"port"`
+	URL              string          `json:"url"`
+	ExpectedStatus   int             `json:"expected_status"` // 0 accepts any status below 400
+	BodyRegex        string          `json:"body_regex"`
+	DNSName          string          `json:"dns_name"`        // also the TLS server name
+	DNSRecordType    string          `json:"dns_record_type"` // A, AAAA, CNAME, MX, NS, TXT
+	DNSServer        string          `json:"dns_server"`      // host[:port], empty uses the system resolver
+	ExpectedRecords  []string        `json:"expected_records"`
+	WarnThreshold    float64         `json:"warning_threshold"`
+	ErrorThreshold   float64         `json:"error_threshold"`
+	PingCount        int             `json:"ping_count"`
+	LossWarn         float64         `json:"loss_warning_threshold"`   // percent
+	LossError        float64         `json:"loss_error_threshold"`     // percent
+	JitterWarn       float64         `json:"jitter_warning_threshold"` // ms
+	JitterError      float64         `json:"jitter_error_threshold"`   // ms
+	AvgMinutes       int             `json:"avg_minutes"`              // cpuload window, 1, 5 or 15, 0 uses 5
+	Percentile       float64         `json:"percentile"`               // grade this percentile of the window instead of its average
+	FailsBeforeAlert int             `json:"fails_b4_alert"`           // consecutive failures before the status changes, 0 or 1 alerts at once
+	FlapWindow       int             `json:"flap_window"`              // number of recent runs looked at for flapping
+	FlapThreshold    int             `json:"flap_threshold"`           // state changes within the window that mark the check flapping
 	// PassStartPending bool           `json:"pass_if_start_pending"`
 	// PassNotExist     bool           `json:"pass_if_svc_not_exist"`
 	// RestartIfStopped bool           `json:"restart_if_stopped"`
-	// EventIDWildcard  bool           `json:"event_id_is_wildcard"`
-	// EventType        string         `json:"event_type"`
-	// EventSource      string         `json:"event_source"`
-	// EventMessage     string         `json:"event_message"`
-	// FailWhen         string         `json:"fail_when"`
+}
+
+// ExpectedMount describes a mount point a mounts check verifies
+type ExpectedMount struct {
+	Path    string   `json:"path"`
+	Fstype  string   `json:"fstype"`  // empty matches any
+	Options []string `json:"options"` // each must be present, e.g. "rw", "noexec"
 }
 
 type AllChecks struct {
@@ -82,6 +180,17 @@ type AllChecks struct {
 	Checks []Check
 }
 
+// CheckUpdate is a change to the agent's check definitions pushed over NATS.
+// A full update replaces every check, otherwise Checks are added or
+// modified and Removed are deleted.
+type CheckUpdate struct {
+	Version  int64   `json:"version"`
+	Full     bool    `json:"full"`
+	Interval int     `json:"check_interval"` // 0 keeps the current interval
+	Checks   []Check `json:"checks"`
+	Removed  []int   `json:"removed"`
+}
+
 type AutomatedTask struct {
 	ID         int      `json:"id"`
 	TaskScript Script   `json:"script"`
@@ -100,6 +209,19 @@ type CheckInPublicIP struct {
 	PublicIP string `json:"public_ip"`
 }
 
+// AgentInfo is the agentinfo check-in
+type AgentInfo struct {
+	jetrmm.AgentInfoNats
+	Interpreters []InterpreterInfo `json:"interpreters"`
+}
+
+// InterpreterInfo is a script interpreter found on the agent
+type InterpreterInfo struct {
+	Name    string `json:"name"` // as used in Script.Interpreter
+	Path    string `json:"path"`
+	Version string `json:"version"` // empty if it couldn't be told
+}
+
 type CheckInDisk struct {
 	AgentHeader
 	Drives []jetrmm.StorageDrive `json:"drives"`
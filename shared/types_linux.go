@@ -0,0 +1,40 @@
+package shared
+
+// KernelEvent is a classified kernel ring buffer (/dev/kmsg) record
+type KernelEvent struct {
+	Seq      uint64 `json:"seq"`
+	Priority int    `json:"priority"` // syslog level, 0 (emerg) to 7 (debug)
+	Category string `json:"category"` // oom, fs_error, fs_readonly, hardware, hung_task
+	Message  string `json:"message"`
+	Time     string `json:"time"`
+}
+
+type KernelEventsNats struct {
+	AgentId string        `json:"agent_id"`
+	Events  []KernelEvent `json:"events"`
+}
+
+// MdArray is the state of a Linux software RAID array from /proc/mdstat
+type MdArray struct {
+	Name     string   `json:"name"`
+	State    string   `json:"state"` // active, inactive
+	Level    string   `json:"level"`
+	Devices  []string `json:"devices"`
+	Failed   []string `json:"failed"`
+	Expected int      `json:"expected"`
+	Active   int      `json:"active"`
+	Health   string   `json:"health"` // clean, degraded, resync, recovery, reshape, check, inactive
+	Progress float64  `json:"progress"`
+}
+
+// MountStatus is the result of verifying one ExpectedMount
+type MountStatus struct {
+	Path     string   `json:"path"`
+	Mounted  bool     `json:"mounted"`
+	Device   string   `json:"device"`
+	Fstype   string   `json:"fstype"`
+	Options  []string `json:"options"`
+	ReadOnly bool     `json:"read_only"`
+	Stale    bool     `json:"stale"`
+	Errors   []string `json:"errors"`
+}